@@ -1,20 +1,41 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"net/http"
+	"os"
 
 	"go.uber.org/zap"
 
+	"github.com/xgaicc/binance-proxy/internal/audit"
+	"github.com/xgaicc/binance-proxy/internal/auth"
+	"github.com/xgaicc/binance-proxy/internal/clock"
 	"github.com/xgaicc/binance-proxy/internal/config"
 	"github.com/xgaicc/binance-proxy/internal/health"
+	"github.com/xgaicc/binance-proxy/internal/keystore"
+	"github.com/xgaicc/binance-proxy/internal/killswitch"
 	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/marketdata"
+	"github.com/xgaicc/binance-proxy/internal/metrics"
+	"github.com/xgaicc/binance-proxy/internal/orderbook"
+	"github.com/xgaicc/binance-proxy/internal/policy"
 	"github.com/xgaicc/binance-proxy/internal/proxy/rest"
 	"github.com/xgaicc/binance-proxy/internal/proxy/websocket"
+	"github.com/xgaicc/binance-proxy/internal/redact"
+	"github.com/xgaicc/binance-proxy/internal/risk"
 	"github.com/xgaicc/binance-proxy/internal/server"
+	"github.com/xgaicc/binance-proxy/internal/tracing"
+	"github.com/xgaicc/binance-proxy/internal/userdata"
+	"github.com/xgaicc/binance-proxy/pkg/binance"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAudit(os.Args[2:]))
+	}
+
 	configPath := flag.String("config", "", "Path to config file")
 	flag.Parse()
 
@@ -31,30 +52,180 @@ func main() {
 	}
 	defer logger.Sync()
 
+	redactor, err := redact.New(&cfg.Redaction)
+	if err != nil {
+		logger.Fatal("Failed to configure redaction", zap.Error(err))
+	}
+
 	// Initialize request logger
-	reqLogger := logging.NewRequestLogger(logger, &cfg.Logging)
+	reqLogger := logging.NewRequestLogger(logger, &cfg.Logging, redactor)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), &cfg.Tracing)
+	if err != nil {
+		logger.Fatal("Failed to set up tracing", zap.Error(err))
+	}
+	defer func() {
+		// Flush buffered spans, without hanging on an unreachable collector
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+		defer cancel()
+		shutdownTracing(ctx)
+	}()
 
 	// Initialize handlers
 	healthHandler := health.NewHandler()
 
-	restHandler, err := rest.NewProxyHandler(cfg, reqLogger)
+	keys, err := keystore.New(&cfg.Keystore)
+	if err != nil {
+		logger.Fatal("Failed to load keystore", zap.Error(err))
+	}
+
+	clk := clock.New(&cfg.TimeSync, reqLogger)
+
+	var auditStore *audit.Store
+	if cfg.Audit.Enabled {
+		if auditStore, err = audit.Open(&cfg.Audit, redactor, reqLogger); err != nil {
+			logger.Fatal("Failed to open audit store", zap.Error(err))
+		}
+		defer auditStore.Close()
+	}
+
+	restHandler, err := rest.NewProxyHandler(cfg, keys, clk, auditStore, reqLogger)
 	if err != nil {
 		logger.Fatal("Failed to create REST proxy handler", zap.Error(err))
 	}
 
-	wsHandler := websocket.NewHandler(cfg, reqLogger)
+	authenticator, err := auth.New(&cfg.Auth)
+	if err != nil {
+		logger.Fatal("Failed to configure authentication", zap.Error(err))
+	}
+
+	var policies *policy.Engine
+	if cfg.Policy.Enabled {
+		if policies, err = policy.New(&cfg.Policy); err != nil {
+			logger.Fatal("Failed to load policies", zap.Error(err))
+		}
+	}
+
+	var riskChecker *risk.Checker
+	if cfg.Risk.Enabled {
+		if riskChecker, err = risk.New(&cfg.Risk); err != nil {
+			logger.Fatal("Failed to load risk limits", zap.Error(err))
+		}
+	}
+
+	killSwitch, err := killswitch.Open(&cfg.KillSwitch)
+	if err != nil {
+		logger.Fatal("Failed to load kill switch state", zap.Error(err))
+	}
+	if state := killSwitch.State(); state.Global != nil || len(state.Bots) > 0 {
+		logger.Warn("Kill switch engaged from previous run",
+			zap.Bool("global", state.Global != nil),
+			zap.Int("bots", len(state.Bots)))
+	}
+
+	wsHandler := websocket.NewHandler(cfg, keys, clk, &websocket.Guards{
+		Policies:   policies,
+		Risk:       riskChecker,
+		KillSwitch: killSwitch,
+	}, auditStore, reqLogger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	restHandler.Start(ctx)
+	if auditStore != nil {
+		auditStore.Start(ctx)
+	}
+
+	var bookManagers []*orderbook.Manager
+	var userDataManagers []*userdata.Manager
+	streamData := make(map[string]*marketdata.Manager)
+	for _, api := range cfg.Binance.APIs() {
+		apiType := binance.APIType(api.Name)
+		hosts := restHandler.Hosts(apiType)
+		healthHandler.AddCheck(api.Name+"_upstream", func() (any, bool) {
+			return hosts.Status()
+		})
+		clk.Add(api, restHandler)
+
+		if len(api.OrderBook.Symbols) > 0 {
+			m := orderbook.NewManager(api.Name, &api.OrderBook, wsHandler.Hub(apiType), restHandler, reqLogger)
+			m.Start(ctx)
+			bookManagers = append(bookManagers, m)
+		}
+		if len(api.StreamData.Symbols) > 0 {
+			m := marketdata.NewManager(api, wsHandler.Hub(apiType), reqLogger)
+			m.Start(ctx)
+			streamData[api.Name] = m
+			if riskChecker != nil {
+				riskChecker.AddPrices(api.Name, m)
+			}
+		}
+		if api.ListenKeyPath != "" && api.WebSocketURL != "" {
+			userDataManagers = append(userDataManagers,
+				userdata.NewManager(api.Name, api.WebSocketURL, &cfg.WebSocket, restHandler, keys, reqLogger))
+		}
+	}
+
+	if cfg.TimeSync.Enabled {
+		healthHandler.AddCheck("clock", func() (any, bool) {
+			return clk.Status()
+		})
+		clk.Start(ctx)
+	}
+
+	var orderBooks *orderbook.Handler
+	if len(bookManagers) > 0 {
+		orderBooks = orderbook.NewHandler(bookManagers, reqLogger)
+	}
+	userData := userdata.NewHandler(userDataManagers, reqLogger)
+
+	var adminAuth auth.Authenticator
+	if len(cfg.Admin.Tokens) > 0 {
+		if adminAuth, err = auth.NewTokenAuthenticator(cfg.Admin.Tokens); err != nil {
+			logger.Fatal("Failed to configure admin authentication", zap.Error(err))
+		}
+	}
+
+	var metricsHandler http.Handler
+	if cfg.Metrics.Enabled {
+		metricsHandler = metrics.Handler()
+	}
 
 	// Setup router
-	router := rest.NewRouter(restHandler, wsHandler, healthHandler, reqLogger)
+	router := rest.NewRouter(&rest.RouterConfig{
+		APIs:       cfg.Binance.APIs(),
+		REST:       restHandler,
+		WebSocket:  wsHandler,
+		Health:     healthHandler,
+		Auth:       authenticator,
+		Policies:   policies,
+		Risk:       riskChecker,
+		KillSwitch: killSwitch,
+		Admin:      killswitch.NewHandler(killSwitch, restHandler, reqLogger),
+		AdminAuth:  adminAuth,
+		Audit:      auditStore,
+		OrderBooks: orderBooks,
+		UserData:   userData,
+		Clock:      clk,
+		StreamData: streamData,
+		Metrics:    metricsHandler,
+		Logger:     reqLogger,
+	})
 
 	// Create and start server
-	srv := server.New(router, &cfg.Server, logger)
+	srv, err := server.New(router, &cfg.Server, logger)
+	if err != nil {
+		logger.Fatal("Failed to create server", zap.Error(err))
+	}
 
-	logger.Info("Binance Proxy starting",
-		zap.String("spot_rest", cfg.Binance.Spot.RestURL),
-		zap.String("spot_ws", cfg.Binance.Spot.WebSocketURL),
-		zap.String("futures_rest", cfg.Binance.Futures.RestURL),
-		zap.String("futures_ws", cfg.Binance.Futures.WebSocketURL))
+	var endpoints []zap.Field
+	for _, api := range cfg.Binance.APIs() {
+		endpoints = append(endpoints,
+			zap.String(api.Name+"_rest", api.RestURL),
+			zap.String(api.Name+"_ws", api.WebSocketURL))
+	}
+	logger.Info("Binance Proxy starting", endpoints...)
 
 	if err := srv.Start(); err != nil {
 		logger.Fatal("Server error", zap.Error(err))
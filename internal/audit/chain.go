@@ -0,0 +1,270 @@
+package audit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/xgaicc/binance-proxy/internal/logging"
+)
+
+// Digest returns the hash of r: SHA-256 over its JSON encoding without ID
+// and Hash, which includes PrevHash and so chains r to the record before
+func (r *Record) Digest() string {
+	c := *r
+	c.ID, c.Hash = 0, ""
+	content, _ := json.Marshal(c)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkpointPayload is what a checkpoint signature covers. Including the
+// previous checkpoint's signature chains the checkpoints, so that none can be
+// removed without breaking the signature of the next.
+func checkpointPayload(recordID, timeMs, records int64, hash, prevSignature string) []byte {
+	return fmt.Appendf(nil, "binance-proxy audit checkpoint %d %d %d %s %s", recordID, timeMs, records, hash, prevSignature)
+}
+
+// checkpoint signs the hash of the newest record, unless the last checkpoint
+// already covers it
+func (s *Store) checkpoint(ctx context.Context) {
+	var prevRecordID int64
+	var prevSignature string
+	err := s.db.QueryRowContext(ctx, "SELECT record_id, signature FROM checkpoints ORDER BY id DESC LIMIT 1").
+		Scan(&prevRecordID, &prevSignature)
+	if err != nil && err != sql.ErrNoRows {
+		s.logger.Error("failed to read audit checkpoints", logging.Field("error", err.Error()))
+		return
+	}
+
+	var recordID, records int64
+	var hash string
+	err = s.db.QueryRowContext(ctx, "SELECT coalesce(max(id), 0), count(*) FROM records WHERE id > ?", prevRecordID).
+		Scan(&recordID, &records)
+	if err == nil && records == 0 {
+		return
+	}
+	if err == nil {
+		err = s.db.QueryRowContext(ctx, "SELECT hash FROM records WHERE id = ?", recordID).Scan(&hash)
+	}
+	if err != nil {
+		s.logger.Error("failed to read audit chain", logging.Field("error", err.Error()))
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	signature, err := s.signer.Sign(checkpointPayload(recordID, now, records, hash, prevSignature))
+	if err == nil {
+		_, err = s.db.ExecContext(ctx,
+			"INSERT INTO checkpoints (time, record_id, records, hash, prev_signature, signature) VALUES (?, ?, ?, ?, ?, ?)",
+			now, recordID, records, hash, prevSignature, signature)
+	}
+	if err != nil {
+		s.logger.Error("failed to write audit checkpoint", logging.Field("error", err.Error()))
+	}
+}
+
+// Report is the outcome of verifying an audit database. Broken describes the
+// first broken link and is empty if the chain and every checkpoint hold.
+type Report struct {
+	Records     int
+	Unchained   int
+	FirstID     int64
+	LastID      int64
+	Checkpoints int
+	Broken      string
+	BrokenID    int64
+}
+
+// Verify walks the records of the audit database at path in order, checking
+// each record's hash and its link to the record before, and each checkpoint's
+// link to the checkpoint before. Records from before chaining was introduced
+// are counted as unchained. The oldest remaining record's link, and the
+// oldest remaining checkpoint's, are taken on trust, as older ones may have
+// been pruned.
+//
+// With pub, checkpoint signatures are verified too, and every chained record
+// older than interval must be covered by a checkpoint, as the store signs one
+// at least that often; with an interval of zero every record must be.
+// Without pub, checkpoints prove nothing, as anyone could have written them.
+func Verify(ctx context.Context, path string, pub ed25519.PublicKey, interval time.Duration) (*Report, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	checkpoints, err := loadCheckpoints(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT "+recordColumns+" FROM records ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &Report{}
+	broken := func(id int64, format string, args ...any) {
+		if report.Broken == "" {
+			report.BrokenID = id
+			report.Broken = fmt.Sprintf(format, args...)
+		}
+	}
+
+	var prev string
+	var prevCheckpoint *checkpoint
+	// since counts the records after the last checkpoint; uncovered is the
+	// first of them
+	var since int64
+	var uncovered *Record
+	for rows.Next() && report.Broken == "" {
+		r, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		report.Records++
+		if report.FirstID == 0 {
+			report.FirstID = r.ID
+		}
+		report.LastID = r.ID
+
+		if r.Hash == "" {
+			if prev != "" {
+				broken(r.ID, "record %d has no hash", r.ID)
+			}
+			report.Unchained++
+			continue
+		}
+		if prev != "" && r.PrevHash != prev {
+			broken(r.ID, "record %d does not link to the record before it; records were deleted or reordered", r.ID)
+		} else if r.Digest() != r.Hash {
+			broken(r.ID, "record %d does not match its hash; it was modified", r.ID)
+		}
+		prev = r.Hash
+
+		since++
+		if uncovered == nil {
+			uncovered = &r
+		}
+		cp, ok := checkpoints[r.ID]
+		if !ok {
+			continue
+		}
+		delete(checkpoints, r.ID)
+		report.Checkpoints++
+
+		switch {
+		case cp.hash != r.Hash:
+			broken(r.ID, "checkpoint %d does not match record %d", cp.id, r.ID)
+		case prevCheckpoint != nil && cp.prevSignature != prevCheckpoint.signature:
+			broken(r.ID, "checkpoint %d does not link to checkpoint %d; checkpoints were deleted", cp.id, prevCheckpoint.id)
+		case prevCheckpoint != nil && cp.records != since:
+			broken(r.ID, "checkpoint %d covers %d records, but %d remain; records were deleted", cp.id, cp.records, since)
+		case pub != nil && !cp.verify(pub, r.ID):
+			broken(r.ID, "checkpoint %d for record %d has an invalid signature", cp.id, r.ID)
+		}
+		prevCheckpoint = &cp
+		since = 0
+		uncovered = nil
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Checkpoints are pruned with their records, so any left over point at
+	// records that were deleted
+	var missing int64
+	for recordID := range checkpoints {
+		if recordID >= report.FirstID && (missing == 0 || recordID < missing) {
+			missing = recordID
+		}
+	}
+	if missing > 0 {
+		broken(missing, "checkpoint %d covers record %d, which is missing", checkpoints[missing].id, missing)
+	}
+
+	if pub != nil && uncovered != nil && time.UnixMilli(uncovered.Time).Before(time.Now().Add(-interval)) {
+		broken(uncovered.ID, "record %d is not covered by a checkpoint; checkpoints were deleted", uncovered.ID)
+	}
+	return report, nil
+}
+
+type checkpoint struct {
+	id            int64
+	time          int64
+	records       int64
+	hash          string
+	prevSignature string
+	signature     string
+}
+
+// verify checks the signature of the checkpoint covering recordID
+func (cp *checkpoint) verify(pub ed25519.PublicKey, recordID int64) bool {
+	signature, err := base64.StdEncoding.DecodeString(cp.signature)
+	return err == nil && ed25519.Verify(pub, checkpointPayload(recordID, cp.time, cp.records, cp.hash, cp.prevSignature), signature)
+}
+
+func loadCheckpoints(ctx context.Context, db *sql.DB) (map[int64]checkpoint, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, time, record_id, records, hash, prev_signature, signature FROM checkpoints")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checkpoints := make(map[int64]checkpoint)
+	for rows.Next() {
+		var cp checkpoint
+		var recordID int64
+		if err := rows.Scan(&cp.id, &cp.time, &recordID, &cp.records, &cp.hash, &cp.prevSignature, &cp.signature); err != nil {
+			return nil, err
+		}
+		checkpoints[recordID] = cp
+	}
+	return checkpoints, rows.Err()
+}
+
+// LoadPublicKey reads the Ed25519 key checkpoints are verified with from a
+// PEM file holding either the public key or the signing key itself
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", path)
+	}
+
+	var parsed any
+	if block.Type == "PUBLIC KEY" {
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	} else {
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	switch key := parsed.(type) {
+	case ed25519.PublicKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key.Public().(ed25519.PublicKey), nil
+	default:
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+}
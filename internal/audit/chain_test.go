@@ -0,0 +1,149 @@
+package audit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/logging"
+)
+
+// newChain writes 15 records older than an hour to a new database, with a
+// checkpoint after every 5, and returns its path and the checkpoint key
+func newChain(t *testing.T) (string, ed25519.PublicKey) {
+	t.Helper()
+	dir := t.TempDir()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "audit.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.AuditConfig{Path: filepath.Join(dir, "audit.db"), SigningKeyFile: keyFile}
+	s, err := Open(cfg, nil, logging.NewRequestLogger(zap.NewNop(), &config.LoggingConfig{}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour).UnixMilli()
+	for range 3 {
+		var batch []*Record
+		for range 5 {
+			batch = append(batch, &Record{Time: old, Transport: TransportREST, Method: "POST", Path: "/api/v3/order", Symbol: "BTCUSDT"})
+		}
+		if err := s.insert(batch); err != nil {
+			t.Fatal(err)
+		}
+		s.checkpoint(context.Background())
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Path, pub
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper []string
+		// wantID is the record the chain is reported broken at, 0 if intact
+		wantID   int64
+		wantText string
+	}{
+		{
+			name: "intact",
+		},
+		{
+			name: "oldest records pruned",
+			tamper: []string{
+				"DELETE FROM records WHERE id <= 5",
+				"DELETE FROM checkpoints WHERE record_id <= 5",
+			},
+		},
+		{
+			name:     "record modified",
+			tamper:   []string{"UPDATE records SET symbol = 'ETHUSDT' WHERE id = 7"},
+			wantID:   7,
+			wantText: "was modified",
+		},
+		{
+			name:     "record deleted",
+			tamper:   []string{"DELETE FROM records WHERE id = 7"},
+			wantID:   8,
+			wantText: "does not link to the record before it",
+		},
+		{
+			name:     "middle checkpoint deleted",
+			tamper:   []string{"DELETE FROM checkpoints WHERE record_id = 10"},
+			wantID:   15,
+			wantText: "does not link to checkpoint",
+		},
+		{
+			name:     "newest checkpoint deleted",
+			tamper:   []string{"DELETE FROM checkpoints WHERE record_id = 15"},
+			wantID:   11,
+			wantText: "not covered by a checkpoint",
+		},
+		{
+			name:     "all checkpoints deleted",
+			tamper:   []string{"DELETE FROM checkpoints"},
+			wantID:   1,
+			wantText: "not covered by a checkpoint",
+		},
+		{
+			name:     "checkpoint signature forged",
+			tamper:   []string{"UPDATE checkpoints SET signature = (SELECT signature FROM checkpoints WHERE record_id = 5) WHERE record_id = 10"},
+			wantID:   10,
+			wantText: "invalid signature",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, pub := newChain(t)
+
+			db, err := sql.Open("sqlite3", "file:"+path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, stmt := range tt.tamper {
+				if _, err := db.Exec(stmt); err != nil {
+					t.Fatalf("%s: %v", stmt, err)
+				}
+			}
+			db.Close()
+
+			report, err := Verify(context.Background(), path, pub, time.Hour)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if tt.wantID == 0 {
+				if report.Broken != "" {
+					t.Errorf("chain reported broken: %s", report.Broken)
+				}
+				return
+			}
+			if report.BrokenID != tt.wantID || !strings.Contains(report.Broken, tt.wantText) {
+				t.Errorf("broken at %d (%q), want %d (%q)", report.BrokenID, report.Broken, tt.wantID, tt.wantText)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/xgaicc/binance-proxy/internal/logging"
+)
+
+// Records serves the records matching the query parameters bot, apiType,
+// symbol, clientOrderId, orderId, startTime and endTime (in milliseconds),
+// newest first. limit caps the page size and beforeId continues from the
+// last record of the previous page.
+func (s *Store) Records(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := Filter{
+		Bot:           q.Get("bot"),
+		APIType:       q.Get("apiType"),
+		Symbol:        q.Get("symbol"),
+		ClientOrderID: q.Get("clientOrderId"),
+		OrderID:       q.Get("orderId"),
+	}
+
+	var err error
+	if f.StartTime, err = timeParam(q.Get("startTime")); err != nil {
+		http.Error(w, "invalid startTime", http.StatusBadRequest)
+		return
+	}
+	if f.EndTime, err = timeParam(q.Get("endTime")); err != nil {
+		http.Error(w, "invalid endTime", http.StatusBadRequest)
+		return
+	}
+	if v := q.Get("beforeId"); v != "" {
+		if f.BeforeID, err = strconv.ParseInt(v, 10, 64); err != nil || f.BeforeID <= 0 {
+			http.Error(w, "invalid beforeId", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 || f.Limit > MaxLimit {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := s.Query(r.Context(), f)
+	if err != nil {
+		s.logger.Error("failed to query audit records", logging.Field("error", err.Error()))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
+
+func timeParam(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(ms), nil
+}
@@ -0,0 +1,48 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// order holds the identifying fields of an order in a Binance response
+type order struct {
+	Symbol        string      `json:"symbol"`
+	ClientOrderID string      `json:"clientOrderId"`
+	OrderID       json.Number `json:"orderId"`
+}
+
+// Identify sets the symbol and order IDs of rec from the request parameters
+// and the order in the response, if it holds one. The response's IDs win, as
+// they are what Binance assigned.
+func (rec *Record) Identify(params url.Values, response []byte) {
+	rec.Symbol = strings.ToUpper(params.Get("symbol"))
+	rec.ClientOrderID = params.Get("newClientOrderId")
+	if rec.ClientOrderID == "" {
+		rec.ClientOrderID = params.Get("origClientOrderId")
+	}
+	rec.OrderID = params.Get("orderId")
+
+	// Batch orders carry their symbol per order
+	if rec.Symbol == "" && params.Has("batchOrders") {
+		var batch []order
+		if json.Unmarshal([]byte(params.Get("batchOrders")), &batch) == nil && len(batch) > 0 {
+			rec.Symbol = strings.ToUpper(batch[0].Symbol)
+		}
+	}
+
+	var o order
+	if json.Unmarshal(response, &o) != nil {
+		return
+	}
+	if o.Symbol != "" {
+		rec.Symbol = o.Symbol
+	}
+	if o.ClientOrderID != "" {
+		rec.ClientOrderID = o.ClientOrderID
+	}
+	if o.OrderID != "" {
+		rec.OrderID = o.OrderID.String()
+	}
+}
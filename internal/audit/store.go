@@ -0,0 +1,537 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/keystore"
+	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/redact"
+)
+
+const (
+	queueSize     = 4096
+	maxBatch      = 256
+	pruneInterval = 10 * time.Minute
+	pruneBatch    = 1000
+
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// Transports a record was received over. Internal records are of requests
+// the proxy issued itself, such as kill switch cancels, and of gaps.
+const (
+	TransportREST      = "rest"
+	TransportWebSocket = "websocket"
+	TransportInternal  = "internal"
+)
+
+// MethodGap marks a record written in place of records dropped because the
+// queue was full. Its response holds the number dropped.
+const MethodGap = "audit.gap"
+
+// Record is one signed request and the full response it got. REST requests
+// keep their query string in Request and form body in Body. WebSocket API
+// requests keep the whole message in Request, the API method (order.place)
+// in Method and the path of its REST equivalent, if any, in Path.
+type Record struct {
+	ID            int64   `json:"id"`
+	Time          int64   `json:"time"`
+	DurationMs    float64 `json:"durationMs"`
+	Transport     string  `json:"transport"`
+	APIType       string  `json:"apiType"`
+	Bot           string  `json:"bot,omitempty"`
+	ClientIP      string  `json:"clientIp"`
+	APIKey        string  `json:"apiKey,omitempty"`
+	Method        string  `json:"method"`
+	Path          string  `json:"path,omitempty"`
+	Symbol        string  `json:"symbol,omitempty"`
+	ClientOrderID string  `json:"clientOrderId,omitempty"`
+	OrderID       string  `json:"orderId,omitempty"`
+	Status        int     `json:"status"`
+	Request       string  `json:"request"`
+	Body          string  `json:"body,omitempty"`
+	Response      string  `json:"response"`
+	// PrevHash is the Hash of the record before; see Digest
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+}
+
+// Filter selects records. Zero fields match everything.
+type Filter struct {
+	Bot           string
+	APIType       string
+	Symbol        string
+	ClientOrderID string
+	OrderID       string
+	StartTime     time.Time
+	EndTime       time.Time
+	// BeforeID pages back from the last record of the previous page
+	BeforeID int64
+	Limit    int
+}
+
+// Store keeps audit records in an embedded SQLite database. Records are
+// written in the background so that a slow disk never holds up trading; if
+// the queue overflows, records are dropped and a gap record in the chain
+// counts them. Each record is chained to the one before by its hash, and the
+// chain is signed at checkpoints when a signing key is configured.
+type Store struct {
+	db       *sql.DB
+	cfg      *config.AuditConfig
+	signer   keystore.Signer
+	redactor *redact.Redactor
+	logger   *logging.RequestLogger
+	// last is the hash of the newest record, owned by the writer
+	last string
+	// dropped counts records dropped since the last gap record
+	dropped atomic.Int64
+
+	mu     sync.RWMutex
+	queue  chan *Record
+	closed bool
+	done   chan struct{}
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS records (
+	id              INTEGER PRIMARY KEY AUTOINCREMENT,
+	time            INTEGER NOT NULL,
+	duration_ms     REAL NOT NULL,
+	transport       TEXT NOT NULL,
+	api_type        TEXT NOT NULL,
+	bot             TEXT NOT NULL,
+	client_ip       TEXT NOT NULL,
+	api_key         TEXT NOT NULL,
+	method          TEXT NOT NULL,
+	path            TEXT NOT NULL,
+	symbol          TEXT NOT NULL,
+	client_order_id TEXT NOT NULL,
+	order_id        TEXT NOT NULL,
+	status          INTEGER NOT NULL,
+	request         TEXT NOT NULL,
+	body            TEXT NOT NULL,
+	response        TEXT NOT NULL,
+	prev_hash       TEXT NOT NULL DEFAULT '',
+	hash            TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS records_time ON records (time);
+CREATE INDEX IF NOT EXISTS records_bot ON records (bot, time);
+CREATE INDEX IF NOT EXISTS records_symbol ON records (symbol, time);
+CREATE INDEX IF NOT EXISTS records_client_order_id ON records (client_order_id);
+CREATE INDEX IF NOT EXISTS records_order_id ON records (order_id);
+CREATE TABLE IF NOT EXISTS checkpoints (
+	id             INTEGER PRIMARY KEY AUTOINCREMENT,
+	time           INTEGER NOT NULL,
+	record_id      INTEGER NOT NULL,
+	records        INTEGER NOT NULL DEFAULT 0,
+	hash           TEXT NOT NULL,
+	prev_signature TEXT NOT NULL DEFAULT '',
+	signature      TEXT NOT NULL
+);
+`
+
+// recordColumns are the columns of a Record in the order scanRecord reads
+const recordColumns = `id, time, duration_ms, transport, api_type, bot, client_ip, api_key, method, path,
+	symbol, client_order_id, order_id, status, request, body, response, prev_hash, hash`
+
+// Open opens or creates the database at cfg.Path and starts the writer.
+// Requests and responses pass through redactor before they are stored.
+func Open(cfg *config.AuditConfig, redactor *redact.Redactor, logger *logging.RequestLogger) (*Store, error) {
+	if dir := filepath.Dir(cfg.Path); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("audit directory: %w", err)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+cfg.Path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(wal)")
+	if err != nil {
+		return nil, fmt.Errorf("open audit database: %w", err)
+	}
+	// Incremental vacuum lets pruning return space to the filesystem. It
+	// only takes effect on a new database, before any table exists.
+	if _, err := db.Exec("PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("audit database: %w", err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("audit schema: %w", err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("audit schema: %w", err)
+	}
+
+	s := &Store{
+		db:       db,
+		cfg:      cfg,
+		redactor: redactor,
+		logger:   logger,
+		queue:    make(chan *Record, queueSize),
+		done:     make(chan struct{}),
+	}
+	if cfg.SigningKeyFile != "" {
+		if s.signer, err = keystore.LoadPrivateKey(cfg.SigningKeyFile, keystore.KeyTypeEd25519); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("audit signing key: %w", err)
+		}
+	}
+	err = db.QueryRow("SELECT hash FROM records ORDER BY id DESC LIMIT 1").Scan(&s.last)
+	if err != nil && err != sql.ErrNoRows {
+		db.Close()
+		return nil, fmt.Errorf("audit chain: %w", err)
+	}
+
+	go s.write()
+	return s, nil
+}
+
+// migrations are the columns added since the tables were introduced.
+// Records from before chaining stay unchained.
+var migrations = []struct{ table, column, definition string }{
+	{"records", "prev_hash", "TEXT NOT NULL DEFAULT ''"},
+	{"records", "hash", "TEXT NOT NULL DEFAULT ''"},
+	{"checkpoints", "records", "INTEGER NOT NULL DEFAULT 0"},
+	{"checkpoints", "prev_signature", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// migrate adds the columns missing from databases created by earlier
+// versions
+func migrate(db *sql.DB) error {
+	for _, m := range migrations {
+		var n int
+		err := db.QueryRow("SELECT count(*) FROM pragma_table_info(?) WHERE name = ?", m.table, m.column).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE " + m.table + " ADD COLUMN " + m.column + " " + m.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start prunes records beyond the retention and size limits, and signs
+// checkpoints if a signing key is configured, until ctx is cancelled
+func (s *Store) Start(ctx context.Context) {
+	if s.signer != nil && s.cfg.CheckpointInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(s.cfg.CheckpointInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					s.checkpoint(ctx)
+				}
+			}
+		}()
+	}
+
+	if s.cfg.Retention <= 0 && s.cfg.MaxSizeMB <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+
+		for {
+			s.prune(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Record queues rec for writing. It never blocks and does nothing on a nil
+// store.
+func (s *Store) Record(rec *Record) {
+	if s == nil {
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return
+	}
+	rec.Request = s.redactor.String(rec.Request)
+	rec.Body = s.redactor.String(rec.Body)
+	rec.Response = s.redactor.JSON(rec.Response)
+	select {
+	case s.queue <- rec:
+	default:
+		s.dropped.Add(1)
+		s.logger.Error("audit queue full, record dropped",
+			logging.Field("api_type", rec.APIType),
+			logging.Field("bot", rec.Bot),
+			logging.Field("method", rec.Method),
+			logging.Field("path", rec.Path),
+			logging.Field("client_order_id", rec.ClientOrderID))
+	}
+}
+
+// Close writes the queued records, signs a final checkpoint and closes the
+// database
+func (s *Store) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	<-s.done
+	if s.signer != nil {
+		s.checkpoint(context.Background())
+	}
+	return s.db.Close()
+}
+
+// write inserts queued records, batching those that arrive together into
+// one transaction
+func (s *Store) write() {
+	defer close(s.done)
+
+	for rec := range s.queue {
+		batch := []*Record{rec}
+	fill:
+		for len(batch) < maxBatch {
+			select {
+			case rec, ok := <-s.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, rec)
+			default:
+				break fill
+			}
+		}
+
+		if gap := s.gap(); gap != nil {
+			batch = append([]*Record{gap}, batch...)
+		}
+		if err := s.insert(batch); err != nil {
+			s.logger.Error("failed to write audit records",
+				logging.Field("records", len(batch)),
+				logging.Field("error", err.Error()))
+		}
+	}
+
+	if gap := s.gap(); gap != nil {
+		if err := s.insert([]*Record{gap}); err != nil {
+			s.logger.Error("failed to write audit gap record", logging.Field("error", err.Error()))
+		}
+	}
+}
+
+// gap returns a record of the records dropped since the last one, if any
+func (s *Store) gap() *Record {
+	n := s.dropped.Swap(0)
+	if n == 0 {
+		return nil
+	}
+	return &Record{
+		Time:      time.Now().UnixMilli(),
+		Transport: TransportInternal,
+		Method:    MethodGap,
+		Response:  fmt.Sprintf(`{"dropped":%d}`, n),
+	}
+}
+
+func (s *Store) insert(batch []*Record) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO records (
+		time, duration_ms, transport, api_type, bot, client_ip, api_key, method, path,
+		symbol, client_order_id, order_id, status, request, body, response, prev_hash, hash
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	last := s.last
+	for _, r := range batch {
+		r.PrevHash = last
+		r.Hash = r.Digest()
+		last = r.Hash
+
+		if _, err := stmt.Exec(
+			r.Time, r.DurationMs, r.Transport, r.APIType, r.Bot, r.ClientIP, r.APIKey, r.Method, r.Path,
+			r.Symbol, r.ClientOrderID, r.OrderID, r.Status, r.Request, r.Body, r.Response, r.PrevHash, r.Hash,
+		); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.last = last
+	return nil
+}
+
+// Query returns the records matching f, newest first
+func (s *Store) Query(ctx context.Context, f Filter) ([]Record, error) {
+	var where []string
+	var args []any
+	match := func(column string, value any) {
+		where = append(where, column+" = ?")
+		args = append(args, value)
+	}
+	if f.Bot != "" {
+		match("bot", f.Bot)
+	}
+	if f.APIType != "" {
+		match("api_type", f.APIType)
+	}
+	if f.Symbol != "" {
+		match("symbol", strings.ToUpper(f.Symbol))
+	}
+	if f.ClientOrderID != "" {
+		match("client_order_id", f.ClientOrderID)
+	}
+	if f.OrderID != "" {
+		match("order_id", f.OrderID)
+	}
+	if !f.StartTime.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, f.StartTime.UnixMilli())
+	}
+	if !f.EndTime.IsZero() {
+		where = append(where, "time <= ?")
+		args = append(args, f.EndTime.UnixMilli())
+	}
+	if f.BeforeID > 0 {
+		where = append(where, "id < ?")
+		args = append(args, f.BeforeID)
+	}
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	limit = min(limit, MaxLimit)
+
+	query := "SELECT " + recordColumns + " FROM records"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []Record{}
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+func scanRecord(rows *sql.Rows) (Record, error) {
+	var r Record
+	err := rows.Scan(
+		&r.ID, &r.Time, &r.DurationMs, &r.Transport, &r.APIType, &r.Bot, &r.ClientIP, &r.APIKey, &r.Method, &r.Path,
+		&r.Symbol, &r.ClientOrderID, &r.OrderID, &r.Status, &r.Request, &r.Body, &r.Response, &r.PrevHash, &r.Hash,
+	)
+	return r, err
+}
+
+// prune deletes records older than the retention period, then the oldest
+// records while the database is over its size limit
+func (s *Store) prune(ctx context.Context) {
+	var deleted int64
+	if s.cfg.Retention > 0 {
+		cutoff := time.Now().Add(-s.cfg.Retention).UnixMilli()
+		res, err := s.db.ExecContext(ctx, "DELETE FROM records WHERE time < ?", cutoff)
+		if err != nil {
+			s.logger.Error("failed to prune audit records", logging.Field("error", err.Error()))
+			return
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+
+	if s.cfg.MaxSizeMB > 0 {
+		limit := int64(s.cfg.MaxSizeMB) << 20
+		for {
+			size, err := s.size(ctx)
+			if err != nil || size <= limit {
+				break
+			}
+			// Delete the share of records the excess amounts to, assuming
+			// records of average size, in batches short enough not to hold
+			// up the writer
+			var count int64
+			if err := s.db.QueryRowContext(ctx, "SELECT count(*) FROM records").Scan(&count); err != nil || count == 0 {
+				break
+			}
+			batch := min(count*(size-limit)/size+1, pruneBatch)
+			res, err := s.db.ExecContext(ctx,
+				"DELETE FROM records WHERE id IN (SELECT id FROM records ORDER BY id LIMIT ?)", batch)
+			if err != nil {
+				s.logger.Error("failed to prune audit records", logging.Field("error", err.Error()))
+				return
+			}
+			n, _ := res.RowsAffected()
+			if n == 0 {
+				break
+			}
+			deleted += n
+		}
+	}
+
+	if deleted == 0 {
+		return
+	}
+	// Checkpoints of pruned records can no longer be verified
+	s.db.ExecContext(ctx,
+		"DELETE FROM checkpoints WHERE record_id < (SELECT coalesce(min(id), 9223372036854775807) FROM records)")
+	s.db.ExecContext(ctx, "PRAGMA incremental_vacuum")
+	s.db.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)")
+	s.logger.Info("pruned audit records", logging.Field("records", deleted))
+}
+
+// size returns the bytes used by the database, not counting free pages
+func (s *Store) size(ctx context.Context) (int64, error) {
+	var pages, free, pageSize int64
+	err := s.db.QueryRowContext(ctx,
+		"SELECT page_count, freelist_count, page_size FROM pragma_page_count(), pragma_freelist_count(), pragma_page_size()").
+		Scan(&pages, &free, &pageSize)
+	return (pages - free) * pageSize, err
+}
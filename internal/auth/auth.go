@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+)
+
+// Authentication methods reported in Identity.Method
+const (
+	MethodToken = "token"
+	MethodHMAC  = "hmac"
+	MethodMTLS  = "mtls"
+)
+
+// ErrUnauthenticated is returned when no authenticator recognised the request
+var ErrUnauthenticated = errors.New("no valid credentials")
+
+// Identity is the bot a request was authenticated as
+type Identity struct {
+	Bot    string
+	Method string
+}
+
+// Authenticator identifies the bot behind a request. It returns nil, nil when
+// the request carries none of the credentials it understands, so that the next
+// authenticator can try, and an error when credentials are present but invalid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Chain tries each authenticator in order
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range c {
+		id, err := a.Authenticate(r)
+		if err != nil || id != nil {
+			return id, err
+		}
+	}
+	return nil, ErrUnauthenticated
+}
+
+// New builds the authenticator chain from configuration. It returns nil when
+// authentication is disabled.
+func New(cfg *config.AuthConfig) (Authenticator, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	var chain Chain
+
+	if len(cfg.MTLS) > 0 {
+		chain = append(chain, NewMTLSAuthenticator(cfg.MTLS))
+	}
+
+	if len(cfg.Tokens) > 0 {
+		a, err := NewTokenAuthenticator(cfg.Tokens)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, a)
+	}
+
+	if len(cfg.HMAC.Clients) > 0 {
+		a, err := NewHMACAuthenticator(&cfg.HMAC)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, a)
+	}
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("auth is enabled but no tokens, hmac clients or mtls bots are configured")
+	}
+	return chain, nil
+}
+
+// StripHeaders removes proxy authentication headers before a request is sent
+// upstream
+func StripHeaders(header http.Header) {
+	header.Del("Authorization")
+	header.Del(HeaderClient)
+	header.Del(HeaderTimestamp)
+	header.Del(HeaderSignature)
+}
+
+type contextKey struct{}
+
+// WithIdentity returns a copy of ctx carrying id
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity stored by WithIdentity
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(*Identity)
+	return id, ok
+}
+
+// Bot returns the authenticated bot name for a request, or "" if the request
+// was not authenticated
+func Bot(r *http.Request) string {
+	if id, ok := FromContext(r.Context()); ok {
+		return id.Bot
+	}
+	return ""
+}
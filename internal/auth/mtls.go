@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+)
+
+// MTLSAuthenticator maps the common name of a verified client certificate to
+// a bot. Certificate verification itself happens in the TLS handshake against
+// server.tls.clientCaFile.
+type MTLSAuthenticator struct {
+	bots map[string]string
+}
+
+func NewMTLSAuthenticator(entries []config.MTLSAuthConfig) *MTLSAuthenticator {
+	a := &MTLSAuthenticator{bots: make(map[string]string, len(entries))}
+	for _, e := range entries {
+		bot := e.Bot
+		if bot == "" {
+			bot = e.CommonName
+		}
+		a.bots[e.CommonName] = bot
+	}
+	return a
+}
+
+func (a *MTLSAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	bot, ok := a.bots[cn]
+	if !ok {
+		return nil, fmt.Errorf("client certificate %q is not mapped to a bot", cn)
+	}
+	return &Identity{Bot: bot, Method: MethodMTLS}, nil
+}
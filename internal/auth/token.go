@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+)
+
+// TokenAuthenticator accepts static bearer tokens
+type TokenAuthenticator struct {
+	// Tokens are compared by hash so that lookups take constant time
+	bots map[[sha256.Size]byte]string
+}
+
+func NewTokenAuthenticator(tokens []config.TokenAuthConfig) (*TokenAuthenticator, error) {
+	a := &TokenAuthenticator{bots: make(map[[sha256.Size]byte]string, len(tokens))}
+
+	for _, tc := range tokens {
+		token := tc.Token
+		if tc.TokenEnv != "" {
+			token = os.Getenv(tc.TokenEnv)
+		}
+		if tc.Bot == "" || token == "" {
+			return nil, fmt.Errorf("token auth: bot %q needs a bot name and token", tc.Bot)
+		}
+		a.bots[sha256.Sum256([]byte(token))] = tc.Bot
+	}
+
+	return a, nil
+}
+
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	header := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return nil, nil
+	}
+
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	for known, bot := range a.bots {
+		if subtle.ConstantTimeCompare(known[:], sum[:]) == 1 {
+			return &Identity{Bot: bot, Method: MethodToken}, nil
+		}
+	}
+	return nil, errors.New("invalid bearer token")
+}
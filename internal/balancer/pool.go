@@ -0,0 +1,258 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/ratelimit"
+)
+
+// latencyAlpha weights the newest probe in a host's latency average
+const latencyAlpha = 0.3
+
+// Host is one REST base URL of an API family
+type Host struct {
+	URL    *url.URL
+	weight int
+
+	// Guarded by the pool's mutex
+	healthy  bool
+	failures int
+	latency  time.Duration
+}
+
+// HostStatus is a host's state as reported by the readiness endpoint
+type HostStatus struct {
+	URL       string  `json:"url"`
+	Healthy   bool    `json:"healthy"`
+	LatencyMs float64 `json:"latencyMs"`
+}
+
+// Limiter holds back requests the pool sends on its own, health probes and
+// failover attempts, while the upstream bans the proxy's IP, and reserves
+// their weight
+type Limiter interface {
+	// Admit returns an error if req must not be sent
+	Admit(req *http.Request) error
+	// Observe records the rate limit headers and bans of a response
+	Observe(resp *http.Response)
+}
+
+// Pool balances the requests of one API family across its REST hosts. Hosts
+// are probed for health and latency, and marked down after repeated failures
+// of probes or requests.
+type Pool struct {
+	tag      string
+	pingPath string
+	cfg      config.HealthCheckConfig
+	client   *http.Client
+	limiter  Limiter
+	logger   *logging.RequestLogger
+
+	mu    sync.Mutex
+	hosts []*Host
+}
+
+func NewPool(cfg *config.APIEndpoints, limiter Limiter, logger *logging.RequestLogger) (*Pool, error) {
+	p := &Pool{
+		tag:      cfg.Tag,
+		pingPath: cfg.PingPath,
+		cfg:      cfg.HealthCheck,
+		client:   &http.Client{Timeout: cfg.HealthCheck.Timeout},
+		limiter:  limiter,
+		logger:   logger,
+	}
+	for _, u := range cfg.RestURLs {
+		target, err := url.Parse(u.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%s upstream %q: %w", cfg.Name, u.URL, err)
+		}
+		p.hosts = append(p.hosts, &Host{URL: target, weight: u.Weight, healthy: true})
+	}
+	if len(p.hosts) == 0 {
+		return nil, fmt.Errorf("%s: no REST upstreams configured", cfg.Name)
+	}
+	return p, nil
+}
+
+// Primary returns the first configured host
+func (p *Pool) Primary() *Host {
+	return p.hosts[0]
+}
+
+// Len returns the number of hosts
+func (p *Pool) Len() int {
+	return len(p.hosts)
+}
+
+// Start probes every host until ctx is cancelled. A single host is not
+// probed, since there is nothing to fail over to.
+func (p *Pool) Start(ctx context.Context) {
+	if len(p.hosts) < 2 || p.pingPath == "" || p.cfg.Interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(p.cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			p.probeAll(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (p *Pool) probeAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, h := range p.hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.probe(ctx, h)
+		}()
+	}
+	wg.Wait()
+}
+
+// probe measures a host's latency. Probes are skipped during a ban, and a
+// rate limited probe says nothing about the host: every host shares the
+// same limits.
+func (p *Pool) probe(ctx context.Context, h *Host) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.URL.JoinPath(p.pingPath).String(), nil)
+	if err != nil {
+		return
+	}
+	if p.limiter.Admit(req) != nil {
+		return
+	}
+
+	start := time.Now()
+	resp, err := p.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		p.limiter.Observe(resp)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == ratelimit.StatusIPBanned {
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		p.Failed(h, "probe: "+err.Error())
+		return
+	}
+
+	p.mu.Lock()
+	rtt := time.Since(start)
+	if h.latency == 0 {
+		h.latency = rtt
+	} else {
+		h.latency = time.Duration(latencyAlpha*float64(rtt) + (1-latencyAlpha)*float64(h.latency))
+	}
+	p.mu.Unlock()
+	p.Succeeded(h)
+}
+
+// Pick returns the healthy host with the lowest latency relative to its
+// weight, skipping those in tried. When every host is down the one with the
+// fewest failures in a row is tried anyway. It returns nil once all hosts
+// have been tried.
+func (p *Pool) Pick(tried []*Host) *Host {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best, fallback *Host
+	for _, h := range p.hosts {
+		if slices.Contains(tried, h) {
+			continue
+		}
+		if !h.healthy {
+			if fallback == nil || h.failures < fallback.failures {
+				fallback = h
+			}
+			continue
+		}
+		if best == nil || faster(h, best) {
+			best = h
+		}
+	}
+	if best == nil {
+		return fallback
+	}
+	return best
+}
+
+// faster compares latency divided by weight; hosts not yet measured count
+// as fastest, and ties go to the heavier host
+func faster(a, b *Host) bool {
+	sa := float64(a.latency) / float64(a.weight)
+	sb := float64(b.latency) / float64(b.weight)
+	if sa != sb {
+		return sa < sb
+	}
+	return a.weight > b.weight
+}
+
+// Succeeded records a successful request or probe, bringing a down host back
+func (p *Pool) Succeeded(h *Host) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h.failures = 0
+	if !h.healthy {
+		h.healthy = true
+		p.logger.Info("upstream host recovered",
+			logging.Field("api_type", p.tag),
+			logging.Field("host", h.URL.Host))
+	}
+}
+
+// Failed records a failed request or probe, taking the host down once
+// FailureThreshold failures happened in a row
+func (p *Pool) Failed(h *Host, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h.failures++
+	if h.healthy && h.failures >= p.cfg.FailureThreshold {
+		h.healthy = false
+		p.logger.Warn("upstream host marked down",
+			logging.Field("api_type", p.tag),
+			logging.Field("host", h.URL.Host),
+			logging.Field("failures", h.failures),
+			logging.Field("reason", reason))
+	}
+}
+
+// Status reports every host and whether any of them is healthy
+func (p *Pool) Status() ([]HostStatus, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	statuses := make([]HostStatus, len(p.hosts))
+	ready := false
+	for i, h := range p.hosts {
+		statuses[i] = HostStatus{
+			URL:       h.URL.String(),
+			Healthy:   h.healthy,
+			LatencyMs: float64(h.latency.Microseconds()) / 1000,
+		}
+		ready = ready || h.healthy
+	}
+	return statuses, ready
+}
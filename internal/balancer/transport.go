@@ -0,0 +1,100 @@
+package balancer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/metrics"
+)
+
+// Transport sends each request to a host picked from the pool. Requests that
+// are safe to repeat fail over to the next host when one is unreachable or
+// answers with a gateway error. Each failover reserves its own weight, and
+// none is sent during a ban.
+func (p *Pool) Transport(base http.RoundTripper) http.RoundTripper {
+	return &transport{pool: p, base: base}
+}
+
+type transport struct {
+	pool *Pool
+	base http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var tried []*Host
+	for {
+		host := t.pool.Pick(tried)
+		tried = append(tried, host)
+
+		out := req.Clone(req.Context())
+		out.URL.Scheme = host.URL.Scheme
+		out.URL.Host = host.URL.Host
+		out.Host = host.URL.Host
+
+		resp, err := t.base.RoundTrip(out)
+		if err != nil && req.Context().Err() != nil {
+			// The client went away; the host is not to blame
+			return nil, err
+		}
+		if err != nil {
+			metrics.DialFailed(t.pool.tag, metrics.TransportREST)
+		}
+		reason := Failure(resp, err)
+		if reason == "" {
+			t.pool.Succeeded(host)
+			return resp, nil
+		}
+		t.pool.Failed(host, reason)
+
+		if !Safe(req) || len(tried) == t.pool.Len() {
+			return resp, err
+		}
+		if resp != nil {
+			t.pool.limiter.Observe(resp)
+		}
+		if admitErr := t.pool.limiter.Admit(req); admitErr != nil {
+			t.pool.logger.Warn("not failing over to next upstream host",
+				logging.Field("api_type", t.pool.tag),
+				logging.Field("host", host.URL.Host),
+				logging.Field("path", req.URL.Path),
+				logging.Field("reason", reason),
+				logging.Field("error", admitErr.Error()))
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		t.pool.logger.Warn("failing over to next upstream host",
+			logging.Field("api_type", t.pool.tag),
+			logging.Field("host", host.URL.Host),
+			logging.Field("path", req.URL.Path),
+			logging.Field("reason", reason))
+	}
+}
+
+// Failure describes why a response shows the host failing, or returns "" if
+// it does not. Rate limit responses are left alone: every host shares the
+// same limits, so moving on would not help.
+func Failure(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return fmt.Sprintf("status %d", resp.StatusCode)
+	}
+	return ""
+}
+
+// Safe reports whether a request can be sent again without side effects
+func Safe(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
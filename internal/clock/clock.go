@@ -0,0 +1,277 @@
+package clock
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/pkg/binance"
+)
+
+// staleIntervals is how many sync intervals an offset is trusted for. An
+// older offset is no longer applied, and makes the proxy not ready.
+const staleIntervals = 3
+
+// Fetcher queries a family's server time through its upstream chain, so that
+// time requests count against the request weight and are held back during
+// bans like any other
+type Fetcher interface {
+	ServerTime(ctx context.Context, apiType string) ([]byte, error)
+}
+
+// source is the server time of one API family
+type source struct {
+	name    string
+	tag     string
+	timeout time.Duration
+	fetcher Fetcher
+
+	// Guarded by the clock's mutex
+	offset   time.Duration
+	rtt      time.Duration
+	synced   time.Time
+	exceeded bool
+}
+
+// Status is a family's offset as reported by /proxy/time and readiness.
+// Offsets are Binance time minus local time.
+type Status struct {
+	Synced   bool    `json:"synced"`
+	OffsetMs float64 `json:"offsetMs"`
+	RTTMs    float64 `json:"rttMs"`
+	LastSync string  `json:"lastSync,omitempty"`
+	Stale    bool    `json:"stale,omitempty"`
+}
+
+// Clock tracks the offset of the local clock from Binance server time for
+// each API family, polling the family's time endpoint
+type Clock struct {
+	cfg    *config.TimeSyncConfig
+	logger *logging.RequestLogger
+
+	mu      sync.Mutex
+	sources map[binance.APIType]*source
+	// fallback is used for families without a time endpoint
+	fallback *source
+}
+
+func New(cfg *config.TimeSyncConfig, logger *logging.RequestLogger) *Clock {
+	return &Clock{
+		cfg:     cfg,
+		logger:  logger,
+		sources: make(map[binance.APIType]*source),
+	}
+}
+
+// Add tracks the server time of a family. Families without a TimePath are
+// skipped and use the offset of the first family added.
+func (c *Clock) Add(api *config.APIEndpoints, fetcher Fetcher) {
+	if !c.cfg.Enabled || api.TimePath == "" {
+		return
+	}
+
+	s := &source{
+		name:    api.Name,
+		tag:     api.Tag,
+		timeout: api.HealthCheck.Timeout,
+		fetcher: fetcher,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sources[binance.APIType(api.Name)] = s
+	if c.fallback == nil {
+		c.fallback = s
+	}
+}
+
+// Start polls every family's server time until ctx is cancelled. Without an
+// interval the time is synced once.
+func (c *Clock) Start(ctx context.Context) {
+	if !c.cfg.Enabled {
+		return
+	}
+
+	c.mu.Lock()
+	sources := make([]*source, 0, len(c.sources))
+	for _, s := range c.sources {
+		sources = append(sources, s)
+	}
+	c.mu.Unlock()
+
+	for _, s := range sources {
+		if c.cfg.Interval <= 0 {
+			go c.sync(ctx, s)
+			continue
+		}
+		go func() {
+			ticker := time.NewTicker(c.cfg.Interval)
+			defer ticker.Stop()
+
+			for {
+				c.sync(ctx, s)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+}
+
+// sync measures a family's offset, assuming the server read its clock
+// halfway through the round trip
+func (c *Clock) sync(ctx context.Context, s *source) {
+	offset, rtt, err := s.measure(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		c.logger.Warn("server time sync failed",
+			logging.Field("api_type", s.tag),
+			logging.Field("error", err.Error()))
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	first := s.synced.IsZero()
+	s.offset, s.rtt, s.synced = offset, rtt, time.Now()
+
+	exceeded := c.cfg.MaxOffset > 0 && offset.Abs() > c.cfg.MaxOffset
+	switch {
+	case exceeded && !s.exceeded:
+		c.logger.Warn("clock offset exceeds limit",
+			logging.Field("api_type", s.tag),
+			logging.Field("offset_ms", offset.Milliseconds()),
+			logging.Field("max_offset_ms", c.cfg.MaxOffset.Milliseconds()))
+	case !exceeded && s.exceeded:
+		c.logger.Info("clock offset back within limit",
+			logging.Field("api_type", s.tag),
+			logging.Field("offset_ms", offset.Milliseconds()))
+	case first:
+		c.logger.Info("server time synchronized",
+			logging.Field("api_type", s.tag),
+			logging.Field("offset_ms", offset.Milliseconds()),
+			logging.Field("rtt_ms", rtt.Milliseconds()))
+	}
+	s.exceeded = exceeded
+}
+
+func (s *source) measure(ctx context.Context) (offset, rtt time.Duration, err error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	// The round trip is timed on the connection, leaving out any wait for
+	// request weight in the upstream chain. With retries the last attempt
+	// counts.
+	var mu sync.Mutex
+	var sent, received time.Time
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			sent = time.Now()
+			mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			received = time.Now()
+			mu.Unlock()
+		},
+	})
+
+	data, err := s.fetcher.ServerTime(ctx, s.name)
+	if err != nil {
+		return 0, 0, err
+	}
+	var body struct {
+		ServerTime int64 `json:"serverTime"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return 0, 0, err
+	}
+	if body.ServerTime == 0 {
+		return 0, 0, fmt.Errorf("response has no serverTime")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sent.IsZero() || received.Before(sent) {
+		return 0, 0, fmt.Errorf("round trip was not timed")
+	}
+	rtt = received.Sub(sent)
+	local := sent.Add(rtt / 2)
+	return time.UnixMilli(body.ServerTime).Sub(local), rtt, nil
+}
+
+// Now returns the time to sign a request to a family with: Binance's time
+// when timestamps are corrected and the offset is known, the local time
+// otherwise. A nil Clock returns the local time.
+func (c *Clock) Now(apiType binance.APIType) time.Time {
+	now := time.Now()
+	if c == nil || !c.cfg.CorrectTimestamps {
+		return now
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.sources[apiType]
+	if !ok {
+		s = c.fallback
+	}
+	if s == nil || s.synced.IsZero() || c.stale(s, now) {
+		return now
+	}
+	return now.Add(s.offset)
+}
+
+// stale reports whether a family's offset is too old to rely on, after
+// syncs failed for several intervals
+func (c *Clock) stale(s *source, now time.Time) bool {
+	return !s.synced.IsZero() && c.cfg.Interval > 0 && now.Sub(s.synced) > staleIntervals*c.cfg.Interval
+}
+
+// Status reports every family's offset and whether the proxy can sign
+// requests Binance will accept: offsets synced, recently, and within
+// MaxOffset or corrected
+func (c *Clock) Status() (map[string]Status, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	statuses := make(map[string]Status, len(c.sources))
+	ready := true
+	for _, s := range c.sources {
+		status := s.status()
+		status.Stale = c.stale(s, now)
+		statuses[s.name] = status
+		if !status.Synced || status.Stale || s.exceeded && !c.cfg.CorrectTimestamps {
+			ready = false
+		}
+	}
+	return statuses, ready
+}
+
+func (s *source) status() Status {
+	if s.synced.IsZero() {
+		return Status{}
+	}
+	return Status{
+		Synced:   true,
+		OffsetMs: float64(s.offset.Microseconds()) / 1000,
+		RTTMs:    float64(s.rtt.Microseconds()) / 1000,
+		LastSync: s.synced.UTC().Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,44 @@
+package clock
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// TimeResponse is served on /proxy/time. ServerTime is Binance's current
+// time as estimated from the offset, in milliseconds like /api/v3/time.
+type TimeResponse struct {
+	LocalTime         int64                  `json:"localTime"`
+	CorrectTimestamps bool                   `json:"correctTimestamps"`
+	APIs              map[string]TimeOffsets `json:"apis"`
+}
+
+type TimeOffsets struct {
+	ServerTime int64 `json:"serverTime,omitempty"`
+	Status
+}
+
+// Time reports the local time and every family's offset from Binance
+func (c *Clock) Time(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	resp := TimeResponse{
+		LocalTime:         now.UnixMilli(),
+		CorrectTimestamps: c.cfg.CorrectTimestamps,
+		APIs:              make(map[string]TimeOffsets),
+	}
+
+	c.mu.Lock()
+	for _, s := range c.sources {
+		offsets := TimeOffsets{Status: s.status()}
+		offsets.Stale = c.stale(s, now)
+		if offsets.Synced {
+			offsets.ServerTime = now.Add(s.offset).UnixMilli()
+		}
+		resp.APIs[s.name] = offsets
+	}
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -2,16 +2,33 @@ package config
 
 import (
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 
 	"github.com/spf13/viper"
+
+	"github.com/xgaicc/binance-proxy/pkg/binance"
 )
 
 type Config struct {
-	Server  ServerConfig  `mapstructure:"server"`
-	Binance BinanceConfig `mapstructure:"binance"`
-	Logging LoggingConfig `mapstructure:"logging"`
+	Server     ServerConfig     `mapstructure:"server"`
+	Binance    BinanceConfig    `mapstructure:"binance"`
+	Keystore   KeystoreConfig   `mapstructure:"keystore"`
+	Auth       AuthConfig       `mapstructure:"auth"`
+	Policy     PolicyConfig     `mapstructure:"policy"`
+	Risk       RiskConfig       `mapstructure:"risk"`
+	KillSwitch KillSwitchConfig `mapstructure:"killSwitch"`
+	Admin      AdminConfig      `mapstructure:"admin"`
+	WebSocket  WebSocketConfig  `mapstructure:"websocket"`
+	Retry      RetryConfig      `mapstructure:"retry"`
+	TimeSync   TimeSyncConfig   `mapstructure:"timeSync"`
+	Cache      CacheConfig      `mapstructure:"cache"`
+	Metrics    MetricsConfig    `mapstructure:"metrics"`
+	Tracing    TracingConfig    `mapstructure:"tracing"`
+	Audit      AuditConfig      `mapstructure:"audit"`
+	Redaction  RedactionConfig  `mapstructure:"redaction"`
+	Logging    LoggingConfig    `mapstructure:"logging"`
 }
 
 type ServerConfig struct {
@@ -20,16 +37,304 @@ type ServerConfig struct {
 	ReadTimeout     time.Duration `mapstructure:"readTimeout"`
 	WriteTimeout    time.Duration `mapstructure:"writeTimeout"`
 	ShutdownTimeout time.Duration `mapstructure:"shutdownTimeout"`
+	TLS             TLSConfig     `mapstructure:"tls"`
+}
+
+// TLSConfig enables HTTPS. Setting ClientCAFile additionally requests client
+// certificates, which the mTLS authenticator maps to bots.
+type TLSConfig struct {
+	CertFile     string `mapstructure:"certFile"`
+	KeyFile      string `mapstructure:"keyFile"`
+	ClientCAFile string `mapstructure:"clientCaFile"`
 }
 
+// BinanceConfig holds the API families the proxy serves: spot and futures,
+// plus any listed in Families
 type BinanceConfig struct {
-	Spot    APIEndpoints `mapstructure:"spot"`
-	Futures APIEndpoints `mapstructure:"futures"`
+	Spot     APIEndpoints   `mapstructure:"spot"`
+	Futures  APIEndpoints   `mapstructure:"futures"`
+	Families []APIEndpoints `mapstructure:"families"`
 }
 
+// APIEndpoints configures one API family. Name selects the defaults of a
+// family the proxy knows (coinm, options, portfolio); any other name needs
+// its URLs and paths configured. Prefix is the route the family is served
+// under and Tag labels it in logs, both defaulting to the name. Features
+// whose path is empty are unavailable for the family. OrderPaths lists the
+// endpoints of an added family that place an order on POST, which the known
+// families have built in. RestURLs, when set, replaces RestURL with several
+// hosts to balance and fail over between.
 type APIEndpoints struct {
-	RestURL      string `mapstructure:"restUrl"`
-	WebSocketURL string `mapstructure:"websocketUrl"`
+	Name             string            `mapstructure:"name"`
+	Prefix           string            `mapstructure:"prefix"`
+	Tag              string            `mapstructure:"tag"`
+	RestURL          string            `mapstructure:"restUrl"`
+	RestURLs         []UpstreamConfig  `mapstructure:"restUrls"`
+	WebSocketURL     string            `mapstructure:"websocketUrl"`
+	WebSocketAPIURL  string            `mapstructure:"websocketApiUrl"`
+	PingPath         string            `mapstructure:"pingPath"`
+	TimePath         string            `mapstructure:"timePath"`
+	DepthPath        string            `mapstructure:"depthPath"`
+	ListenKeyPath    string            `mapstructure:"listenKeyPath"`
+	CancelAllPaths   []string          `mapstructure:"cancelAllPaths"`
+	OrderPaths       []string          `mapstructure:"orderPaths"`
+	BookTickerPath   string            `mapstructure:"bookTickerPath"`
+	PremiumIndexPath string            `mapstructure:"premiumIndexPath"`
+	HealthCheck      HealthCheckConfig `mapstructure:"healthCheck"`
+	RateLimit        RateLimitConfig   `mapstructure:"rateLimit"`
+	OrderBook        OrderBookConfig   `mapstructure:"orderBook"`
+	StreamData       StreamDataConfig  `mapstructure:"streamData"`
+}
+
+// UpstreamConfig is one REST host of a family. Weight divides the host's
+// measured latency when picking the fastest one, so a host of weight 2 is
+// preferred until it is twice as slow.
+type UpstreamConfig struct {
+	URL    string `mapstructure:"url"`
+	Weight int    `mapstructure:"weight"`
+}
+
+// HealthCheckConfig sets how REST hosts are probed on PingPath when a family
+// has more than one, and after how many failures in a row, of probes or
+// requests, a host is taken out of rotation
+type HealthCheckConfig struct {
+	Interval         time.Duration `mapstructure:"interval"`
+	Timeout          time.Duration `mapstructure:"timeout"`
+	FailureThreshold int           `mapstructure:"failureThreshold"`
+}
+
+// OrderBookConfig lists the symbols the proxy keeps local order books for,
+// and the depth of the REST snapshot each book is initialized from
+type OrderBookConfig struct {
+	Symbols       []string `mapstructure:"symbols"`
+	SnapshotLimit int      `mapstructure:"snapshotLimit"`
+}
+
+// StreamDataConfig lists the symbols whose book ticker and mark price the
+// proxy follows over WebSocket, to answer REST queries for them. Data older
+// than MaxAge is not served.
+type StreamDataConfig struct {
+	Symbols []string      `mapstructure:"symbols"`
+	MaxAge  time.Duration `mapstructure:"maxAge"`
+}
+
+// RateLimitConfig sets the budgets the proxy enforces before Binance does.
+// Limits are keyed by interval ("10s", "1m", "1d") matching the suffix of the
+// X-MBX-USED-WEIGHT-* and X-MBX-ORDER-COUNT-* response headers.
+type RateLimitConfig struct {
+	Enabled       bool           `mapstructure:"enabled"`
+	MaxWait       time.Duration  `mapstructure:"maxWait"`
+	RequestWeight map[string]int `mapstructure:"requestWeight"`
+	Orders        map[string]int `mapstructure:"orders"`
+}
+
+// KeystoreConfig holds the Binance keys the proxy signs requests with on
+// behalf of bots. Bots send Credential in place of a Binance API key.
+type KeystoreConfig struct {
+	RecvWindow time.Duration `mapstructure:"recvWindow"`
+	Keys       []KeyConfig   `mapstructure:"keys"`
+}
+
+// KeyConfig describes one Binance key. HMAC keys take Secret or SecretEnv;
+// RSA and Ed25519 keys are read from a PEM encoded PrivateKeyFile.
+type KeyConfig struct {
+	Name           string `mapstructure:"name"`
+	Credential     string `mapstructure:"credential"`
+	APIKey         string `mapstructure:"apiKey"`
+	Type           string `mapstructure:"type"`
+	Secret         string `mapstructure:"secret"`
+	SecretEnv      string `mapstructure:"secretEnv"`
+	PrivateKeyFile string `mapstructure:"privateKeyFile"`
+}
+
+// AuthConfig controls how bots authenticate to the proxy. Each configured
+// method is tried in turn; the first one whose credentials are present
+// decides the outcome.
+type AuthConfig struct {
+	Enabled bool              `mapstructure:"enabled"`
+	Tokens  []TokenAuthConfig `mapstructure:"tokens"`
+	HMAC    HMACAuthConfig    `mapstructure:"hmac"`
+	MTLS    []MTLSAuthConfig  `mapstructure:"mtls"`
+}
+
+type TokenAuthConfig struct {
+	Bot      string `mapstructure:"bot"`
+	Token    string `mapstructure:"token"`
+	TokenEnv string `mapstructure:"tokenEnv"`
+}
+
+type HMACAuthConfig struct {
+	MaxClockSkew time.Duration          `mapstructure:"maxClockSkew"`
+	Clients      []HMACAuthClientConfig `mapstructure:"clients"`
+}
+
+type HMACAuthClientConfig struct {
+	Bot       string `mapstructure:"bot"`
+	Secret    string `mapstructure:"secret"`
+	SecretEnv string `mapstructure:"secretEnv"`
+}
+
+type MTLSAuthConfig struct {
+	Bot        string `mapstructure:"bot"`
+	CommonName string `mapstructure:"commonName"`
+}
+
+// PolicyConfig lists which endpoints each bot may call. Rules are evaluated
+// in order, bot-specific ones before those for bot "*", and the first match
+// decides. Requests no rule matches get DefaultAction.
+type PolicyConfig struct {
+	Enabled       bool              `mapstructure:"enabled"`
+	DefaultAction string            `mapstructure:"defaultAction"`
+	Bots          []BotPolicyConfig `mapstructure:"bots"`
+}
+
+type BotPolicyConfig struct {
+	Bot   string             `mapstructure:"bot"`
+	Rules []PolicyRuleConfig `mapstructure:"rules"`
+}
+
+// PolicyRuleConfig matches Binance paths (without the family's route
+// prefix) where "*" matches any run of characters, including "/". Empty
+// Methods matches every method.
+type PolicyRuleConfig struct {
+	Effect  string   `mapstructure:"effect"`
+	Methods []string `mapstructure:"methods"`
+	Paths   []string `mapstructure:"paths"`
+}
+
+// RiskConfig holds pre-trade limits checked before orders are forwarded.
+// A bot listed in Bots is checked against its own limits instead of the
+// default ones.
+type RiskConfig struct {
+	Enabled bool             `mapstructure:"enabled"`
+	Limits  RiskLimitsConfig `mapstructure:"limits"`
+	Bots    []BotRiskConfig  `mapstructure:"bots"`
+}
+
+type BotRiskConfig struct {
+	Bot    string           `mapstructure:"bot"`
+	Limits RiskLimitsConfig `mapstructure:"limits"`
+}
+
+// RiskLimitsConfig leaves a check disabled when its value is empty or zero
+type RiskLimitsConfig struct {
+	Symbols     []string           `mapstructure:"symbols"`
+	OrderTypes  []string           `mapstructure:"orderTypes"`
+	MaxNotional float64            `mapstructure:"maxNotional"`
+	MaxQuantity map[string]float64 `mapstructure:"maxQuantity"`
+	MaxLeverage int                `mapstructure:"maxLeverage"`
+}
+
+// KillSwitchConfig sets where engaged kill switches are persisted, and for
+// how long a symbol a bot stopped trading is still cancelled on. A zero
+// ActivityWindow keeps activity forever.
+type KillSwitchConfig struct {
+	StateFile      string        `mapstructure:"stateFile"`
+	ActivityWindow time.Duration `mapstructure:"activityWindow"`
+}
+
+// AdminConfig lists the bearer tokens accepted on /admin routes. The admin
+// API is disabled when no tokens are configured.
+type AdminConfig struct {
+	Tokens []TokenAuthConfig `mapstructure:"tokens"`
+}
+
+// WebSocketConfig controls the shared upstream stream connections. Binance
+// closes them after 24 hours, so they are replaced before MaxConnectionAge.
+type WebSocketConfig struct {
+	MaxConnectionAge time.Duration `mapstructure:"maxConnectionAge"`
+	ReconnectNotice  bool          `mapstructure:"reconnectNotice"`
+}
+
+// RetryConfig controls retries of REST requests that failed upstream. GETs
+// and cancels are retried as they are; with Orders, which is off by default,
+// proxy-signed orders are retried once an order status query shows they were
+// not placed.
+type RetryConfig struct {
+	Enabled        bool          `mapstructure:"enabled"`
+	MaxAttempts    int           `mapstructure:"maxAttempts"`
+	InitialBackoff time.Duration `mapstructure:"initialBackoff"`
+	MaxBackoff     time.Duration `mapstructure:"maxBackoff"`
+	Orders         bool          `mapstructure:"orders"`
+}
+
+// TimeSyncConfig controls tracking of each family's offset from Binance
+// server time on TimePath. With CorrectTimestamps, proxy-signed requests are
+// timestamped with Binance's time instead of the local clock. Readiness fails
+// until every family has synced, and when an offset exceeds MaxOffset and
+// timestamps are not corrected. Without an Interval the time is synced once.
+type TimeSyncConfig struct {
+	Enabled           bool          `mapstructure:"enabled"`
+	Interval          time.Duration `mapstructure:"interval"`
+	MaxOffset         time.Duration `mapstructure:"maxOffset"`
+	CorrectTimestamps bool          `mapstructure:"correctTimestamps"`
+}
+
+// CacheConfig enables caching of public GET responses. A response is cached
+// for the TTL of the first rule with a path pattern matching its Binance
+// path; paths no rule matches are never cached. At most MaxEntries responses
+// are held at a time.
+type CacheConfig struct {
+	Enabled    bool              `mapstructure:"enabled"`
+	MaxEntries int               `mapstructure:"maxEntries"`
+	Rules      []CacheRuleConfig `mapstructure:"rules"`
+}
+
+// CacheRuleConfig matches paths like PolicyRuleConfig does
+type CacheRuleConfig struct {
+	Paths []string      `mapstructure:"paths"`
+	TTL   time.Duration `mapstructure:"ttl"`
+}
+
+// MetricsConfig controls the Prometheus endpoint at /metrics, which is
+// served without authentication like /health
+type MetricsConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+}
+
+// TracingConfig controls export of OpenTelemetry spans over OTLP/HTTP to
+// the collector at Endpoint (host:port). SampleRatio applies to traces the
+// proxy starts; traces continued from a bot's traceparent follow its
+// sampling decision.
+type TracingConfig struct {
+	Enabled     bool              `mapstructure:"enabled"`
+	Endpoint    string            `mapstructure:"endpoint"`
+	Insecure    bool              `mapstructure:"insecure"`
+	Headers     map[string]string `mapstructure:"headers"`
+	ServiceName string            `mapstructure:"serviceName"`
+	SampleRatio float64           `mapstructure:"sampleRatio"`
+}
+
+// AuditConfig controls the SQLite audit store at Path, which keeps every
+// signed request with its full response. Records older than Retention are
+// deleted, then the oldest while the database exceeds MaxSizeMB; zero
+// disables either limit. Records are hash-chained; with a PEM encoded
+// Ed25519 SigningKeyFile the chain is also signed every CheckpointInterval
+// and on shutdown.
+type AuditConfig struct {
+	Enabled            bool          `mapstructure:"enabled"`
+	Path               string        `mapstructure:"path"`
+	Retention          time.Duration `mapstructure:"retention"`
+	MaxSizeMB          int           `mapstructure:"maxSizeMB"`
+	SigningKeyFile     string        `mapstructure:"signingKeyFile"`
+	CheckpointInterval time.Duration `mapstructure:"checkpointInterval"`
+}
+
+// RedactionConfig controls the rewriting of sensitive fields before
+// requests, responses and WebSocket messages reach logs or the audit store.
+// Rules name query parameters, form fields and JSON keys; with Defaults the
+// built-in Binance rules apply first and Rules override them per field.
+type RedactionConfig struct {
+	Enabled  bool                  `mapstructure:"enabled"`
+	Defaults bool                  `mapstructure:"defaults"`
+	Rules    []RedactionRuleConfig `mapstructure:"rules"`
+}
+
+// RedactionRuleConfig applies Action (drop, mask or hash) to Fields, which
+// are matched case-insensitively
+type RedactionRuleConfig struct {
+	Fields []string `mapstructure:"fields"`
+	Action string   `mapstructure:"action"`
 }
 
 type LoggingConfig struct {
@@ -50,10 +355,76 @@ func Load(configPath string) (*Config, error) {
 	v.SetDefault("server.writeTimeout", "30s")
 	v.SetDefault("server.shutdownTimeout", "10s")
 
-	v.SetDefault("binance.spot.restUrl", "https://api.binance.com")
-	v.SetDefault("binance.spot.websocketUrl", "wss://stream.binance.com:9443")
-	v.SetDefault("binance.futures.restUrl", "https://fapi.binance.com")
-	v.SetDefault("binance.futures.websocketUrl", "wss://fstream.binance.com")
+	// Other families default in BinanceConfig.resolve; these keep spot and
+	// futures overridable from the environment
+	v.SetDefault("binance.spot.restUrl", binance.SpotRestURL)
+	v.SetDefault("binance.spot.websocketUrl", binance.SpotWebSocketURL)
+	v.SetDefault("binance.spot.websocketApiUrl", "wss://ws-api.binance.com:443/ws-api/v3")
+	v.SetDefault("binance.futures.restUrl", binance.FuturesRestURL)
+	v.SetDefault("binance.futures.websocketUrl", binance.FuturesWebSocketURL)
+	v.SetDefault("binance.futures.websocketApiUrl", "wss://ws-fapi.binance.com/ws-fapi/v1")
+
+	// Budgets default to 90% of the published Binance limits
+	v.SetDefault("binance.spot.rateLimit.enabled", true)
+	v.SetDefault("binance.spot.rateLimit.maxWait", "2s")
+	v.SetDefault("binance.spot.rateLimit.requestWeight", map[string]int{"1m": 5400})
+	v.SetDefault("binance.spot.rateLimit.orders", map[string]int{"10s": 90, "1d": 180000})
+	v.SetDefault("binance.futures.rateLimit.enabled", true)
+	v.SetDefault("binance.futures.rateLimit.maxWait", "2s")
+	v.SetDefault("binance.futures.rateLimit.requestWeight", map[string]int{"1m": 2160})
+	v.SetDefault("binance.futures.rateLimit.orders", map[string]int{"10s": 270, "1m": 1080})
+	// The other known families are defaulted in defaultFamilyRateLimits
+
+	v.SetDefault("binance.spot.orderBook.snapshotLimit", 1000)
+	v.SetDefault("binance.futures.orderBook.snapshotLimit", 1000)
+
+	v.SetDefault("keystore.recvWindow", "5s")
+
+	v.SetDefault("auth.enabled", false)
+	v.SetDefault("auth.hmac.maxClockSkew", "30s")
+
+	v.SetDefault("policy.enabled", false)
+	v.SetDefault("policy.defaultAction", "deny")
+
+	v.SetDefault("risk.enabled", false)
+
+	v.SetDefault("killSwitch.stateFile", "data/killswitch.json")
+	v.SetDefault("killSwitch.activityWindow", "168h")
+
+	v.SetDefault("websocket.maxConnectionAge", "23h30m")
+	v.SetDefault("websocket.reconnectNotice", false)
+
+	v.SetDefault("retry.enabled", true)
+	v.SetDefault("retry.maxAttempts", 3)
+	v.SetDefault("retry.initialBackoff", "200ms")
+	v.SetDefault("retry.maxBackoff", "2s")
+	v.SetDefault("retry.orders", false)
+
+	v.SetDefault("timeSync.enabled", true)
+	v.SetDefault("timeSync.interval", "30s")
+	v.SetDefault("timeSync.maxOffset", "500ms")
+	v.SetDefault("timeSync.correctTimestamps", false)
+
+	v.SetDefault("cache.enabled", false)
+	v.SetDefault("cache.maxEntries", 10000)
+
+	v.SetDefault("metrics.enabled", true)
+
+	v.SetDefault("tracing.enabled", false)
+	v.SetDefault("tracing.endpoint", "localhost:4318")
+	v.SetDefault("tracing.insecure", true)
+	v.SetDefault("tracing.serviceName", "binance-proxy")
+	v.SetDefault("tracing.sampleRatio", 1.0)
+
+	v.SetDefault("audit.enabled", false)
+	v.SetDefault("audit.path", "data/audit.db")
+	v.SetDefault("audit.retention", "2160h")
+	v.SetDefault("audit.maxSizeMB", 1024)
+	v.SetDefault("audit.signingKeyFile", "")
+	v.SetDefault("audit.checkpointInterval", "1h")
+
+	v.SetDefault("redaction.enabled", true)
+	v.SetDefault("redaction.defaults", true)
 
 	v.SetDefault("logging.level", "info")
 	v.SetDefault("logging.format", "json")
@@ -77,6 +448,7 @@ func Load(configPath string) (*Config, error) {
 		}
 		// Config file not found, use defaults
 	}
+	defaultFamilyRateLimits(v)
 
 	// Environment variable overrides
 	v.SetEnvPrefix("PROXY")
@@ -88,9 +460,204 @@ func Load(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
+	if err := cfg.Binance.resolve(); err != nil {
+		return nil, err
+	}
+	if err := cfg.checkOrderPaths(); err != nil {
+		return nil, err
+	}
+
 	return &cfg, nil
 }
 
+// familyRateLimits are the rate limit defaults of the known families listed
+// under binance.families, 90% of the published Binance limits like those of
+// spot and futures
+var familyRateLimits = map[binance.APIType]map[string]any{
+	binance.APITypeCoinM: {
+		"enabled":       true,
+		"maxWait":       "2s",
+		"requestWeight": map[string]any{"1m": 2160},
+		"orders":        map[string]any{"1m": 1080},
+	},
+	binance.APITypeOptions: {
+		"enabled":       true,
+		"maxWait":       "2s",
+		"requestWeight": map[string]any{"1m": 360},
+		"orders":        map[string]any{"10s": 90, "1m": 1080},
+	},
+	binance.APITypePortfolioMargin: {
+		"enabled":       true,
+		"maxWait":       "2s",
+		"requestWeight": map[string]any{"1m": 5400},
+		"orders":        map[string]any{"1m": 1080},
+	},
+}
+
+// defaultFamilyRateLimits fills in the rate limits of known families, which
+// viper cannot default as they are list entries. Settings a family has, such
+// as enabled: false, are kept.
+func defaultFamilyRateLimits(v *viper.Viper) {
+	families, ok := v.Get("binance.families").([]any)
+	if !ok {
+		return
+	}
+	for _, f := range families {
+		family, ok := f.(map[string]any)
+		if !ok {
+			continue
+		}
+		_, name := lookup(family, "name")
+		defaults, ok := familyRateLimits[binance.APIType(fmt.Sprint(name))]
+		if !ok {
+			continue
+		}
+		key, value := lookup(family, "rateLimit")
+		limits, ok := value.(map[string]any)
+		if !ok {
+			limits = make(map[string]any, len(defaults))
+			family[key] = limits
+		}
+		for setting, def := range defaults {
+			if _, value := lookup(limits, setting); value == nil {
+				limits[setting] = def
+			}
+		}
+	}
+	v.Set("binance.families", families)
+}
+
+// lookup finds key in a map decoded from the config file, whose keys may
+// not be lowercased like viper's own. It returns key itself if missing.
+func lookup(m map[string]any, key string) (string, any) {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return k, v
+		}
+	}
+	return key, nil
+}
+
+// checkOrderPaths registers the order endpoints of added families, and
+// refuses families whose orders the kill switch and risk checks could not
+// recognise while either is enabled. The kill switch is enabled by the admin
+// API.
+func (c *Config) checkOrderPaths() error {
+	guarded := c.Risk.Enabled || len(c.Admin.Tokens) > 0
+	for _, api := range c.Binance.APIs() {
+		for _, path := range api.OrderPaths {
+			if !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("binance %s: order path %q must start with /", api.Name, path)
+			}
+			binance.AddOrderEndpoint(http.MethodPost, path)
+		}
+		if _, known := binance.KnownFamily(binance.APIType(api.Name)); !known && guarded && len(api.OrderPaths) == 0 {
+			return fmt.Errorf("binance %s: orderPaths is required while risk checks or the admin API are enabled", api.Name)
+		}
+	}
+	return nil
+}
+
+// APIs returns every API family, spot and futures first
+func (c *BinanceConfig) APIs() []*APIEndpoints {
+	apis := []*APIEndpoints{&c.Spot, &c.Futures}
+	for i := range c.Families {
+		apis = append(apis, &c.Families[i])
+	}
+	return apis
+}
+
+// resolve fills in family defaults and checks that every family can be
+// routed unambiguously
+func (c *BinanceConfig) resolve() error {
+	c.Spot.Name = string(binance.APITypeSpot)
+	c.Futures.Name = string(binance.APITypeFutures)
+
+	apis := c.APIs()
+	for _, api := range apis {
+		if api.Name == "" {
+			return fmt.Errorf("binance.families: every family needs a name")
+		}
+		if known, ok := binance.KnownFamily(binance.APIType(api.Name)); ok {
+			api.RestURL = withDefault(api.RestURL, known.RestURL)
+			api.WebSocketURL = withDefault(api.WebSocketURL, known.WebSocketURL)
+			api.WebSocketAPIURL = withDefault(api.WebSocketAPIURL, known.WebSocketAPIURL)
+			api.PingPath = withDefault(api.PingPath, known.PingPath)
+			api.TimePath = withDefault(api.TimePath, known.TimePath)
+			api.DepthPath = withDefault(api.DepthPath, known.DepthPath)
+			api.ListenKeyPath = withDefault(api.ListenKeyPath, known.ListenKeyPath)
+			if len(api.CancelAllPaths) == 0 {
+				api.CancelAllPaths = known.CancelAllPaths
+			}
+			api.BookTickerPath = withDefault(api.BookTickerPath, known.BookTickerPath)
+			api.PremiumIndexPath = withDefault(api.PremiumIndexPath, known.PremiumIndexPath)
+		}
+		api.Prefix = withDefault(api.Prefix, "/"+api.Name)
+		api.Tag = withDefault(api.Tag, api.Name)
+		if api.OrderBook.SnapshotLimit == 0 {
+			api.OrderBook.SnapshotLimit = 1000
+		}
+		if api.StreamData.MaxAge == 0 {
+			api.StreamData.MaxAge = 2 * time.Second
+		}
+
+		if len(api.RestURLs) == 0 && api.RestURL != "" {
+			api.RestURLs = []UpstreamConfig{{URL: api.RestURL}}
+		}
+		if len(api.RestURLs) == 0 {
+			return fmt.Errorf("binance %s: restUrl is required", api.Name)
+		}
+		for i := range api.RestURLs {
+			if api.RestURLs[i].Weight <= 0 {
+				api.RestURLs[i].Weight = 1
+			}
+		}
+		api.RestURL = api.RestURLs[0].URL
+		if api.HealthCheck.Interval == 0 {
+			api.HealthCheck.Interval = 10 * time.Second
+		}
+		if api.HealthCheck.Timeout == 0 {
+			api.HealthCheck.Timeout = 2 * time.Second
+		}
+		if api.HealthCheck.FailureThreshold <= 0 {
+			api.HealthCheck.FailureThreshold = 3
+		}
+		if !strings.HasPrefix(api.Prefix, "/") || strings.HasSuffix(api.Prefix, "/") {
+			return fmt.Errorf("binance %s: prefix %q must start and not end with /", api.Name, api.Prefix)
+		}
+		if len(api.OrderBook.Symbols) > 0 && (api.DepthPath == "" || api.WebSocketURL == "") {
+			return fmt.Errorf("binance %s: order books need depthPath and websocketUrl", api.Name)
+		}
+		if len(api.StreamData.Symbols) > 0 && (api.WebSocketURL == "" || api.BookTickerPath == "" && api.PremiumIndexPath == "") {
+			return fmt.Errorf("binance %s: stream data needs websocketUrl and bookTickerPath or premiumIndexPath", api.Name)
+		}
+	}
+
+	for i, a := range apis {
+		for _, b := range apis[i+1:] {
+			if a.Name == b.Name {
+				return fmt.Errorf("binance: family %s is configured twice", a.Name)
+			}
+			// Routes match by prefix, so /futures would also catch /futures2
+			if strings.HasPrefix(a.Prefix, b.Prefix) || strings.HasPrefix(b.Prefix, a.Prefix) {
+				return fmt.Errorf("binance: prefixes %s and %s overlap", a.Prefix, b.Prefix)
+			}
+		}
+	}
+	return nil
+}
+
+func withDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
 func (c *ServerConfig) Address() string {
 	return fmt.Sprintf("%s:%d", c.Host, c.Port)
 }
+
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
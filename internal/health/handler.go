@@ -3,11 +3,24 @@ package health
 import (
 	"encoding/json"
 	"net/http"
+	"sync"
 	"time"
 )
 
+// Check reports the state of a dependency and whether the proxy can serve
+// with it in that state
+type Check func() (status any, ready bool)
+
 type Handler struct {
 	startTime time.Time
+
+	mu     sync.Mutex
+	checks []namedCheck
+}
+
+type namedCheck struct {
+	name  string
+	check Check
 }
 
 func NewHandler() *Handler {
@@ -17,23 +30,57 @@ func NewHandler() *Handler {
 }
 
 type HealthResponse struct {
-	Status    string `json:"status"`
-	Uptime    string `json:"uptime"`
-	Timestamp string `json:"timestamp"`
+	Status    string         `json:"status"`
+	Uptime    string         `json:"uptime"`
+	Timestamp string         `json:"timestamp"`
+	Checks    map[string]any `json:"checks,omitempty"`
+}
+
+// AddCheck adds a dependency the readiness endpoint reports on
+func (h *Handler) AddCheck(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checks = append(h.checks, namedCheck{name, check})
 }
 
 func (h *Handler) Liveness(w http.ResponseWriter, r *http.Request) {
-	resp := HealthResponse{
-		Status:    "ok",
+	h.write(w, http.StatusOK, h.response("ok"))
+}
+
+// Readiness runs every check, answering 503 if any of them is not ready
+func (h *Handler) Readiness(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	checks := h.checks
+	h.mu.Unlock()
+
+	resp := h.response("ok")
+	status := http.StatusOK
+	if len(checks) > 0 {
+		resp.Checks = make(map[string]any, len(checks))
+	}
+	for _, c := range checks {
+		result, ready := c.check()
+		resp.Checks[c.name] = result
+		if !ready {
+			resp.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	h.write(w, status, resp)
+}
+
+func (h *Handler) response(status string) HealthResponse {
+	return HealthResponse{
+		Status:    status,
 		Uptime:    time.Since(h.startTime).Round(time.Second).String(),
 		Timestamp: time.Now().UTC().Format(time.RFC3339),
 	}
+}
 
+func (h *Handler) write(w http.ResponseWriter, status int, resp HealthResponse) {
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(resp)
 }
-
-func (h *Handler) Readiness(w http.ResponseWriter, r *http.Request) {
-	// Could add checks for Binance API connectivity here
-	h.Liveness(w, r)
-}
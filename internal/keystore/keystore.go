@@ -0,0 +1,95 @@
+package keystore
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+)
+
+// Key is a Binance API key held by the proxy
+type Key struct {
+	Name   string
+	APIKey string
+	Signer
+}
+
+// Keystore maps client credentials to the Binance keys they may use
+type Keystore struct {
+	keys       map[string]*Key
+	recvWindow time.Duration
+}
+
+func New(cfg *config.KeystoreConfig) (*Keystore, error) {
+	ks := &Keystore{
+		keys:       make(map[string]*Key, len(cfg.Keys)),
+		recvWindow: cfg.RecvWindow,
+	}
+
+	for _, kc := range cfg.Keys {
+		if kc.Credential == "" || kc.APIKey == "" {
+			return nil, fmt.Errorf("key %q: credential and apiKey are required", kc.Name)
+		}
+		if _, dup := ks.keys[kc.Credential]; dup {
+			return nil, fmt.Errorf("key %q: duplicate credential", kc.Name)
+		}
+
+		signer, err := newSigner(&kc)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", kc.Name, err)
+		}
+
+		ks.keys[kc.Credential] = &Key{
+			Name:   kc.Name,
+			APIKey: kc.APIKey,
+			Signer: signer,
+		}
+	}
+
+	return ks, nil
+}
+
+func newSigner(kc *config.KeyConfig) (Signer, error) {
+	keyType := strings.ToLower(kc.Type)
+
+	switch keyType {
+	case "", KeyTypeHMAC:
+		if kc.PrivateKeyFile == "" {
+			secret := kc.Secret
+			if kc.SecretEnv != "" {
+				secret = os.Getenv(kc.SecretEnv)
+			}
+			if secret == "" {
+				return nil, fmt.Errorf("no secret configured")
+			}
+			return NewHMACSigner(secret), nil
+		}
+		if keyType == KeyTypeHMAC {
+			return nil, fmt.Errorf("hmac keys use secret or secretEnv, not privateKeyFile")
+		}
+		return LoadPrivateKey(kc.PrivateKeyFile, "")
+	case KeyTypeRSA, KeyTypeEd25519:
+		if kc.PrivateKeyFile == "" {
+			return nil, fmt.Errorf("%s keys require privateKeyFile", keyType)
+		}
+		return LoadPrivateKey(kc.PrivateKeyFile, keyType)
+	default:
+		return nil, fmt.Errorf("unknown key type %q", kc.Type)
+	}
+}
+
+// Lookup returns the key a client credential maps to
+func (s *Keystore) Lookup(credential string) (*Key, bool) {
+	if s == nil || credential == "" {
+		return nil, false
+	}
+	key, ok := s.keys[credential]
+	return key, ok
+}
+
+// RecvWindow is added to signed requests that do not set their own
+func (s *Keystore) RecvWindow() time.Duration {
+	return s.recvWindow
+}
@@ -0,0 +1,113 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Key types supported by Binance
+const (
+	KeyTypeHMAC    = "hmac"
+	KeyTypeRSA     = "rsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// Signer produces the signature Binance expects for a payload. The result is
+// hex for HMAC keys and base64 for RSA and Ed25519 keys, and is the same for
+// REST requests and WebSocket API calls.
+type Signer interface {
+	Type() string
+	Sign(payload []byte) (string, error)
+}
+
+type hmacSigner struct {
+	secret []byte
+}
+
+func (s *hmacSigner) Type() string { return KeyTypeHMAC }
+
+func (s *hmacSigner) Sign(payload []byte) (string, error) {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+type rsaSigner struct {
+	key *rsa.PrivateKey
+}
+
+func (s *rsaSigner) Type() string { return KeyTypeRSA }
+
+func (s *rsaSigner) Sign(payload []byte) (string, error) {
+	digest := sha256.Sum256(payload)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+type ed25519Signer struct {
+	key ed25519.PrivateKey
+}
+
+func (s *ed25519Signer) Type() string { return KeyTypeEd25519 }
+
+func (s *ed25519Signer) Sign(payload []byte) (string, error) {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, payload)), nil
+}
+
+// NewHMACSigner returns a signer for a Binance HMAC secret
+func NewHMACSigner(secret string) Signer {
+	return &hmacSigner{secret: []byte(secret)}
+}
+
+// LoadPrivateKey reads an RSA or Ed25519 private key from a PEM file. If
+// keyType is set, the key in the file must match it.
+func LoadPrivateKey(path, keyType string) (Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", path)
+	}
+
+	var parsed any
+	if block.Type == "RSA PRIVATE KEY" {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var signer Signer
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		signer = &rsaSigner{key: key}
+	case ed25519.PrivateKey:
+		signer = &ed25519Signer{key: key}
+	default:
+		return nil, fmt.Errorf("%s: unsupported private key type %T", path, parsed)
+	}
+
+	if keyType != "" && !strings.EqualFold(keyType, signer.Type()) {
+		return nil, fmt.Errorf("%s: file holds an %s key but type is %s", path, signer.Type(), keyType)
+	}
+	return signer, nil
+}
@@ -0,0 +1,130 @@
+package killswitch
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/xgaicc/binance-proxy/internal/auth"
+	"github.com/xgaicc/binance-proxy/internal/logging"
+)
+
+const cancelTimeout = 30 * time.Second
+
+// Canceler cancels all open orders on a symbol using a proxy-held key
+type Canceler interface {
+	CancelAll(ctx context.Context, apiType, credential, symbol string) error
+}
+
+// Handler serves the kill switch admin API
+type Handler struct {
+	sw       *Switch
+	canceler Canceler
+	logger   *logging.RequestLogger
+}
+
+func NewHandler(sw *Switch, canceler Canceler, logger *logging.RequestLogger) *Handler {
+	return &Handler{
+		sw:       sw,
+		canceler: canceler,
+		logger:   logger,
+	}
+}
+
+type EngageRequest struct {
+	Bot          string   `json:"bot"`
+	Reason       string   `json:"reason"`
+	CancelOrders bool     `json:"cancelOrders"`
+	Symbols      []string `json:"symbols"`
+}
+
+type CancelResult struct {
+	APIType string `json:"apiType"`
+	Symbol  string `json:"symbol"`
+	APIKey  string `json:"apiKey"`
+	Error   string `json:"error,omitempty"`
+}
+
+type EngageResponse struct {
+	State   State          `json:"state"`
+	Cancels []CancelResult `json:"cancels,omitempty"`
+}
+
+func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.sw.State())
+}
+
+func (h *Handler) Engage(w http.ResponseWriter, r *http.Request) {
+	var req EngageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	by := auth.Bot(r)
+	if err := h.sw.Engage(req.Bot, req.Reason, by); err != nil {
+		h.logger.Error("failed to persist kill switch", logging.Field("error", err.Error()))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	h.logger.LogKillSwitch("engage", req.Bot, by, req.Reason)
+
+	resp := EngageResponse{State: h.sw.State()}
+	if req.CancelOrders {
+		resp.Cancels = h.cancelOpenOrders(r.Context(), req.Bot, req.Symbols)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) Release(w http.ResponseWriter, r *http.Request) {
+	bot := r.URL.Query().Get("bot")
+	if err := h.sw.Release(bot); err != nil {
+		h.logger.Error("failed to persist kill switch", logging.Field("error", err.Error()))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	h.logger.LogKillSwitch("release", bot, auth.Bot(r), "")
+
+	writeJSON(w, http.StatusOK, h.sw.State())
+}
+
+// cancelOpenOrders cancels open orders on every symbol the affected bots have
+// traded through the proxy, plus any symbols named in the request
+func (h *Handler) cancelOpenOrders(ctx context.Context, bot string, symbols []string) []CancelResult {
+	ctx, cancel := context.WithTimeout(ctx, cancelTimeout)
+	defer cancel()
+
+	targets := make(map[Activity]struct{})
+	for _, a := range h.sw.Activity(bot) {
+		targets[a] = struct{}{}
+		for _, symbol := range symbols {
+			targets[Activity{APIType: a.APIType, Credential: a.Credential, Symbol: symbol}] = struct{}{}
+		}
+	}
+
+	results := make([]CancelResult, 0, len(targets))
+	for a := range targets {
+		result := CancelResult{
+			APIType: a.APIType,
+			Symbol:  a.Symbol,
+			APIKey:  logging.MaskAPIKey(a.Credential),
+		}
+		if err := h.canceler.CancelAll(ctx, a.APIType, a.Credential, a.Symbol); err != nil {
+			result.Error = err.Error()
+			h.logger.Error("kill switch cancel failed",
+				logging.Field("api_type", a.APIType),
+				logging.Field("symbol", a.Symbol),
+				logging.Field("error", err.Error()))
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
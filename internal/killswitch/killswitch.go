@@ -0,0 +1,245 @@
+package killswitch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+)
+
+// activityResolution is how stale a recorded order time may get before it
+// is refreshed, so that a bot trading one symbol does not rewrite the state
+// file on every order
+const activityResolution = time.Hour
+
+// Entry records why and by whom a kill switch was engaged
+type Entry struct {
+	Reason    string    `json:"reason"`
+	EngagedBy string    `json:"engagedBy"`
+	EngagedAt time.Time `json:"engagedAt"`
+}
+
+// State is the persisted set of engaged kill switches
+type State struct {
+	Global *Entry            `json:"global,omitempty"`
+	Bots   map[string]*Entry `json:"bots,omitempty"`
+}
+
+// Activity identifies a symbol a bot has placed orders on, and the API key
+// header it used, so that its open orders can be cancelled later
+type Activity struct {
+	APIType    string `json:"apiType"`
+	Credential string `json:"credential"`
+	Symbol     string `json:"symbol"`
+}
+
+// recordedActivity is an Activity as kept in the state file, with the time
+// of its latest order
+type recordedActivity struct {
+	Activity
+	LastOrder time.Time `json:"lastOrder"`
+}
+
+// stateFile is the layout of the state file. Activity is kept there too, so
+// that orders placed before a restart can still be cancelled.
+type stateFile struct {
+	State
+	Activity map[string][]recordedActivity `json:"activity,omitempty"`
+}
+
+// Switch blocks new order placement globally or per bot. Engaged switches
+// and order activity are written to disk so that they survive restarts.
+// Activity without an order for the activity window is forgotten.
+type Switch struct {
+	mu       sync.RWMutex
+	path     string
+	window   time.Duration
+	state    State
+	activity map[string]map[Activity]time.Time
+}
+
+// Open loads the kill switch state from cfg.StateFile, starting with every
+// switch released if the file does not exist yet
+func Open(cfg *config.KillSwitchConfig) (*Switch, error) {
+	s := &Switch{
+		path:     cfg.StateFile,
+		window:   cfg.ActivityWindow,
+		state:    State{Bots: make(map[string]*Entry)},
+		activity: make(map[string]map[Activity]time.Time),
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kill switch state: %w", err)
+	}
+
+	var f stateFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse kill switch state %s: %w", s.path, err)
+	}
+	s.state = f.State
+	if s.state.Bots == nil {
+		s.state.Bots = make(map[string]*Entry)
+	}
+	now := time.Now()
+	for bot, activity := range f.Activity {
+		seen := make(map[Activity]time.Time, len(activity))
+		for _, a := range activity {
+			if a.LastOrder.IsZero() {
+				// Written before order times were kept
+				a.LastOrder = now
+			}
+			seen[a.Activity] = a.LastOrder
+		}
+		s.activity[bot] = seen
+	}
+	s.prune(now)
+	return s, nil
+}
+
+// Blocked reports whether bot may not place new orders, and which switch
+// blocks it
+func (s *Switch) Blocked(bot string) (*Entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.state.Global != nil {
+		return s.state.Global, true
+	}
+	if e, ok := s.state.Bots[bot]; ok {
+		return e, true
+	}
+	return nil, false
+}
+
+// Engage blocks order placement for bot, or for every bot if bot is empty
+func (s *Switch) Engage(bot, reason, by string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := &Entry{Reason: reason, EngagedBy: by, EngagedAt: time.Now().UTC()}
+	if bot == "" {
+		s.state.Global = entry
+	} else {
+		s.state.Bots[bot] = entry
+	}
+	return s.save()
+}
+
+// Release lifts the switch for bot, or the global switch if bot is empty
+func (s *Switch) Release(bot string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if bot == "" {
+		s.state.Global = nil
+	} else {
+		delete(s.state.Bots, bot)
+	}
+	return s.save()
+}
+
+// State returns a copy of the current state
+func (s *Switch) State() State {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	state := State{Global: s.state.Global, Bots: make(map[string]*Entry, len(s.state.Bots))}
+	for bot, e := range s.state.Bots {
+		state.Bots[bot] = e
+	}
+	return state
+}
+
+// RecordOrder remembers that bot sent an order described by a to Binance.
+// New activity, and activity whose recorded time is over activityResolution
+// old, is written to disk along with the pruning of expired activity.
+func (s *Switch) RecordOrder(bot string, a Activity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	seen, ok := s.activity[bot]
+	if !ok {
+		seen = make(map[Activity]time.Time)
+		s.activity[bot] = seen
+	}
+	if last, ok := seen[a]; ok && now.Sub(last) < activityResolution {
+		return nil
+	}
+	seen[a] = now
+	s.prune(now)
+	return s.save()
+}
+
+// Activity returns where bot has placed orders within the activity window,
+// or every bot if bot is empty
+func (s *Switch) Activity(bot string) []Activity {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	var result []Activity
+	for b, seen := range s.activity {
+		if bot != "" && b != bot {
+			continue
+		}
+		for a, last := range seen {
+			if !s.expired(last, now) {
+				result = append(result, a)
+			}
+		}
+	}
+	return result
+}
+
+// prune drops activity without an order for the activity window
+func (s *Switch) prune(now time.Time) {
+	for bot, seen := range s.activity {
+		for a, last := range seen {
+			if s.expired(last, now) {
+				delete(seen, a)
+			}
+		}
+		if len(seen) == 0 {
+			delete(s.activity, bot)
+		}
+	}
+}
+
+func (s *Switch) expired(last, now time.Time) bool {
+	return s.window > 0 && now.Sub(last) > s.window
+}
+
+func (s *Switch) save() error {
+	f := stateFile{State: s.state, Activity: make(map[string][]recordedActivity, len(s.activity))}
+	for bot, seen := range s.activity {
+		for a, last := range seen {
+			f.Activity[bot] = append(f.Activity[bot], recordedActivity{Activity: a, LastOrder: last.UTC()})
+		}
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create kill switch state directory: %w", err)
+	}
+
+	// Write then rename so a crash never leaves a truncated state file. The
+	// file names proxy credentials, so only the proxy may read it.
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write kill switch state: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
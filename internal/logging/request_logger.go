@@ -1,11 +1,13 @@
 package logging
 
 import (
+	"net/url"
 	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/redact"
 )
 
 const (
@@ -26,17 +28,40 @@ type RequestLog struct {
 	ClientIP     string
 	APIKey       string
 	APIType      string
+	Bot          string
+	Cache        string // X-Proxy-Cache status of a cacheable request
+	TraceID      string
 }
 
+// WebSocketAPILog is one WebSocket API request and its response, correlated
+// by the request id
+type WebSocketAPILog struct {
+	Timestamp time.Time
+	Duration  time.Duration
+	ID        string
+	Method    string
+	Status    int
+	Request   string
+	Response  string
+	ClientIP  string
+	APIKey    string
+	APIType   string
+	Bot       string
+}
+
+// RequestLogger logs requests and WebSocket traffic. Paths, queries, bodies
+// and messages pass through the redactor before they are written.
 type RequestLogger struct {
 	logger       *zap.Logger
+	redactor     *redact.Redactor
 	logRequests  bool
 	logResponses bool
 }
 
-func NewRequestLogger(logger *zap.Logger, cfg *config.LoggingConfig) *RequestLogger {
+func NewRequestLogger(logger *zap.Logger, cfg *config.LoggingConfig, redactor *redact.Redactor) *RequestLogger {
 	return &RequestLogger{
 		logger:       logger,
+		redactor:     redactor,
 		logRequests:  cfg.LogRequests,
 		logResponses: cfg.LogResponses,
 	}
@@ -47,14 +72,26 @@ func (l *RequestLogger) LogRequest(log RequestLog) {
 		zap.Time("timestamp", log.Timestamp),
 		zap.Duration("duration_ms", log.Duration),
 		zap.String("method", log.Method),
-		zap.String("path", log.Path),
+		zap.String("path", l.redactor.Path(log.Path)),
 		zap.Int("status_code", log.StatusCode),
 		zap.String("client_ip", log.ClientIP),
 		zap.String("api_type", log.APIType),
 	}
 
+	if log.Bot != "" {
+		fields = append(fields, zap.String("bot", log.Bot))
+	}
+
 	if log.Query != "" {
-		fields = append(fields, zap.String("query", log.Query))
+		fields = append(fields, zap.String("query", l.redactor.Query(log.Query)))
+	}
+
+	if log.Cache != "" {
+		fields = append(fields, zap.String("cache", log.Cache))
+	}
+
+	if log.TraceID != "" {
+		fields = append(fields, zap.String("trace_id", log.TraceID))
 	}
 
 	if log.APIKey != "" {
@@ -62,42 +99,145 @@ func (l *RequestLogger) LogRequest(log RequestLog) {
 	}
 
 	if l.logRequests && log.RequestBody != "" {
-		fields = append(fields, zap.String("request_body", truncate(log.RequestBody, maxRequestBodyLog)))
+		fields = append(fields, zap.String("request_body", truncate(l.redactor.String(log.RequestBody), maxRequestBodyLog)))
 	}
 
 	if l.logResponses && log.ResponseBody != "" {
-		fields = append(fields, zap.String("response_body", truncate(log.ResponseBody, maxResponseBodyLog)))
+		fields = append(fields, zap.String("response_body", truncate(l.redactor.String(log.ResponseBody), maxResponseBodyLog)))
 	}
 
 	l.logger.Info("api_request", fields...)
 }
 
-func (l *RequestLogger) LogWebSocketConnect(clientIP, path, apiType string) {
+func (l *RequestLogger) LogWebSocketAPI(log WebSocketAPILog) {
+	fields := []zap.Field{
+		zap.Time("timestamp", log.Timestamp),
+		zap.Duration("duration_ms", log.Duration),
+		zap.String("id", log.ID),
+		zap.String("method", log.Method),
+		zap.Int("status_code", log.Status),
+		zap.String("client_ip", log.ClientIP),
+		zap.String("api_type", log.APIType),
+	}
+
+	if log.Bot != "" {
+		fields = append(fields, zap.String("bot", log.Bot))
+	}
+
+	if log.APIKey != "" {
+		fields = append(fields, zap.String("api_key", MaskAPIKey(log.APIKey)))
+	}
+
+	if l.logRequests && log.Request != "" {
+		fields = append(fields, zap.String("request_body", truncate(l.redactor.JSON(log.Request), maxRequestBodyLog)))
+	}
+
+	if l.logResponses && log.Response != "" {
+		fields = append(fields, zap.String("response_body", truncate(l.redactor.JSON(log.Response), maxResponseBodyLog)))
+	}
+
+	l.logger.Info("ws_api_request", fields...)
+}
+
+func (l *RequestLogger) LogWebSocketConnect(clientIP, path, apiType, bot string) {
 	l.logger.Info("websocket_connect",
 		zap.String("client_ip", clientIP),
-		zap.String("path", path),
+		zap.String("path", l.redactor.Path(path)),
 		zap.String("api_type", apiType),
+		zap.String("bot", bot),
 		zap.Time("timestamp", time.Now()),
 	)
 }
 
-func (l *RequestLogger) LogWebSocketDisconnect(clientIP, path, apiType string, duration time.Duration) {
+func (l *RequestLogger) LogWebSocketDisconnect(clientIP, path, apiType, bot string, duration time.Duration) {
 	l.logger.Info("websocket_disconnect",
 		zap.String("client_ip", clientIP),
-		zap.String("path", path),
+		zap.String("path", l.redactor.Path(path)),
 		zap.String("api_type", apiType),
+		zap.String("bot", bot),
 		zap.Duration("duration_ms", duration),
 		zap.Time("timestamp", time.Now()),
 	)
 }
 
+func (l *RequestLogger) LogAuthFailure(clientIP, method, path, apiType, reason string) {
+	l.logger.Warn("auth_failure",
+		zap.String("client_ip", clientIP),
+		zap.String("method", method),
+		zap.String("path", l.redactor.Path(path)),
+		zap.String("api_type", apiType),
+		zap.String("reason", reason),
+		zap.Time("timestamp", time.Now()),
+	)
+}
+
 func (l *RequestLogger) LogWebSocketMessage(direction, clientIP, apiType string, message []byte) {
+	// Skip redacting messages that would not be logged
+	if !l.logger.Core().Enabled(zap.DebugLevel) {
+		return
+	}
 	l.logger.Debug("websocket_message",
 		zap.String("direction", direction),
 		zap.String("client_ip", clientIP),
 		zap.String("api_type", apiType),
 		zap.Int("size_bytes", len(message)),
-		zap.String("content", truncate(string(message), maxWSMessageLog)),
+		zap.String("content", truncate(l.redactor.String(string(message)), maxWSMessageLog)),
+	)
+}
+
+func (l *RequestLogger) LogBanStart(apiType string, status int, until time.Time) {
+	l.logger.Warn("upstream_ban_start",
+		zap.String("api_type", apiType),
+		zap.Int("status_code", status),
+		zap.Time("until", until),
+		zap.Duration("duration_ms", time.Until(until)),
+	)
+}
+
+func (l *RequestLogger) LogBanEnd(apiType string, status int, duration time.Duration) {
+	l.logger.Info("upstream_ban_end",
+		zap.String("api_type", apiType),
+		zap.Int("status_code", status),
+		zap.Duration("duration_ms", duration),
+	)
+}
+
+func (l *RequestLogger) LogPolicyDenial(bot, clientIP, method, path, apiType, rule string) {
+	l.logger.Warn("policy_denied",
+		zap.String("bot", bot),
+		zap.String("client_ip", clientIP),
+		zap.String("method", method),
+		zap.String("path", l.redactor.Path(path)),
+		zap.String("api_type", apiType),
+		zap.String("rule", rule),
+		zap.Time("timestamp", time.Now()),
+	)
+}
+
+func (l *RequestLogger) LogRiskRejection(bot, clientIP, method, path, apiType string, code int, reason string) {
+	l.logger.Warn("risk_rejected",
+		zap.String("bot", bot),
+		zap.String("client_ip", clientIP),
+		zap.String("method", method),
+		zap.String("path", l.redactor.Path(path)),
+		zap.String("api_type", apiType),
+		zap.Int("code", code),
+		zap.String("reason", reason),
+		zap.Time("timestamp", time.Now()),
+	)
+}
+
+func (l *RequestLogger) LogKillSwitch(action, bot, by, reason string) {
+	scope := bot
+	if scope == "" {
+		scope = "global"
+	}
+	l.logger.Warn("kill_switch",
+		zap.String("action", action),
+		zap.String("scope", scope),
+		zap.String("by", by),
+		zap.String("reason", reason),
+		zap.Time("timestamp", time.Now()),
 	)
 }
 
@@ -105,6 +245,10 @@ func (l *RequestLogger) Error(msg string, fields ...zap.Field) {
 	l.logger.Error(msg, fields...)
 }
 
+func (l *RequestLogger) Warn(msg string, fields ...zap.Field) {
+	l.logger.Warn(msg, fields...)
+}
+
 func (l *RequestLogger) Debug(msg string, fields ...zap.Field) {
 	l.logger.Debug(msg, fields...)
 }
@@ -113,11 +257,14 @@ func (l *RequestLogger) Info(msg string, fields ...zap.Field) {
 	l.logger.Info(msg, fields...)
 }
 
+// URL renders target for logs with listen keys and sensitive query
+// parameters redacted
+func (l *RequestLogger) URL(target *url.URL) string {
+	return l.redactor.URL(target)
+}
+
 func MaskAPIKey(key string) string {
-	if len(key) <= 8 {
-		return "****"
-	}
-	return key[:4] + "****" + key[len(key)-4:]
+	return redact.Mask(key)
 }
 
 func truncate(s string, maxLen int) string {
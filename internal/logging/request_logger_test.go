@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/redact"
+)
+
+const listenKey = "pqia91ma19a5s61cv6a81va65sdf19v8a65a1a5s61cv6a81va65sdf19v8a65a1"
+
+func TestRequestLoggerRedactsListenKeys(t *testing.T) {
+	redactor, err := redact.New(&config.RedactionConfig{Enabled: true, Defaults: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	core, logs := observer.New(zapcore.InfoLevel)
+	logger := NewRequestLogger(zap.New(core), &config.LoggingConfig{}, redactor)
+
+	tests := []struct {
+		name  string
+		path  string
+		query string
+	}{
+		{name: "stream path", path: "/spot/ws/" + listenKey},
+		{name: "stream path with market streams", path: "/spot/ws/btcusdt@trade/" + listenKey},
+		{name: "combined streams", path: "/spot/stream", query: "streams=btcusdt@trade/" + listenKey},
+		{name: "escaped combined streams", path: "/spot/stream", query: "streams=" + url.QueryEscape(listenKey+"/btcusdt@trade")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.TakeAll()
+			logger.LogRequest(RequestLog{Method: "GET", Path: tt.path, Query: tt.query, StatusCode: 101})
+			logger.Error("failed to connect to Binance WebSocket",
+				Field("target", logger.URL(&url.URL{Scheme: "wss", Host: "stream.binance.com", Path: tt.path, RawQuery: tt.query})))
+
+			for _, entry := range logs.TakeAll() {
+				for key, value := range entry.ContextMap() {
+					if s, ok := value.(string); ok && strings.Contains(s, listenKey) {
+						t.Errorf("%s: %s field holds the listen key: %s", entry.Message, key, s)
+					}
+				}
+			}
+		})
+	}
+}
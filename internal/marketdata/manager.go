@@ -0,0 +1,274 @@
+package marketdata
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/logging"
+	streams "github.com/xgaicc/binance-proxy/internal/proxy/websocket"
+)
+
+const (
+	resubscribeMinBackoff = time.Second
+	resubscribeMaxBackoff = time.Minute
+)
+
+// Manager follows the book ticker and mark price streams of configured
+// symbols for one API type, to answer the equivalent REST queries
+type Manager struct {
+	apiType          string
+	bookTickerPath   string
+	premiumIndexPath string
+	maxAge           time.Duration
+	symbols          []string
+	hub              *streams.Hub
+	logger           *logging.RequestLogger
+
+	mu          sync.Mutex
+	bookTickers map[string]*entry
+	marks       map[string]*entry
+}
+
+// entry is the latest REST response built from a stream event, with the
+// mark price of mark price events
+type entry struct {
+	body     []byte
+	price    float64
+	received time.Time
+}
+
+// bookTickerEvent is a @bookTicker event. Futures events carry the
+// transaction time, spot events do not.
+type bookTickerEvent struct {
+	UpdateID int64  `json:"u"`
+	Symbol   string `json:"s"`
+	BidPrice string `json:"b"`
+	BidQty   string `json:"B"`
+	AskPrice string `json:"a"`
+	AskQty   string `json:"A"`
+	Time     int64  `json:"T"`
+}
+
+// BookTicker has the shape of Binance's ticker/bookTicker response
+type BookTicker struct {
+	LastUpdateID int64  `json:"lastUpdateId,omitempty"`
+	Symbol       string `json:"symbol"`
+	BidPrice     string `json:"bidPrice"`
+	BidQty       string `json:"bidQty"`
+	AskPrice     string `json:"askPrice"`
+	AskQty       string `json:"askQty"`
+	Time         int64  `json:"time,omitempty"`
+}
+
+// markPriceEvent is a @markPrice event. Event is decoded only so that "e"
+// does not match "E", as encoding/json matches keys case-insensitively.
+type markPriceEvent struct {
+	Event                string `json:"e"`
+	EventTime            int64  `json:"E"`
+	Symbol               string `json:"s"`
+	MarkPrice            string `json:"p"`
+	IndexPrice           string `json:"i"`
+	EstimatedSettlePrice string `json:"P"`
+	FundingRate          string `json:"r"`
+	NextFundingTime      int64  `json:"T"`
+}
+
+// PremiumIndex has the shape of Binance's premiumIndex response, less
+// interestRate, which the stream does not carry
+type PremiumIndex struct {
+	Symbol               string `json:"symbol"`
+	MarkPrice            string `json:"markPrice"`
+	IndexPrice           string `json:"indexPrice"`
+	EstimatedSettlePrice string `json:"estimatedSettlePrice"`
+	LastFundingRate      string `json:"lastFundingRate"`
+	NextFundingTime      int64  `json:"nextFundingTime"`
+	Time                 int64  `json:"time"`
+}
+
+func NewManager(api *config.APIEndpoints, hub *streams.Hub, logger *logging.RequestLogger) *Manager {
+	m := &Manager{
+		apiType:          api.Tag,
+		bookTickerPath:   api.BookTickerPath,
+		premiumIndexPath: api.PremiumIndexPath,
+		maxAge:           api.StreamData.MaxAge,
+		hub:              hub,
+		logger:           logger,
+		bookTickers:      make(map[string]*entry),
+		marks:            make(map[string]*entry),
+	}
+	for _, symbol := range api.StreamData.Symbols {
+		m.symbols = append(m.symbols, strings.ToUpper(symbol))
+	}
+	return m
+}
+
+// Start follows the streams until ctx is cancelled
+func (m *Manager) Start(ctx context.Context) {
+	var names []string
+	for _, symbol := range m.symbols {
+		symbol = strings.ToLower(symbol)
+		if m.bookTickerPath != "" {
+			names = append(names, symbol+"@bookTicker")
+		}
+		if m.premiumIndexPath != "" {
+			names = append(names, symbol+"@markPrice@1s")
+		}
+	}
+	go m.follow(ctx, names)
+}
+
+// Response answers a GET on path from stream data. It reports false when
+// the query is not for a single followed symbol, or its data is missing or
+// older than MaxAge.
+func (m *Manager) Response(path string, query url.Values) ([]byte, bool) {
+	if path == "" || len(query) != 1 || len(query["symbol"]) != 1 {
+		return nil, false
+	}
+	symbol := strings.ToUpper(query.Get("symbol"))
+
+	var entries map[string]*entry
+	switch path {
+	case m.bookTickerPath:
+		entries = m.bookTickers
+	case m.premiumIndexPath:
+		entries = m.marks
+	default:
+		return nil, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := entries[symbol]
+	if !ok || time.Since(e.received) > m.maxAge {
+		return nil, false
+	}
+	return e.body, true
+}
+
+// MarkPrice returns the mark price of a followed symbol, unless it is
+// missing or older than MaxAge
+func (m *Manager) MarkPrice(symbol string) (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.marks[strings.ToUpper(symbol)]
+	if !ok || e.price <= 0 || time.Since(e.received) > m.maxAge {
+		return 0, false
+	}
+	return e.price, true
+}
+
+func (m *Manager) follow(ctx context.Context, names []string) {
+	backoff := resubscribeMinBackoff
+	for {
+		start := time.Now()
+		sub := streams.NewSubscriber()
+		var reason string
+		if err := m.hub.Subscribe(sub, names...); err != nil {
+			reason = err.Error()
+		} else {
+			reason = m.consume(ctx, sub)
+			m.hub.Remove(sub)
+		}
+		m.clear()
+		if ctx.Err() != nil {
+			return
+		}
+
+		m.logger.Warn("stream data subscription lost, resubscribing",
+			logging.Field("api_type", m.apiType),
+			logging.Field("reason", reason))
+
+		if time.Since(start) > resubscribeMaxBackoff {
+			backoff = resubscribeMinBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, resubscribeMaxBackoff)
+	}
+}
+
+func (m *Manager) consume(ctx context.Context, sub *streams.Subscriber) string {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err().Error()
+		case <-sub.Done():
+			return sub.Reason()
+		case msg := <-sub.Messages():
+			// Messages without a stream are reconnect notices. Data from
+			// before the gap ages out under MaxAge like any other.
+			if msg.Stream != "" {
+				m.update(msg.Stream, msg.Data)
+			}
+		}
+	}
+}
+
+func (m *Manager) update(stream string, data json.RawMessage) {
+	now := time.Now()
+	switch {
+	case strings.HasSuffix(stream, "@bookTicker"):
+		var e bookTickerEvent
+		if json.Unmarshal(data, &e) != nil || e.Symbol == "" {
+			return
+		}
+		ticker := BookTicker{
+			Symbol:   e.Symbol,
+			BidPrice: e.BidPrice,
+			BidQty:   e.BidQty,
+			AskPrice: e.AskPrice,
+			AskQty:   e.AskQty,
+		}
+		if e.Time != 0 {
+			ticker.LastUpdateID, ticker.Time = e.UpdateID, e.Time
+		}
+		m.store(m.bookTickers, e.Symbol, ticker, 0, now)
+
+	case strings.Contains(stream, "@markPrice"):
+		var e markPriceEvent
+		if json.Unmarshal(data, &e) != nil || e.Symbol == "" {
+			return
+		}
+		price, _ := strconv.ParseFloat(e.MarkPrice, 64)
+		m.store(m.marks, e.Symbol, PremiumIndex{
+			Symbol:               e.Symbol,
+			MarkPrice:            e.MarkPrice,
+			IndexPrice:           e.IndexPrice,
+			EstimatedSettlePrice: e.EstimatedSettlePrice,
+			LastFundingRate:      e.FundingRate,
+			NextFundingTime:      e.NextFundingTime,
+			Time:                 e.EventTime,
+		}, price, now)
+	}
+}
+
+func (m *Manager) store(entries map[string]*entry, symbol string, v any, price float64, received time.Time) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries[symbol] = &entry{body: body, price: price, received: received}
+}
+
+func (m *Manager) clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	clear(m.bookTickers)
+	clear(m.marks)
+}
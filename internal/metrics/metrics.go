@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "binance_proxy"
+
+// Transports and directions of the bytes metric. Bytes are counted on the
+// client side of the proxy: in from bots, out to bots.
+const (
+	TransportREST      = "rest"
+	TransportWebSocket = "websocket"
+
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+// Kinds of WebSocket connections
+const (
+	ConnStreams   = "streams"
+	ConnAPI       = "api"
+	ConnUserData  = "userdata"
+	ConnOrderBook = "orderbook"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "HTTP requests served, by API family, method, endpoint, status code and bot.",
+	}, []string{"api_type", "method", "endpoint", "status", "bot"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency, including time queued by the rate limiter.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"api_type", "method", "endpoint", "status", "bot"})
+
+	bytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_total",
+		Help:      "Bytes received from (in) and sent to (out) bots.",
+	}, []string{"api_type", "transport", "direction"})
+
+	connections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_connections",
+		Help:      "Open bot WebSocket connections.",
+	}, []string{"api_type", "kind"})
+
+	streamMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_messages_total",
+		Help:      "Messages received on shared upstream streams.",
+	}, []string{"api_type", "stream_type"})
+
+	streamBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_bytes_total",
+		Help:      "Bytes received on shared upstream streams.",
+	}, []string{"api_type", "stream_type"})
+
+	dialFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_dial_failures_total",
+		Help:      "Failed connection attempts to Binance.",
+	}, []string{"api_type", "transport"})
+
+	weight = &weightCollector{
+		sources: make(map[string]func() []WeightUsage),
+		used: prometheus.NewDesc(namespace+"_upstream_weight_used",
+			"Request weight used in the current window, as accounted by the proxy.",
+			[]string{"api_type", "interval"}, nil),
+		limit: prometheus.NewDesc(namespace+"_upstream_weight_limit",
+			"Request weight budget per window.",
+			[]string{"api_type", "interval"}, nil),
+	}
+)
+
+func init() {
+	registry.MustRegister(
+		requests, requestDuration, bytesTotal, connections,
+		streamMessages, streamBytes, dialFailures, weight,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// ObserveRequest records a served HTTP request. endpoint must come from a
+// bounded set, such as route templates or known Binance paths.
+func ObserveRequest(apiType, method, endpoint string, status int, bot string, d time.Duration) {
+	labels := prometheus.Labels{
+		"api_type": apiType,
+		"method":   method,
+		"endpoint": endpoint,
+		"status":   strconv.Itoa(status),
+		"bot":      bot,
+	}
+	requests.With(labels).Inc()
+	requestDuration.With(labels).Observe(d.Seconds())
+}
+
+// AddBytes counts bytes exchanged with bots
+func AddBytes(apiType, transport, direction string, n int) {
+	if n > 0 {
+		bytesTotal.WithLabelValues(apiType, transport, direction).Add(float64(n))
+	}
+}
+
+// ConnectionOpened counts an open bot WebSocket connection until the
+// returned function is called
+func ConnectionOpened(apiType, kind string) (closed func()) {
+	gauge := connections.WithLabelValues(apiType, kind)
+	gauge.Inc()
+	return gauge.Dec
+}
+
+// streamTypes are the stream types given their own label value. Streams are
+// named by bots, so anything else is counted as other.
+var streamTypes = map[string]bool{
+	"aggTrade": true, "trade": true, "kline": true, "continuousKline": true,
+	"indexPriceKline": true, "markPriceKline": true, "miniTicker": true,
+	"ticker": true, "bookTicker": true, "depth": true, "avgPrice": true,
+	"markPrice": true, "forceOrder": true, "compositeIndex": true,
+	"contractInfo": true, "assetIndex": true, "openInterest": true,
+	"optionPair": true, "index": true,
+}
+
+// StreamMessage records a message received on an upstream stream
+func StreamMessage(apiType, stream string, size int) {
+	label := streamType(stream)
+	streamMessages.WithLabelValues(apiType, label).Inc()
+	streamBytes.WithLabelValues(apiType, label).Add(float64(size))
+}
+
+// streamType returns the label a stream is counted under: its type without
+// symbol, interval or depth, such as kline for btcusdt@kline_1m. User data
+// streams, named by their listen key, are counted as userdata so that the
+// key never appears in metrics.
+func streamType(stream string) string {
+	name, all := strings.CutPrefix(stream, "!")
+	if !all {
+		_, after, ok := strings.Cut(name, "@")
+		if !ok {
+			return "userdata"
+		}
+		name = after
+	}
+	name, _, _ = strings.Cut(name, "@")
+	name, _, _ = strings.Cut(name, "_")
+	name = strings.TrimRight(name, "0123456789")
+	if !streamTypes[name] {
+		return "other"
+	}
+	return name
+}
+
+// DialFailed records a failed connection attempt to Binance
+func DialFailed(apiType, transport string) {
+	dialFailures.WithLabelValues(apiType, transport).Inc()
+}
+
+// WeightUsage is the state of one request weight window
+type WeightUsage struct {
+	Interval string
+	Used     int
+	Limit    int
+}
+
+// AddWeightSource reports an API family's request weight at every scrape
+func AddWeightSource(apiType string, usage func() []WeightUsage) {
+	weight.mu.Lock()
+	defer weight.mu.Unlock()
+
+	weight.sources[apiType] = usage
+}
+
+// weightCollector reads weight usage when scraped rather than tracking it
+type weightCollector struct {
+	used  *prometheus.Desc
+	limit *prometheus.Desc
+
+	mu      sync.Mutex
+	sources map[string]func() []WeightUsage
+}
+
+func (c *weightCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.used
+	ch <- c.limit
+}
+
+func (c *weightCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for apiType, usage := range c.sources {
+		for _, w := range usage() {
+			ch <- prometheus.MustNewConstMetric(c.used, prometheus.GaugeValue, float64(w.Used), apiType, w.Interval)
+			ch <- prometheus.MustNewConstMetric(c.limit, prometheus.GaugeValue, float64(w.Limit), apiType, w.Interval)
+		}
+	}
+}
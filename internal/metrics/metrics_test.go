@@ -0,0 +1,27 @@
+package metrics
+
+import "testing"
+
+func TestStreamType(t *testing.T) {
+	tests := []struct {
+		stream string
+		want   string
+	}{
+		{"btcusdt@trade", "trade"},
+		{"btcusdt@kline_1m", "kline"},
+		{"btcusdt@depth5@100ms", "depth"},
+		{"btcusdt@depth@100ms", "depth"},
+		{"btcusdt_perpetual@continuousKline_1m", "continuousKline"},
+		{"!ticker@arr", "ticker"},
+		{"!ticker_1h@arr", "ticker"},
+		{"!bookTicker", "bookTicker"},
+		{"ETH@openInterest@240628", "openInterest"},
+		{"btcusdt@madeUpStream", "other"},
+		{"pqia91ma19a5s61cv6a81va65sdf19v8a65a1a5s61cv6a81va65sdf19v8a65a1", "userdata"},
+	}
+	for _, tt := range tests {
+		if got := streamType(tt.stream); got != tt.want {
+			t.Errorf("streamType(%q) = %q, want %q", tt.stream, got, tt.want)
+		}
+	}
+}
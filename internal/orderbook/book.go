@@ -0,0 +1,280 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const watcherBuffer = 256
+
+// Level is a price level as Binance formats it: [price, quantity]
+type Level [2]string
+
+// Snapshot is the top of a book, in the shape of Binance's depth response
+type Snapshot struct {
+	LastUpdateID int64   `json:"lastUpdateId"`
+	Bids         []Level `json:"bids"`
+	Asks         []Level `json:"asks"`
+}
+
+// depthEvent is a diff depth stream event. Futures events also carry pu, the
+// final update ID of the previous event.
+type depthEvent struct {
+	Event   string  `json:"e"`
+	Time    int64   `json:"E"`
+	Symbol  string  `json:"s"`
+	FirstID int64   `json:"U"`
+	LastID  int64   `json:"u"`
+	PrevID  *int64  `json:"pu"`
+	Bids    []Level `json:"b"`
+	Asks    []Level `json:"a"`
+	raw     json.RawMessage
+}
+
+// snapshotMessage starts a book WebSocket stream, and restarts it whenever the
+// book is resynchronized
+type snapshotMessage struct {
+	Event  string `json:"e"`
+	Symbol string `json:"s"`
+	Snapshot
+}
+
+// side holds one side of a book keyed by numeric price
+type side map[float64]Level
+
+func (s side) update(levels []Level) error {
+	for _, l := range levels {
+		price, err := strconv.ParseFloat(l[0], 64)
+		if err != nil {
+			return fmt.Errorf("invalid price %q", l[0])
+		}
+		qty, err := strconv.ParseFloat(l[1], 64)
+		if err != nil {
+			return fmt.Errorf("invalid quantity %q", l[1])
+		}
+		if qty == 0 {
+			delete(s, price)
+		} else {
+			s[price] = l
+		}
+	}
+	return nil
+}
+
+// top returns up to n levels, best first. n <= 0 returns all levels.
+func (s side) top(n int, descending bool) []Level {
+	prices := make([]float64, 0, len(s))
+	for price := range s {
+		prices = append(prices, price)
+	}
+	if descending {
+		sort.Sort(sort.Reverse(sort.Float64Slice(prices)))
+	} else {
+		sort.Float64s(prices)
+	}
+	if n > 0 && n < len(prices) {
+		prices = prices[:n]
+	}
+
+	levels := make([]Level, len(prices))
+	for i, price := range prices {
+		levels[i] = s[price]
+	}
+	return levels
+}
+
+// Book is a local order book kept in sync from a REST snapshot and the diff
+// depth stream
+type Book struct {
+	symbol string
+	// Futures streams chain events through pu; spot streams through U
+	chained bool
+
+	mu           sync.Mutex
+	synced       bool
+	started      bool
+	lastUpdateID int64
+	bids         side
+	asks         side
+	watchers     map[*Watcher]struct{}
+}
+
+func newBook(symbol string, chained bool) *Book {
+	return &Book{
+		symbol:   symbol,
+		chained:  chained,
+		bids:     make(side),
+		asks:     make(side),
+		watchers: make(map[*Watcher]struct{}),
+	}
+}
+
+// Snapshot returns the top depth levels of each side. ok is false while the
+// book is being synchronized.
+func (b *Book) Snapshot(depth int) (snapshot Snapshot, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.synced {
+		return Snapshot{}, false
+	}
+	return b.snapshotLocked(depth), true
+}
+
+func (b *Book) snapshotLocked(depth int) Snapshot {
+	return Snapshot{
+		LastUpdateID: b.lastUpdateID,
+		Bids:         b.bids.top(depth, true),
+		Asks:         b.asks.top(depth, false),
+	}
+}
+
+// load replaces the book with a REST snapshot. Events must then be applied
+// starting with the first one that covers the snapshot's update ID.
+func (b *Book) load(s *Snapshot) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.bids = make(side, len(s.Bids))
+	b.asks = make(side, len(s.Asks))
+	if err := b.bids.update(s.Bids); err != nil {
+		return err
+	}
+	if err := b.asks.update(s.Asks); err != nil {
+		return err
+	}
+	b.lastUpdateID = s.LastUpdateID
+	b.started = false
+	b.synced = false
+	return nil
+}
+
+// apply applies a diff event, following Binance's rules for managing a local
+// order book. An error means updates were missed and the book must be
+// resynchronized.
+func (b *Book) apply(e *depthEvent) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.started {
+		// Drop events the snapshot already contains
+		if e.LastID < b.lastUpdateID || (!b.chained && e.LastID == b.lastUpdateID) {
+			return nil
+		}
+		next := b.lastUpdateID + 1
+		if b.chained {
+			next = b.lastUpdateID
+		}
+		if e.FirstID > next {
+			return fmt.Errorf("first event starts at %d after snapshot %d", e.FirstID, b.lastUpdateID)
+		}
+	} else if b.chained {
+		if e.PrevID == nil || *e.PrevID != b.lastUpdateID {
+			return fmt.Errorf("event does not follow update %d", b.lastUpdateID)
+		}
+	} else if e.FirstID != b.lastUpdateID+1 {
+		return fmt.Errorf("event starts at %d, expected %d", e.FirstID, b.lastUpdateID+1)
+	}
+
+	if err := b.bids.update(e.Bids); err != nil {
+		return err
+	}
+	if err := b.asks.update(e.Asks); err != nil {
+		return err
+	}
+	b.lastUpdateID = e.LastID
+
+	if !b.started {
+		// The book is consistent from here on; restart every watcher from it
+		b.started = true
+		b.synced = true
+		snapshot := b.snapshotMessageLocked()
+		for w := range b.watchers {
+			b.sendLocked(w, snapshot)
+		}
+		return nil
+	}
+
+	for w := range b.watchers {
+		b.sendLocked(w, e.raw)
+	}
+	return nil
+}
+
+// invalidate marks the book out of sync until the next snapshot is loaded
+func (b *Book) invalidate() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.synced = false
+	b.started = false
+}
+
+func (b *Book) snapshotMessageLocked() []byte {
+	msg, _ := json.Marshal(snapshotMessage{
+		Event:    "snapshot",
+		Symbol:   b.symbol,
+		Snapshot: b.snapshotLocked(0),
+	})
+	return msg
+}
+
+// Watch streams the book to a new watcher: a full snapshot once the book is
+// in sync, then every diff event applied to it
+func (b *Book) Watch() *Watcher {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	w := &Watcher{
+		ch:   make(chan []byte, watcherBuffer),
+		done: make(chan struct{}),
+	}
+	b.watchers[w] = struct{}{}
+	if b.synced {
+		w.ch <- b.snapshotMessageLocked()
+	}
+	return w
+}
+
+// Unwatch stops sending updates to w
+func (b *Book) Unwatch(w *Watcher) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.watchers, w)
+	w.close()
+}
+
+// sendLocked delivers msg to w, dropping a watcher that cannot keep up since
+// a missed delta would leave its copy of the book inconsistent
+func (b *Book) sendLocked(w *Watcher, msg []byte) {
+	select {
+	case w.ch <- msg:
+	default:
+		delete(b.watchers, w)
+		w.close()
+	}
+}
+
+// Watcher receives the messages of a book stream
+type Watcher struct {
+	ch   chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func (w *Watcher) Messages() <-chan []byte {
+	return w.ch
+}
+
+// Done is closed when the watcher falls behind or is removed
+func (w *Watcher) Done() <-chan struct{} {
+	return w.done
+}
+
+func (w *Watcher) close() {
+	w.once.Do(func() { close(w.done) })
+}
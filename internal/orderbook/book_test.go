@@ -0,0 +1,120 @@
+package orderbook
+
+import "testing"
+
+func prev(id int64) *int64 { return &id }
+
+func TestBookApplySequencing(t *testing.T) {
+	tests := []struct {
+		name    string
+		chained bool
+		events  []depthEvent
+		// failAt is the index of the event that must be rejected, or -1
+		failAt   int
+		wantLast int64
+	}{
+		{
+			name:     "spot first event straddles snapshot",
+			events:   []depthEvent{{FirstID: 95, LastID: 105}, {FirstID: 106, LastID: 110}},
+			failAt:   -1,
+			wantLast: 110,
+		},
+		{
+			name:     "spot events in snapshot are dropped",
+			events:   []depthEvent{{FirstID: 90, LastID: 99}, {FirstID: 100, LastID: 100}, {FirstID: 101, LastID: 103}},
+			failAt:   -1,
+			wantLast: 103,
+		},
+		{
+			name:   "spot gap after snapshot",
+			events: []depthEvent{{FirstID: 102, LastID: 105}},
+			failAt: 0,
+		},
+		{
+			name:   "spot gap between events",
+			events: []depthEvent{{FirstID: 99, LastID: 101}, {FirstID: 103, LastID: 104}},
+			failAt: 1,
+		},
+		{
+			name:   "spot overlapping events",
+			events: []depthEvent{{FirstID: 99, LastID: 101}, {FirstID: 101, LastID: 104}},
+			failAt: 1,
+		},
+		{
+			name:    "futures chained through pu",
+			chained: true,
+			events: []depthEvent{
+				{FirstID: 95, LastID: 101, PrevID: prev(94)},
+				{FirstID: 102, LastID: 105, PrevID: prev(101)},
+				{FirstID: 108, LastID: 110, PrevID: prev(105)},
+			},
+			failAt:   -1,
+			wantLast: 110,
+		},
+		{
+			name:    "futures event ending at snapshot starts the book",
+			chained: true,
+			events: []depthEvent{
+				{FirstID: 80, LastID: 99, PrevID: prev(79)},
+				{FirstID: 100, LastID: 100, PrevID: prev(99)},
+				{FirstID: 101, LastID: 102, PrevID: prev(100)},
+			},
+			failAt:   -1,
+			wantLast: 102,
+		},
+		{
+			name:    "futures first event after snapshot",
+			chained: true,
+			events:  []depthEvent{{FirstID: 101, LastID: 105, PrevID: prev(100)}},
+			failAt:  0,
+		},
+		{
+			name:    "futures pu mismatch",
+			chained: true,
+			events: []depthEvent{
+				{FirstID: 95, LastID: 101, PrevID: prev(94)},
+				{FirstID: 103, LastID: 105, PrevID: prev(102)},
+			},
+			failAt: 1,
+		},
+		{
+			name:    "futures event without pu",
+			chained: true,
+			events: []depthEvent{
+				{FirstID: 95, LastID: 101, PrevID: prev(94)},
+				{FirstID: 102, LastID: 105},
+			},
+			failAt: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBook("BTCUSDT", tt.chained)
+			if err := b.load(&Snapshot{LastUpdateID: 100, Bids: []Level{{"1", "1"}}, Asks: []Level{{"2", "1"}}}); err != nil {
+				t.Fatalf("load: %v", err)
+			}
+
+			for i := range tt.events {
+				err := b.apply(&tt.events[i])
+				if i == tt.failAt {
+					if err == nil {
+						t.Fatalf("event %d: expected a sequencing error", i)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("event %d: %v", i, err)
+				}
+			}
+
+			snapshot, ok := b.Snapshot(0)
+			if !ok {
+				t.Fatal("book is not synced")
+			}
+			if snapshot.LastUpdateID != tt.wantLast {
+				t.Errorf("lastUpdateId = %d, want %d", snapshot.LastUpdateID, tt.wantLast)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/xgaicc/binance-proxy/internal/auth"
+	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/metrics"
+	"github.com/xgaicc/binance-proxy/internal/tracing"
+	"github.com/xgaicc/binance-proxy/pkg/binance"
+)
+
+const (
+	defaultDepth = 100
+	writeWait    = 10 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// Handler serves local order books over REST and WebSocket
+type Handler struct {
+	managers map[string]*Manager
+	logger   *logging.RequestLogger
+}
+
+func NewHandler(managers []*Manager, logger *logging.RequestLogger) *Handler {
+	h := &Handler{
+		managers: make(map[string]*Manager, len(managers)),
+		logger:   logger,
+	}
+	for _, m := range managers {
+		h.managers[m.apiType] = m
+	}
+	return h
+}
+
+// book resolves the {apiType} and {symbol} route variables, writing an error
+// response when no such book is maintained
+func (h *Handler) book(w http.ResponseWriter, r *http.Request) *Book {
+	vars := mux.Vars(r)
+	if m, ok := h.managers[vars["apiType"]]; ok {
+		if book := m.Book(vars["symbol"]); book != nil {
+			return book
+		}
+	}
+	writeError(w, http.StatusNotFound, binance.ErrCodeBadSymbol, "Invalid symbol; no order book is maintained for it.")
+	return nil
+}
+
+// Depth returns the top levels of a book, ?limit=N levels per side
+func (h *Handler) Depth(w http.ResponseWriter, r *http.Request) {
+	book := h.book(w, r)
+	if book == nil {
+		return
+	}
+
+	depth := defaultDepth
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, binance.ErrCodeMandatoryParam, "Parameter 'limit' is not valid.")
+			return
+		}
+		depth = n
+	}
+
+	snapshot, ok := book.Snapshot(depth)
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, binance.ErrCodeDisconnected, "Order book is synchronizing; try again shortly.")
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+// Stream sends a full snapshot of a book followed by every diff event applied
+// to it. A new snapshot is sent whenever the book is resynchronized.
+func (h *Handler) Stream(w http.ResponseWriter, r *http.Request) {
+	book := h.book(w, r)
+	if book == nil {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		h.logger.Error("failed to upgrade client connection", logging.Field("error", err.Error()))
+		return
+	}
+	defer conn.Close()
+
+	watcher := book.Watch()
+	defer book.Unwatch(watcher)
+
+	vars := mux.Vars(r)
+	apiType := vars["apiType"]
+	defer metrics.ConnectionOpened(apiType, metrics.ConnOrderBook)()
+
+	_, span := tracing.StartServer(r.Context(), "websocket orderbook",
+		attribute.String("api_type", apiType),
+		attribute.String("symbol", vars["symbol"]),
+		attribute.String("bot", auth.Bot(r)))
+	defer span.End()
+
+	// Clients only listen; reading detects the disconnect
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+
+		case <-watcher.Done():
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "slow consumer"),
+				time.Now().Add(writeWait))
+			return
+
+		case msg := <-watcher.Messages():
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+			metrics.AddBytes(apiType, metrics.TransportWebSocket, metrics.DirectionOut, len(msg))
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status, code int, msg string) {
+	writeJSON(w, status, binance.APIError{Code: code, Msg: msg})
+}
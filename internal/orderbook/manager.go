@@ -0,0 +1,183 @@
+package orderbook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/logging"
+	streams "github.com/xgaicc/binance-proxy/internal/proxy/websocket"
+	"github.com/xgaicc/binance-proxy/pkg/binance"
+)
+
+const (
+	resyncMinBackoff = time.Second
+	resyncMaxBackoff = time.Minute
+)
+
+// Fetcher retrieves REST depth snapshots
+type Fetcher interface {
+	Depth(ctx context.Context, apiType, symbol string, limit int) ([]byte, error)
+}
+
+// Manager maintains the local order books of one API type
+type Manager struct {
+	apiType string
+	limit   int
+	hub     *streams.Hub
+	fetcher Fetcher
+	logger  *logging.RequestLogger
+	books   map[string]*Book
+}
+
+func NewManager(apiType string, cfg *config.OrderBookConfig, hub *streams.Hub, fetcher Fetcher, logger *logging.RequestLogger) *Manager {
+	m := &Manager{
+		apiType: apiType,
+		limit:   cfg.SnapshotLimit,
+		hub:     hub,
+		fetcher: fetcher,
+		logger:  logger,
+		books:   make(map[string]*Book, len(cfg.Symbols)),
+	}
+	chained := apiType != string(binance.APITypeSpot)
+	for _, symbol := range cfg.Symbols {
+		symbol = strings.ToUpper(symbol)
+		m.books[symbol] = newBook(symbol, chained)
+	}
+	return m
+}
+
+// Start synchronizes every book until ctx is cancelled
+func (m *Manager) Start(ctx context.Context) {
+	for _, book := range m.books {
+		go m.maintain(ctx, book)
+	}
+}
+
+// Book returns the book for symbol, or nil if it is not maintained
+func (m *Manager) Book(symbol string) *Book {
+	return m.books[strings.ToUpper(symbol)]
+}
+
+func (m *Manager) maintain(ctx context.Context, book *Book) {
+	stream := strings.ToLower(book.symbol) + "@depth@100ms"
+	backoff := resyncMinBackoff
+
+	// Each attempt subscribes afresh before the previous subscriber is
+	// removed, so the shared upstream subscription survives resyncs
+	var prev *streams.Subscriber
+	defer func() {
+		if prev != nil {
+			m.hub.Remove(prev)
+		}
+	}()
+
+	for {
+		start := time.Now()
+		sub := streams.NewSubscriber()
+		err := m.hub.Subscribe(sub, stream)
+		if prev != nil {
+			m.hub.Remove(prev)
+		}
+		prev = sub
+		if err == nil {
+			err = m.sync(ctx, book, sub)
+		}
+		book.invalidate()
+		if ctx.Err() != nil {
+			return
+		}
+
+		m.logger.Warn("order book out of sync, resynchronizing",
+			logging.Field("api_type", m.apiType),
+			logging.Field("symbol", book.symbol),
+			logging.Field("error", err.Error()))
+
+		// Back off only when books fail quickly, not after a long healthy run
+		if time.Since(start) > resyncMaxBackoff {
+			backoff = resyncMinBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, resyncMaxBackoff)
+	}
+}
+
+type snapshotResult struct {
+	snapshot *Snapshot
+	err      error
+}
+
+// sync buffers diff events from sub while the snapshot is fetched, then
+// applies them until an update is missed
+func (m *Manager) sync(ctx context.Context, book *Book, sub *streams.Subscriber) error {
+	results := make(chan snapshotResult, 1)
+	go func() {
+		snapshot, err := m.fetchSnapshot(ctx, book.symbol)
+		results <- snapshotResult{snapshot, err}
+	}()
+
+	var buffered []*depthEvent
+	loaded := false
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-sub.Done():
+			return errors.New(sub.Reason())
+
+		case res := <-results:
+			if res.err != nil {
+				return fmt.Errorf("fetching snapshot: %w", res.err)
+			}
+			if err := book.load(res.snapshot); err != nil {
+				return err
+			}
+			for _, e := range buffered {
+				if err := book.apply(e); err != nil {
+					return err
+				}
+			}
+			buffered = nil
+			loaded = true
+
+		case msg := <-sub.Messages():
+			if msg.Stream == "" {
+				return errors.New("upstream connection was re-established")
+			}
+			var e depthEvent
+			if err := json.Unmarshal(msg.Data, &e); err != nil {
+				return fmt.Errorf("invalid depth event: %w", err)
+			}
+			e.raw = msg.Data
+
+			if !loaded {
+				buffered = append(buffered, &e)
+				continue
+			}
+			if err := book.apply(&e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (m *Manager) fetchSnapshot(ctx context.Context, symbol string) (*Snapshot, error) {
+	body, err := m.fetcher.Depth(ctx, m.apiType, symbol, m.limit)
+	if err != nil {
+		return nil, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(body, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
@@ -0,0 +1,139 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+)
+
+// AnyBot is the bot name whose rules apply to every bot
+const AnyBot = "*"
+
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// Decision is the outcome of evaluating a request against the policies
+type Decision struct {
+	Allowed bool
+	Rule    string // the rule that matched, or "default"
+}
+
+// Engine decides which endpoints a bot may call
+type Engine struct {
+	rules        map[string][]rule
+	defaultAllow bool
+}
+
+type rule struct {
+	allow   bool
+	methods map[string]bool
+	paths   []string
+	desc    string
+}
+
+func New(cfg *config.PolicyConfig) (*Engine, error) {
+	e := &Engine{rules: make(map[string][]rule, len(cfg.Bots))}
+
+	switch strings.ToLower(cfg.DefaultAction) {
+	case EffectAllow:
+		e.defaultAllow = true
+	case "", EffectDeny:
+	default:
+		return nil, fmt.Errorf("invalid policy defaultAction %q", cfg.DefaultAction)
+	}
+
+	for _, bp := range cfg.Bots {
+		if bp.Bot == "" {
+			return nil, fmt.Errorf("policy entry without a bot name")
+		}
+		for i, rc := range bp.Rules {
+			r, err := newRule(&rc)
+			if err != nil {
+				return nil, fmt.Errorf("policy for bot %q, rule %d: %w", bp.Bot, i+1, err)
+			}
+			r.desc = fmt.Sprintf("%s#%d", bp.Bot, i+1)
+			e.rules[bp.Bot] = append(e.rules[bp.Bot], r)
+		}
+	}
+
+	return e, nil
+}
+
+func newRule(rc *config.PolicyRuleConfig) (rule, error) {
+	r := rule{paths: rc.Paths}
+
+	switch strings.ToLower(rc.Effect) {
+	case "", EffectAllow:
+		r.allow = true
+	case EffectDeny:
+	default:
+		return rule{}, fmt.Errorf("invalid effect %q", rc.Effect)
+	}
+
+	if len(rc.Paths) == 0 {
+		return rule{}, fmt.Errorf("no paths")
+	}
+
+	if len(rc.Methods) > 0 {
+		r.methods = make(map[string]bool, len(rc.Methods))
+		for _, m := range rc.Methods {
+			r.methods[strings.ToUpper(m)] = true
+		}
+	}
+
+	return r, nil
+}
+
+// Evaluate decides whether bot may call method on path
+func (e *Engine) Evaluate(bot, method, path string) Decision {
+	for _, name := range []string{bot, AnyBot} {
+		if name == "" {
+			continue
+		}
+		for _, r := range e.rules[name] {
+			if r.matches(method, path) {
+				return Decision{Allowed: r.allow, Rule: r.desc}
+			}
+		}
+	}
+	return Decision{Allowed: e.defaultAllow, Rule: "default"}
+}
+
+func (r *rule) matches(method, path string) bool {
+	if r.methods != nil && !r.methods[method] {
+		return false
+	}
+	for _, pattern := range r.paths {
+		if Match(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether path matches pattern, where "*" matches any run of
+// characters including "/"
+func Match(pattern, path string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == path
+	}
+
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	path = path[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(path, part)
+		if i < 0 {
+			return false
+		}
+		path = path[i+len(part):]
+	}
+	return strings.HasSuffix(path, last)
+}
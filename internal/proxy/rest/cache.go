@@ -0,0 +1,180 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/policy"
+	"github.com/xgaicc/binance-proxy/internal/tracing"
+	"github.com/xgaicc/binance-proxy/pkg/binance"
+)
+
+const (
+	cacheHeader = "X-Proxy-Cache"
+	cacheHit    = "HIT"
+	cacheMiss   = "MISS"
+	// cacheStream marks responses built from WebSocket stream data
+	cacheStream = "STREAM"
+)
+
+// responseCache holds public GET responses, keyed by API family, path and
+// normalized query. Concurrent misses for the same key share one upstream
+// request.
+type responseCache struct {
+	rules      []config.CacheRuleConfig
+	maxEntries int
+	group      singleflight.Group
+
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newResponseCache(cfg *config.CacheConfig) (*responseCache, error) {
+	for i, rule := range cfg.Rules {
+		if len(rule.Paths) == 0 || rule.TTL <= 0 {
+			return nil, fmt.Errorf("cache rule %d: paths and a positive ttl are required", i+1)
+		}
+	}
+	return &responseCache{
+		rules:      cfg.Rules,
+		maxEntries: cfg.MaxEntries,
+		entries:    make(map[string]*cachedResponse),
+	}, nil
+}
+
+// ttl returns how long the response to r may be cached. Only GETs that
+// carry no API key or signature are cacheable, since their response is the
+// same for every bot.
+func (c *responseCache) ttl(r *http.Request) (time.Duration, bool) {
+	if r.Method != http.MethodGet || r.Header.Get(binance.APIKeyHeader) != "" || r.URL.Query().Has("signature") {
+		return 0, false
+	}
+	for _, rule := range c.rules {
+		for _, pattern := range rule.Paths {
+			if policy.Match(pattern, r.URL.Path) {
+				return rule.TTL, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (c *responseCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry
+}
+
+// put stores a response. A full cache first drops expired entries and
+// admits nothing more until some expire.
+func (c *responseCache) put(key string, entry *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			return
+		}
+	}
+	c.entries[key] = entry
+}
+
+// serveCached answers cacheable requests from the cache, fetching misses
+// through next once however many bots ask at the same time
+func (h *ProxyHandler) serveCached(next http.Handler, u *upstream) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ttl, ok := h.cache.ttl(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Encode sorts parameters by name, so their order does not matter
+		key := string(u.apiType) + " " + r.URL.Path + "?" + r.URL.Query().Encode()
+		_, span := tracing.Start(r.Context(), "cache.lookup")
+		entry := h.cache.get(key)
+		span.SetAttributes(attribute.Bool("hit", entry != nil))
+		span.End()
+		if entry != nil {
+			entry.write(w, cacheHit)
+			return
+		}
+
+		fetched := false
+		v, _, _ := h.cache.group.Do(key, func() (any, error) {
+			fetched = true
+
+			// Waiting bots still need the response if this one disconnects.
+			// Without Accept-Encoding the transport asks for gzip itself and
+			// decompresses, so the stored body suits every bot.
+			req := r.Clone(context.WithoutCancel(r.Context()))
+			req.Header.Del("Accept-Encoding")
+			resp := newBufferedResponse()
+			next.ServeHTTP(resp, req)
+
+			entry := &cachedResponse{
+				status:  resp.status,
+				header:  resp.header.Clone(),
+				body:    resp.body.Bytes(),
+				expires: time.Now().Add(ttl),
+			}
+			if resp.status == http.StatusOK {
+				h.cache.put(key, entry)
+			}
+			return entry, nil
+		})
+
+		status := cacheHit
+		if fetched {
+			status = cacheMiss
+		} else {
+			trace.SpanFromContext(r.Context()).AddEvent("response shared by a concurrent request")
+		}
+		v.(*cachedResponse).write(w, status)
+	})
+}
+
+func (e *cachedResponse) write(w http.ResponseWriter, status string) {
+	header := w.Header()
+	for name, values := range e.header {
+		// Used weight reported on a cached response would be stale
+		if status == cacheHit && strings.HasPrefix(name, "X-Mbx-Used-Weight") {
+			continue
+		}
+		header[name] = values
+	}
+	header.Set(cacheHeader, status)
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
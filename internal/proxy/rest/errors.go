@@ -0,0 +1,16 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/xgaicc/binance-proxy/pkg/binance"
+)
+
+// writeError answers with a Binance-style JSON error body so bots can handle
+// proxy rejections with their existing error handling
+func writeError(w http.ResponseWriter, status, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(binance.APIError{Code: code, Msg: msg})
+}
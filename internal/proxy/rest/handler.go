@@ -1,66 +1,479 @@
 package rest
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/xgaicc/binance-proxy/internal/audit"
+	"github.com/xgaicc/binance-proxy/internal/auth"
+	"github.com/xgaicc/binance-proxy/internal/balancer"
+	"github.com/xgaicc/binance-proxy/internal/clock"
 	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/keystore"
 	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/metrics"
+	"github.com/xgaicc/binance-proxy/internal/ratelimit"
+	"github.com/xgaicc/binance-proxy/internal/tracing"
 	"github.com/xgaicc/binance-proxy/pkg/binance"
 )
 
 type ProxyHandler struct {
-	spotProxy    *httputil.ReverseProxy
-	futuresProxy *httputil.ReverseProxy
-	spotURL      *url.URL
-	futuresURL   *url.URL
-	logger       *logging.RequestLogger
+	upstreams map[binance.APIType]*upstream
+	retry     *config.RetryConfig
+	keys      *keystore.Keystore
+	clock     *clock.Clock
+	cache     *responseCache
+	audit     *audit.Store
+	logger    *logging.RequestLogger
 }
 
-func NewProxyHandler(cfg *config.Config, logger *logging.RequestLogger) (*ProxyHandler, error) {
-	spotURL, err := url.Parse(cfg.Binance.Spot.RestURL)
-	if err != nil {
-		return nil, err
+// upstream bundles the per-API state shared by the handler chain and the
+// reverse proxy
+type upstream struct {
+	limits
+	apiType   binance.APIType
+	endpoints *config.APIEndpoints
+	hosts     *balancer.Pool
+	handler   http.Handler
+	// external is the chain bots reach: handler behind the response cache
+	external http.Handler
+}
+
+// NewProxyHandler builds the upstream chains of every family. Signed
+// requests the proxy issues itself, such as kill switch cancels, are
+// recorded in store.
+func NewProxyHandler(cfg *config.Config, keys *keystore.Keystore, clk *clock.Clock, store *audit.Store, logger *logging.RequestLogger) (*ProxyHandler, error) {
+	h := &ProxyHandler{
+		upstreams: make(map[binance.APIType]*upstream),
+		retry:     &cfg.Retry,
+		keys:      keys,
+		clock:     clk,
+		audit:     store,
+		logger:    logger,
 	}
 
-	futuresURL, err := url.Parse(cfg.Binance.Futures.RestURL)
-	if err != nil {
+	if cfg.Cache.Enabled {
+		cache, err := newResponseCache(&cfg.Cache)
+		if err != nil {
+			return nil, err
+		}
+		h.cache = cache
+	}
+
+	for _, api := range cfg.Binance.APIs() {
+		u, err := h.newUpstream(api)
+		if err != nil {
+			return nil, err
+		}
+		h.upstreams[u.apiType] = u
+	}
+
+	return h, nil
+}
+
+func (h *ProxyHandler) newUpstream(cfg *config.APIEndpoints) (*upstream, error) {
+	u := &upstream{
+		apiType:   binance.APIType(cfg.Name),
+		endpoints: cfg,
+		limits:    limits{bans: ratelimit.NewBanTracker(cfg.Tag, h.logger)},
+	}
+
+	var err error
+	if cfg.RateLimit.Enabled {
+		if u.accountant, err = ratelimit.NewAccountant(&cfg.RateLimit); err != nil {
+			return nil, fmt.Errorf("%s rate limit: %w", cfg.Name, err)
+		}
+		metrics.AddWeightSource(cfg.Tag, func() []metrics.WeightUsage {
+			var usage []metrics.WeightUsage
+			for _, w := range u.accountant.WeightUsage() {
+				usage = append(usage, metrics.WeightUsage(w))
+			}
+			return usage
+		})
+	}
+
+	// Health probes and failover attempts are held to the same ban and
+	// weight budget as bot traffic
+	if u.hosts, err = balancer.NewPool(cfg, &u.limits, h.logger); err != nil {
 		return nil, err
 	}
 
-	return &ProxyHandler{
-		spotProxy:    createReverseProxy(spotURL),
-		futuresProxy: createReverseProxy(futuresURL),
-		spotURL:      spotURL,
-		futuresURL:   futuresURL,
-		logger:       logger,
-	}, nil
+	var handler http.Handler = h.sign(h.createReverseProxy(u), u)
+	if u.accountant != nil {
+		handler = h.throttle(handler, u)
+	}
+	u.handler = h.honorBan(handler, u)
+	u.external = u.handler
+	if h.cache != nil {
+		u.external = h.serveCached(u.handler, u)
+	}
+
+	return u, nil
 }
 
-func createReverseProxy(target *url.URL) *httputil.ReverseProxy {
+func (h *ProxyHandler) createReverseProxy(u *upstream) *httputil.ReverseProxy {
+	// The balancer picks the host; the primary only sets the path
+	transport := u.hosts.Transport(tracing.Transport(http.DefaultTransport, u.endpoints.Tag))
+	if h.retries() {
+		transport = &retryTransport{
+			limits: u.limits,
+			next:   transport,
+			cfg:    h.retry,
+			keys:   h.keys,
+			clock:  h.clock,
+			api:    u.apiType,
+			tag:    u.endpoints.Tag,
+			logger: h.logger,
+		}
+	}
+
 	proxy := &httputil.ReverseProxy{
+		Transport: transport,
 		Rewrite: func(pr *httputil.ProxyRequest) {
-			pr.SetURL(target)
-			pr.Out.Host = target.Host
+			pr.SetURL(u.hosts.Primary().URL)
+			forwarded(pr.In)
 
-			// Preserve authentication header
-			if apiKey := pr.In.Header.Get(binance.APIKeyHeader); apiKey != "" {
+			// Preserve query parameters (including signature, timestamp, recvWindow)
+			pr.Out.URL.RawQuery = pr.In.URL.RawQuery
+
+			// Proxy credentials are for the proxy only
+			auth.StripHeaders(pr.Out.Header)
+
+			apiKey := pr.In.Header.Get(binance.APIKeyHeader)
+			if apiKey == "" {
+				return
+			}
+
+			key, ok := h.keys.Lookup(apiKey)
+			if !ok {
+				// Bot holds its own Binance key and signs its own requests
 				pr.Out.Header.Set(binance.APIKeyHeader, apiKey)
+				return
 			}
 
-			// Preserve query parameters (including signature, timestamp, recvWindow)
-			pr.Out.URL.RawQuery = pr.In.URL.RawQuery
+			// Proxy-held key: swap in the real API key the request was signed
+			// with
+			pr.Out.Header.Set(binance.APIKeyHeader, key.APIKey)
 		},
 	}
 
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		u.Observe(resp)
+		return nil
+	}
+
 	return proxy
 }
 
-func (h *ProxyHandler) SpotHandler() http.Handler {
-	return h.spotProxy
+// retries reports whether failed upstream requests are retried
+func (h *ProxyHandler) retries() bool {
+	return h.retry.Enabled && h.retry.MaxAttempts > 1
+}
+
+// sign signs requests made with a proxy credential on the bot's behalf, as
+// late as possible so that time spent queued does not age the timestamp. A
+// request that cannot be signed is answered here and never forwarded.
+func (h *ProxyHandler) sign(next http.Handler, u *upstream) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := h.keys.Lookup(r.Header.Get(binance.APIKeyHeader))
+		if !ok || !binance.RequiresSignature(r.Method, r.URL.Path, r.URL.Query()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		out := r.Clone(r.Context())
+		if h.retries() {
+			out = h.withRetryInfo(out, r.Method, r.URL.Path, key)
+		}
+		if err := h.keys.SignRequest(out, key, h.clock.Now(u.apiType)); err != nil {
+			h.logger.Error("failed to sign request",
+				logging.Field("api_type", u.endpoints.Tag),
+				logging.Field("path", r.URL.Path),
+				logging.Field("key", key.Name),
+				logging.Field("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, binance.ErrCodeUnknown,
+				"Proxy failed to sign the request.")
+			return
+		}
+		next.ServeHTTP(w, out)
+	})
+}
+
+// honorBan answers on Binance's behalf while the upstream has banned or
+// rate limited the proxy's IP, so that no request extends the ban
+func (h *ProxyHandler) honorBan(next http.Handler, u *upstream) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, remaining, banned := u.bans.Active()
+		if !banned {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		msg := fmt.Sprintf("Too much request weight used; proxy is backing off until %d.", u.bans.Until().UnixMilli())
+		if status == ratelimit.StatusIPBanned {
+			msg = fmt.Sprintf("Way too much request weight used; IP banned until %d.", u.bans.Until().UnixMilli())
+		}
+
+		setRetryAfter(w, remaining)
+		writeError(w, status, binance.ErrCodeTooManyRequests, msg)
+	})
+}
+
+// throttle reserves request weight and order count before forwarding, and
+// answers with a local 429 when the shared budget would be exceeded
+func (h *ProxyHandler) throttle(next http.Handler, u *upstream) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		weight := binance.RequestWeight(r.Method, r.URL.Path, r.URL.Query())
+		orders := binance.OrderCount(r.Method, r.URL.Path)
+
+		_, span := tracing.Start(r.Context(), "ratelimit.acquire", attribute.Int("weight", weight))
+		err := u.accountant.Acquire(r.Context(), weight, orders, h.binanceAPIKey(r))
+		span.End()
+		if err == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var limitErr *ratelimit.LimitError
+		if !errors.As(err, &limitErr) {
+			// Client went away while queued
+			return
+		}
+
+		h.logger.Warn("request throttled by proxy",
+			logging.Field("api_type", u.endpoints.Tag),
+			logging.Field("path", r.URL.Path),
+			logging.Field("limit", limitErr.Limit),
+			logging.Field("retry_after", limitErr.RetryAfter.String()))
+
+		setRetryAfter(w, limitErr.RetryAfter)
+		writeError(w, http.StatusTooManyRequests, binance.ErrCodeTooManyRequests,
+			"Too many requests; proxy "+limitErr.Error()+".")
+	})
+}
+
+// binanceAPIKey returns the Binance API key a request will be sent with,
+// resolving proxy credentials through the keystore
+func (h *ProxyHandler) binanceAPIKey(r *http.Request) string {
+	apiKey := r.Header.Get(binance.APIKeyHeader)
+	if key, ok := h.keys.Lookup(apiKey); ok {
+		return key.APIKey
+	}
+	return apiKey
+}
+
+// CancelAll cancels every open order on symbol for the proxy-held key behind
+// credential. The request goes through the same rate limiting and signing as
+// bot traffic. Families with a cancel-all endpoint per market, such as
+// portfolio margin, are cancelled on every one, since a symbol such as
+// BTCUSDT can trade on several; it only has to be known to one of them.
+func (h *ProxyHandler) CancelAll(ctx context.Context, apiType, credential, symbol string) error {
+	if _, ok := h.keys.Lookup(credential); !ok {
+		return errors.New("API key is not held by the proxy")
+	}
+
+	u, ok := h.upstreams[binance.APIType(apiType)]
+	if !ok {
+		return fmt.Errorf("unknown API type %q", apiType)
+	}
+	if len(u.endpoints.CancelAllPaths) == 0 {
+		return fmt.Errorf("%s has no cancelAllPaths configured", apiType)
+	}
+
+	var errs []error
+	for _, path := range u.endpoints.CancelAllPaths {
+		_, err := h.internalRequest(ctx, apiType, http.MethodDelete, path+"?symbol="+url.QueryEscape(symbol), credential)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	if len(errs) == len(u.endpoints.CancelAllPaths) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// Depth fetches an order book snapshot, counted against the shared request
+// weight like bot traffic
+func (h *ProxyHandler) Depth(ctx context.Context, apiType, symbol string, limit int) ([]byte, error) {
+	path, err := h.path(apiType, "depthPath", func(e *config.APIEndpoints) string { return e.DepthPath })
+	if err != nil {
+		return nil, err
+	}
+	target := path + "?symbol=" + url.QueryEscape(symbol) + "&limit=" + strconv.Itoa(limit)
+	return h.internalRequest(ctx, apiType, http.MethodGet, target, "")
+}
+
+// ServerTime queries a family's server time, counted against the shared
+// request weight like bot traffic
+func (h *ProxyHandler) ServerTime(ctx context.Context, apiType string) ([]byte, error) {
+	path, err := h.path(apiType, "timePath", func(e *config.APIEndpoints) string { return e.TimePath })
+	if err != nil {
+		return nil, err
+	}
+	return h.internalRequest(ctx, apiType, http.MethodGet, path, "")
+}
+
+// CreateListenKey starts a user data stream for the API key behind
+// credential. Binance returns the active key if one exists.
+func (h *ProxyHandler) CreateListenKey(ctx context.Context, apiType, credential string) (string, error) {
+	path, err := h.path(apiType, "listenKeyPath", func(e *config.APIEndpoints) string { return e.ListenKeyPath })
+	if err != nil {
+		return "", err
+	}
+	body, err := h.internalRequest(ctx, apiType, http.MethodPost, path, credential)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		ListenKey string `json:"listenKey"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", err
+	}
+	if resp.ListenKey == "" {
+		return "", errors.New("no listen key in response")
+	}
+	return resp.ListenKey, nil
+}
+
+// KeepAliveListenKey extends a listen key's validity by 60 minutes
+func (h *ProxyHandler) KeepAliveListenKey(ctx context.Context, apiType, credential, listenKey string) error {
+	target, err := h.listenKeyTarget(apiType, listenKey)
+	if err != nil {
+		return err
+	}
+	_, err = h.internalRequest(ctx, apiType, http.MethodPut, target, credential)
+	return err
+}
+
+// CloseListenKey ends a user data stream
+func (h *ProxyHandler) CloseListenKey(ctx context.Context, apiType, credential, listenKey string) error {
+	target, err := h.listenKeyTarget(apiType, listenKey)
+	if err != nil {
+		return err
+	}
+	_, err = h.internalRequest(ctx, apiType, http.MethodDelete, target, credential)
+	return err
+}
+
+// listenKeyTarget names the listen key in the query where the API expects it;
+// other families identify keys by the API key alone
+func (h *ProxyHandler) listenKeyTarget(apiType, listenKey string) (string, error) {
+	target, err := h.path(apiType, "listenKeyPath", func(e *config.APIEndpoints) string { return e.ListenKeyPath })
+	if err != nil {
+		return "", err
+	}
+	if binance.APIType(apiType) == binance.APITypeSpot {
+		target += "?listenKey=" + url.QueryEscape(listenKey)
+	}
+	return target, nil
+}
+
+// path returns a family's endpoint for a proxy feature, or an error when the
+// family has none configured
+func (h *ProxyHandler) path(apiType, name string, get func(*config.APIEndpoints) string) (string, error) {
+	u, ok := h.upstreams[binance.APIType(apiType)]
+	if !ok {
+		return "", fmt.Errorf("unknown API type %q", apiType)
+	}
+	path := get(u.endpoints)
+	if path == "" {
+		return "", fmt.Errorf("%s has no %s configured", apiType, name)
+	}
+	return path, nil
+}
+
+// internalRequest sends a request issued by the proxy itself through the
+// upstream handler chain and returns the response body
+func (h *ProxyHandler) internalRequest(ctx context.Context, apiType, method, target, credential string) ([]byte, error) {
+	u, ok := h.upstreams[binance.APIType(apiType)]
+	if !ok {
+		return nil, fmt.Errorf("unknown API type %q", apiType)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if credential != "" {
+		req.Header.Set(binance.APIKeyHeader, credential)
+	}
+
+	start := time.Now()
+	resp := newBufferedResponse()
+	u.handler.ServeHTTP(resp, req)
+
+	if params := req.URL.Query(); binance.RequiresSignature(method, req.URL.Path, params) {
+		rec := &audit.Record{
+			Time:       start.UnixMilli(),
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			Transport:  audit.TransportInternal,
+			APIType:    u.endpoints.Tag,
+			APIKey:     logging.MaskAPIKey(credential),
+			Method:     method,
+			Path:       req.URL.Path,
+			Status:     resp.status,
+			Request:    req.URL.RawQuery,
+			Response:   resp.body.String(),
+		}
+		rec.Identify(params, resp.body.Bytes())
+		h.audit.Record(rec)
+	}
+
+	if resp.status >= http.StatusBadRequest {
+		var apiErr binance.APIError
+		if json.Unmarshal(resp.body.Bytes(), &apiErr) == nil && apiErr.Code != 0 {
+			return nil, &apiErr
+		}
+		return nil, fmt.Errorf("%s %s failed with status %d", method, target, resp.status)
+	}
+	return resp.body.Bytes(), nil
+}
+
+// bufferedResponse collects the response of an internally issued request
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *bufferedResponse) WriteHeader(status int)      { b.status = status }
+
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// Start probes the REST hosts of every family until ctx is cancelled
+func (h *ProxyHandler) Start(ctx context.Context) {
+	for _, u := range h.upstreams {
+		u.hosts.Start(ctx)
+	}
+}
+
+// Hosts returns the REST hosts of an API family
+func (h *ProxyHandler) Hosts(apiType binance.APIType) *balancer.Pool {
+	return h.upstreams[apiType].hosts
 }
 
-func (h *ProxyHandler) FuturesHandler() http.Handler {
-	return h.futuresProxy
+// Handler returns the handler chain forwarding to an API family
+func (h *ProxyHandler) Handler(apiType binance.APIType) http.Handler {
+	return h.upstreams[apiType].external
 }
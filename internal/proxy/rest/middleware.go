@@ -3,14 +3,31 @@ package rest
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/xgaicc/binance-proxy/internal/audit"
+	"github.com/xgaicc/binance-proxy/internal/auth"
+	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/killswitch"
 	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/marketdata"
+	"github.com/xgaicc/binance-proxy/internal/metrics"
+	"github.com/xgaicc/binance-proxy/internal/policy"
+	"github.com/xgaicc/binance-proxy/internal/risk"
+	"github.com/xgaicc/binance-proxy/internal/tracing"
 	"github.com/xgaicc/binance-proxy/pkg/binance"
 )
 
@@ -63,13 +80,9 @@ func LoggingMiddleware(logger *logging.RequestLogger, apiType string) func(http.
 
 			next.ServeHTTP(lrw, r)
 
-			// Extract client IP
-			clientIP := r.RemoteAddr
-			if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-				clientIP = strings.Split(forwarded, ",")[0]
-			}
-
 			// Log the request/response
+			_, span := tracing.Start(r.Context(), "log.response")
+			defer span.End()
 			logger.LogRequest(logging.RequestLog{
 				Timestamp:    start,
 				Duration:     time.Since(start),
@@ -79,10 +92,392 @@ func LoggingMiddleware(logger *logging.RequestLogger, apiType string) func(http.
 				StatusCode:   lrw.statusCode,
 				RequestBody:  string(reqBody),
 				ResponseBody: lrw.body.String(),
-				ClientIP:     clientIP,
+				ClientIP:     clientIP(r),
 				APIKey:       r.Header.Get(binance.APIKeyHeader),
 				APIType:      apiType,
+				Bot:          auth.Bot(r),
+				Cache:        lrw.Header().Get(cacheHeader),
+				TraceID:      traceID(r),
 			})
 		})
 	}
 }
+
+// AuditMiddleware stores every signed request with its full response in the
+// audit store, including those the proxy rejects itself. prefix is stripped
+// so that records carry Binance paths.
+func AuditMiddleware(store *audit.Store, apiType, prefix string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := strings.TrimPrefix(r.URL.Path, prefix)
+			params := requestParams(r)
+			if isWebSocket(r) || !binance.RequiresSignature(r.Method, path, params) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+			var body []byte
+			if r.Body != nil {
+				body, _ = io.ReadAll(r.Body)
+				r.Body = io.NopCloser(bytes.NewBuffer(body))
+			}
+
+			lrw := newLoggingResponseWriter(w)
+			next.ServeHTTP(lrw, r)
+
+			rec := &audit.Record{
+				Time:       start.UnixMilli(),
+				DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+				Transport:  audit.TransportREST,
+				APIType:    apiType,
+				Bot:        auth.Bot(r),
+				ClientIP:   clientIP(r),
+				APIKey:     logging.MaskAPIKey(r.Header.Get(binance.APIKeyHeader)),
+				Method:     r.Method,
+				Path:       path,
+				Status:     lrw.statusCode,
+				Request:    r.URL.RawQuery,
+				Body:       string(body),
+				Response:   lrw.body.String(),
+			}
+			rec.Identify(params, lrw.body.Bytes())
+			store.Record(rec)
+		})
+	}
+}
+
+// AuthMiddleware rejects requests that no authenticator accepts and stores
+// the caller's identity in the request context for logging and policies
+func AuthMiddleware(authenticator auth.Authenticator, logger *logging.RequestLogger, apiType string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, err := authenticator.Authenticate(r)
+			if err != nil {
+				logger.LogAuthFailure(clientIP(r), r.Method, r.URL.Path, apiType, err.Error())
+				writeError(w, http.StatusUnauthorized, binance.ErrCodeUnauthorized,
+					"You are not authorized to execute this request.")
+				return
+			}
+
+			if id != nil {
+				trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("bot", id.Bot))
+			}
+			next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), id)))
+		})
+	}
+}
+
+// PolicyMiddleware enforces per-bot endpoint policies. prefix is the route
+// prefix stripped from the path before matching, so policies are written
+// against Binance paths.
+func PolicyMiddleware(engine *policy.Engine, logger *logging.RequestLogger, apiType, prefix string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bot := auth.Bot(r)
+			path := strings.TrimPrefix(r.URL.Path, prefix)
+
+			_, span := tracing.Start(r.Context(), "policy.check")
+			decision := engine.Evaluate(bot, r.Method, path)
+			span.SetAttributes(attribute.Bool("allowed", decision.Allowed), attribute.String("rule", decision.Rule))
+			span.End()
+			if !decision.Allowed {
+				logger.LogPolicyDenial(bot, clientIP(r), r.Method, path, apiType, decision.Rule)
+				writeError(w, http.StatusForbidden, binance.ErrCodeRejectedAPIKey,
+					"Invalid API-key, IP, or permissions for action.")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// UserDataPolicyMiddleware applies policies to user data streams as to the
+// family's listen key endpoint, since the stream carries the same account and
+// order events a bot denied that endpoint must not see
+func UserDataPolicyMiddleware(engine *policy.Engine, logger *logging.RequestLogger, apis []*config.APIEndpoints) func(http.Handler) http.Handler {
+	listenKeyPaths := make(map[string]string, len(apis))
+	for _, api := range apis {
+		listenKeyPaths[api.Name] = api.ListenKeyPath
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path, ok := listenKeyPaths[mux.Vars(r)["apiType"]]
+			if !ok || path == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			bot := auth.Bot(r)
+			if decision := engine.Evaluate(bot, http.MethodPost, path); !decision.Allowed {
+				logger.LogPolicyDenial(bot, clientIP(r), http.MethodPost, path, "proxy", decision.Rule)
+				writeError(w, http.StatusForbidden, binance.ErrCodeRejectedAPIKey,
+					"Invalid API-key, IP, or permissions for action.")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RiskMiddleware runs pre-trade risk checks on order requests to apiType and
+// rejects those that break a limit with the error Binance would return; tag
+// labels the family in logs
+func RiskMiddleware(checker *risk.Checker, logger *logging.RequestLogger, apiType, tag, prefix string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := strings.TrimPrefix(r.URL.Path, prefix)
+			if !risk.Checks(r.Method, path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			bot := auth.Bot(r)
+			_, span := tracing.Start(r.Context(), "risk.check")
+			apiErr := checker.Check(bot, apiType, r.Method, path, requestParams(r))
+			span.SetAttributes(attribute.Bool("allowed", apiErr == nil))
+			span.End()
+			if apiErr != nil {
+				logger.LogRiskRejection(bot, clientIP(r), r.Method, path, tag, apiErr.Code, apiErr.Msg)
+				writeError(w, http.StatusBadRequest, apiErr.Code, apiErr.Msg)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardHookKey carries a func() the reverse proxy calls as it sends a
+// request upstream, once every check in the chain has passed
+type forwardHookKey struct{}
+
+// onForward arranges for hook to run if r is sent upstream
+func onForward(r *http.Request, hook func()) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), forwardHookKey{}, hook))
+}
+
+// forwarded runs the hook of a request being sent upstream, if it has one
+func forwarded(r *http.Request) {
+	if hook, ok := r.Context().Value(forwardHookKey{}).(func()); ok {
+		hook()
+	}
+}
+
+// KillSwitchMiddleware blocks new order placement while a kill switch is
+// engaged for the calling bot or globally. Cancels and queries still pass.
+// It also records which symbols each bot sends orders for on apiType so the
+// admin API can cancel their open orders; orders rejected before they reach
+// Binance, by risk checks or rate limits, are not recorded. Tag labels the
+// family in logs.
+func KillSwitchMiddleware(sw *killswitch.Switch, logger *logging.RequestLogger, apiType, tag, prefix string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := strings.TrimPrefix(r.URL.Path, prefix)
+			if binance.OrderCount(r.Method, path) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			bot := auth.Bot(r)
+			_, span := tracing.Start(r.Context(), "killswitch.check")
+			entry, blocked := sw.Blocked(bot)
+			span.SetAttributes(attribute.Bool("allowed", !blocked))
+			span.End()
+			if blocked {
+				logger.LogRiskRejection(bot, clientIP(r), r.Method, path, tag,
+					binance.ErrCodeNewOrderRejected, "kill switch: "+entry.Reason)
+				writeError(w, http.StatusBadRequest, binance.ErrCodeNewOrderRejected,
+					"New orders are disabled by the proxy kill switch.")
+				return
+			}
+
+			credential := r.Header.Get(binance.APIKeyHeader)
+			symbols := orderSymbols(requestParams(r))
+			next.ServeHTTP(w, onForward(r, func() {
+				for _, symbol := range symbols {
+					if err := sw.RecordOrder(bot, killswitch.Activity{APIType: apiType, Credential: credential, Symbol: symbol}); err != nil {
+						logger.Error("failed to persist kill switch activity", logging.Field("error", err.Error()))
+					}
+				}
+			}))
+		})
+	}
+}
+
+// orderSymbols returns the symbols an order request places orders on
+func orderSymbols(params url.Values) []string {
+	if symbol := params.Get("symbol"); symbol != "" {
+		return []string{strings.ToUpper(symbol)}
+	}
+
+	var batch []struct {
+		Symbol string `json:"symbol"`
+	}
+	json.Unmarshal([]byte(params.Get("batchOrders")), &batch)
+
+	symbols := make([]string, 0, len(batch))
+	for _, order := range batch {
+		if order.Symbol != "" {
+			symbols = append(symbols, strings.ToUpper(order.Symbol))
+		}
+	}
+	return symbols
+}
+
+// requestParams returns the query and form body parameters of r combined,
+// leaving the body readable for the next handler
+func requestParams(r *http.Request) url.Values {
+	params := r.URL.Query()
+
+	if r.Body == nil || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return params
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewBuffer(body))
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return params
+	}
+	for key, values := range form {
+		params[key] = append(params[key], values...)
+	}
+	return params
+}
+
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	return r.RemoteAddr
+}
+
+// StreamDataMiddleware answers ticker queries from stream data while it is
+// fresh, at no request weight. Other requests, and those whose data is stale
+// or missing, go on to Binance.
+func StreamDataMiddleware(m *marketdata.Manager, prefix string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				if body, ok := m.Response(strings.TrimPrefix(r.URL.Path, prefix), r.URL.Query()); ok {
+					w.Header().Set("Content-Type", "application/json")
+					w.Header().Set(cacheHeader, cacheStream)
+					w.Write(body)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// statusResponseWriter records the status and size of a response
+type statusResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	written    int
+}
+
+func (mrw *statusResponseWriter) WriteHeader(code int) {
+	mrw.statusCode = code
+	mrw.ResponseWriter.WriteHeader(code)
+}
+
+func (mrw *statusResponseWriter) Write(b []byte) (int, error) {
+	n, err := mrw.ResponseWriter.Write(b)
+	mrw.written += n
+	return n, err
+}
+
+// MetricsMiddleware records request counts, latency and bytes. Requests to
+// the REST catch-all under prefix are labeled with their Binance endpoint,
+// or "other" for paths not in the endpoint table, so that arbitrary paths
+// and query strings never become labels. WebSocket connections are measured
+// by their handlers instead.
+func MetricsMiddleware(apiType, prefix string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isWebSocket(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+			mrw := &statusResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(mrw, r)
+
+			metrics.ObserveRequest(apiType, r.Method, endpointLabel(r, prefix), mrw.statusCode, auth.Bot(r), time.Since(start))
+			if r.ContentLength > 0 {
+				metrics.AddBytes(apiType, metrics.TransportREST, metrics.DirectionIn, int(r.ContentLength))
+			}
+			metrics.AddBytes(apiType, metrics.TransportREST, metrics.DirectionOut, mrw.written)
+		})
+	}
+}
+
+// endpointLabel returns the route template of r, or for the REST catch-all
+// the Binance endpoint it targets
+func endpointLabel(r *http.Request, prefix string) string {
+	var template string
+	if route := mux.CurrentRoute(r); route != nil {
+		template, _ = route.GetPathTemplate()
+	}
+	if prefix == "" || template != prefix+"/" {
+		return template
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	if _, ok := binance.LookupEndpoint(r.Method, path); ok {
+		return path
+	}
+	return "other"
+}
+
+// TracingMiddleware starts the span of each request, as a child of the bot's
+// traceparent if it sent one. Trace context headers are always removed so
+// they are not forwarded to Binance. WebSocket connections get their span
+// from their handler, which finds the bot's trace context in the request.
+func TracingMiddleware(apiType, prefix string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := tracing.Extract(r.Context(), r.Header)
+			if isWebSocket(r) {
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			endpoint := endpointLabel(r, prefix)
+			ctx, span := tracing.StartServer(ctx, r.Method+" "+endpoint,
+				attribute.String("api_type", apiType),
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", endpoint),
+				attribute.String("url.path", r.URL.Path))
+			defer span.End()
+
+			srw := &statusResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(srw, r.WithContext(ctx))
+
+			span.SetAttributes(attribute.Int("http.response.status_code", srw.statusCode))
+			if srw.statusCode >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(srw.statusCode))
+			}
+		})
+	}
+}
+
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// traceID returns the trace of r for correlating logs, "" when not sampled
+func traceID(r *http.Request) string {
+	if sc := trace.SpanContextFromContext(r.Context()); sc.IsSampled() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
@@ -0,0 +1,279 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/xgaicc/binance-proxy/internal/balancer"
+	"github.com/xgaicc/binance-proxy/internal/clock"
+	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/keystore"
+	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/ratelimit"
+	"github.com/xgaicc/binance-proxy/pkg/binance"
+)
+
+// retryInfoKey carries a *retryInfo in the context of proxy-signed requests
+type retryInfoKey struct{}
+
+// retryInfo lets the retry transport re-sign a request, and for orders,
+// look them up to learn whether a failed attempt was placed after all
+type retryInfo struct {
+	key   *keystore.Key
+	order *orderRef
+}
+
+type orderRef struct {
+	queryPath     string
+	symbol        string
+	clientOrderID string
+}
+
+// errBanned stops retries, order lookups, health probes and failovers
+// while the upstream bans the proxy's IP
+var errBanned = errors.New("upstream ban active")
+
+// retryTransport retries requests that failed upstream with jittered
+// exponential backoff. Only requests that cannot be applied twice are
+// retried: GETs, cancels, and orders that were shown not to have landed.
+// Retries and order lookups are requests the bot did not send, so each
+// reserves its own weight and none is sent during a ban.
+type retryTransport struct {
+	limits
+	next   http.RoundTripper
+	cfg    *config.RetryConfig
+	keys   *keystore.Keystore
+	clock  *clock.Clock
+	api    binance.APIType
+	tag    string
+	logger *logging.RequestLogger
+}
+
+// withRetryInfo prepares a request signed with key for retries. Orders get a
+// newClientOrderId, unless the bot set one, to look them up by.
+func (h *ProxyHandler) withRetryInfo(out *http.Request, method, path string, key *keystore.Key) *http.Request {
+	info := &retryInfo{key: key}
+
+	if queryPath, ok := binance.OrderQueryPath(method, path); ok && h.retry.Orders {
+		params := requestParams(out)
+		ref := &orderRef{
+			queryPath:     queryPath,
+			symbol:        params.Get("symbol"),
+			clientOrderID: params.Get("newClientOrderId"),
+		}
+		if ref.clientOrderID == "" {
+			ref.clientOrderID = newClientOrderID()
+			query := out.URL.Query()
+			query.Set("newClientOrderId", ref.clientOrderID)
+			out.URL.RawQuery = query.Encode()
+		}
+		if ref.symbol != "" {
+			info.order = ref
+		}
+	}
+
+	return out.WithContext(context.WithValue(out.Context(), retryInfoKey{}, info))
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	info, _ := req.Context().Value(retryInfoKey{}).(*retryInfo)
+	idempotent := balancer.Safe(req) || req.Method == http.MethodDelete
+	if !idempotent && (info == nil || info.order == nil) {
+		return t.next.RoundTrip(req)
+	}
+
+	// The body is replayed on every attempt
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	backoff := t.cfg.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		out := req.Clone(req.Context())
+		setRequestBody(out, body)
+		if attempt > 1 && info != nil {
+			if err := t.keys.SignRequest(out, info.key, t.clock.Now(t.api)); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := t.next.RoundTrip(out)
+		reason := balancer.Failure(resp, err)
+		if reason == "" || attempt >= t.cfg.MaxAttempts || req.Context().Err() != nil {
+			if resp != nil && attempt > 1 {
+				resp.Header.Set("X-Proxy-Retries", strconv.Itoa(attempt-1))
+			}
+			return resp, err
+		}
+		if resp != nil {
+			// Failed attempts used weight too, and may have started a ban
+			t.Observe(resp)
+		}
+
+		select {
+		case <-req.Context().Done():
+			return resp, err
+		case <-time.After(backoff/2 + rand.N(backoff/2+1)):
+		}
+		backoff = min(backoff*2, t.cfg.MaxBackoff)
+
+		if !idempotent {
+			// Resend only once Binance confirms the order does not exist
+			placed, lookupErr := t.lookupOrder(req, info)
+			if lookupErr != nil {
+				t.logger.Warn("not retrying order with unknown status",
+					logging.Field("api_type", t.tag),
+					logging.Field("path", req.URL.Path),
+					logging.Field("client_order_id", info.order.clientOrderID),
+					logging.Field("reason", reason),
+					logging.Field("error", lookupErr.Error()))
+				return resp, err
+			}
+			if placed != nil {
+				discard(resp)
+				t.logger.Info("order placed despite upstream failure",
+					logging.Field("api_type", t.tag),
+					logging.Field("path", req.URL.Path),
+					logging.Field("client_order_id", info.order.clientOrderID),
+					logging.Field("reason", reason))
+				trace.SpanFromContext(req.Context()).AddEvent("order recovered",
+					trace.WithAttributes(attribute.String("reason", reason)))
+				// The bot gets the order as the status query reports it, in
+				// the query's shape rather than the placement response's
+				placed.Header.Set("X-Proxy-Order-Recovered", "true")
+				return placed, nil
+			}
+		}
+
+		if admitErr := t.Admit(req); admitErr != nil {
+			t.logger.Warn("not retrying upstream request",
+				logging.Field("api_type", t.tag),
+				logging.Field("method", req.Method),
+				logging.Field("path", req.URL.Path),
+				logging.Field("reason", reason),
+				logging.Field("error", admitErr.Error()))
+			return resp, err
+		}
+
+		discard(resp)
+		trace.SpanFromContext(req.Context()).AddEvent("retry", trace.WithAttributes(
+			attribute.Int("attempt", attempt+1),
+			attribute.String("reason", reason)))
+		t.logger.Warn("retrying upstream request",
+			logging.Field("api_type", t.tag),
+			logging.Field("method", req.Method),
+			logging.Field("path", req.URL.Path),
+			logging.Field("attempt", attempt+1),
+			logging.Field("reason", reason))
+	}
+}
+
+// lookupOrder queries the order a failed request tried to place. It returns
+// the query response if the order exists, nil if Binance reports no such
+// order, and an error if neither could be established.
+func (t *retryTransport) lookupOrder(req *http.Request, info *retryInfo) (*http.Response, error) {
+	query := url.Values{}
+	query.Set("symbol", info.order.symbol)
+	query.Set("origClientOrderId", info.order.clientOrderID)
+
+	target := *req.URL
+	target.Path = info.order.queryPath
+	target.RawQuery = query.Encode()
+
+	lookup, err := http.NewRequestWithContext(req.Context(), http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	lookup.Header.Set(binance.APIKeyHeader, info.key.APIKey)
+	if err := t.Admit(lookup); err != nil {
+		return nil, err
+	}
+	if err := t.keys.SignRequest(lookup, info.key, t.clock.Now(t.api)); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(lookup)
+	if err != nil {
+		return nil, err
+	}
+	t.Observe(resp)
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	var apiErr binance.APIError
+	if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Code == binance.ErrCodeNoSuchOrder {
+		return nil, nil
+	}
+	return nil, &binance.APIError{Code: apiErr.Code, Msg: "order lookup failed with status " + strconv.Itoa(resp.StatusCode) + ": " + apiErr.Msg}
+}
+
+// limits holds back requests the proxy sends on its own, which the bot did
+// not send and the chain's honorBan and throttle never saw
+type limits struct {
+	accountant *ratelimit.Accountant
+	bans       *ratelimit.BanTracker
+}
+
+// Admit checks that no ban is active and reserves the weight of req, as
+// honorBan and throttle do for bot requests
+func (l *limits) Admit(req *http.Request) error {
+	if _, _, banned := l.bans.Active(); banned {
+		return errBanned
+	}
+	if l.accountant == nil {
+		return nil
+	}
+	weight := binance.RequestWeight(req.Method, req.URL.Path, req.URL.Query())
+	orders := binance.OrderCount(req.Method, req.URL.Path)
+	return l.accountant.Acquire(req.Context(), weight, orders, req.Header.Get(binance.APIKeyHeader))
+}
+
+// Observe records the rate limit headers and bans of a response
+func (l *limits) Observe(resp *http.Response) {
+	if l.accountant != nil {
+		l.accountant.Observe(resp.Header, resp.Request.Header.Get(binance.APIKeyHeader))
+	}
+	l.bans.Observe(resp)
+}
+
+func setRequestBody(req *http.Request, body []byte) {
+	if body == nil {
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+}
+
+func discard(resp *http.Response) {
+	if resp != nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// newClientOrderID returns a random ID within Binance's 36 character limit
+func newClientOrderID() string {
+	b := make([]byte, 12)
+	crand.Read(b)
+	return "prx" + hex.EncodeToString(b)
+}
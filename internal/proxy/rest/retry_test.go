@@ -0,0 +1,214 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/keystore"
+	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/ratelimit"
+	"github.com/xgaicc/binance-proxy/pkg/binance"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func response(req *http.Request, status int, body string) *http.Response {
+	rec := httptest.NewRecorder()
+	rec.WriteHeader(status)
+	rec.WriteString(body)
+	resp := rec.Result()
+	resp.Request = req
+	return resp
+}
+
+func TestRetryTransportOrderLookup(t *testing.T) {
+	tests := []struct {
+		name string
+		// lookup answers the order status query sent after the failed attempt
+		lookup        func(*http.Request) (*http.Response, error)
+		wantStatus    int
+		wantPlaced    int
+		wantRecovered bool
+	}{
+		{
+			name: "order found",
+			lookup: func(req *http.Request) (*http.Response, error) {
+				return response(req, http.StatusOK, `{"orderId":1,"status":"NEW"}`), nil
+			},
+			wantStatus:    http.StatusOK,
+			wantPlaced:    1,
+			wantRecovered: true,
+		},
+		{
+			name: "no such order",
+			lookup: func(req *http.Request) (*http.Response, error) {
+				return response(req, http.StatusBadRequest, `{"code":-2013,"msg":"Order does not exist."}`), nil
+			},
+			wantStatus: http.StatusOK,
+			wantPlaced: 2,
+		},
+		{
+			name: "lookup rejected",
+			lookup: func(req *http.Request) (*http.Response, error) {
+				return response(req, http.StatusBadRequest, `{"code":-1021,"msg":"Timestamp for this request is outside of the recvWindow."}`), nil
+			},
+			wantStatus: http.StatusServiceUnavailable,
+			wantPlaced: 1,
+		},
+		{
+			name: "lookup fails",
+			lookup: func(*http.Request) (*http.Response, error) {
+				return nil, errors.New("connection reset")
+			},
+			wantStatus: http.StatusServiceUnavailable,
+			wantPlaced: 1,
+		},
+	}
+
+	cfg := &config.KeystoreConfig{Keys: []config.KeyConfig{{Name: "bot", Credential: "cred", APIKey: "key", Secret: "secret"}}}
+	keys, err := keystore.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := keys.Lookup("cred")
+	logger := logging.NewRequestLogger(zap.NewNop(), &config.LoggingConfig{}, nil)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			placed := 0
+			next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if req.Method == http.MethodGet {
+					if got := req.URL.Query().Get("origClientOrderId"); got != "client-1" {
+						t.Errorf("lookup origClientOrderId = %q, want client-1", got)
+					}
+					return tt.lookup(req)
+				}
+				placed++
+				if placed == 1 {
+					return response(req, http.StatusServiceUnavailable, ""), nil
+				}
+				return response(req, http.StatusOK, `{"orderId":2,"status":"NEW"}`), nil
+			})
+			transport := &retryTransport{
+				next:   next,
+				cfg:    &config.RetryConfig{Enabled: true, MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Orders: true},
+				keys:   keys,
+				limits: limits{bans: ratelimit.NewBanTracker("spot", logger)},
+				api:    binance.APITypeSpot,
+				tag:    "spot",
+				logger: logger,
+			}
+
+			info := &retryInfo{key: key, order: &orderRef{queryPath: "/api/v3/order", symbol: "BTCUSDT", clientOrderID: "client-1"}}
+			ctx := context.WithValue(context.Background(), retryInfoKey{}, info)
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+				"https://api.binance.com/api/v3/order?symbol=BTCUSDT&side=BUY&type=MARKET&quantity=1&newClientOrderId=client-1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set(binance.APIKeyHeader, "key")
+
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip: %v", err)
+			}
+			defer resp.Body.Close()
+			io.Copy(io.Discard, resp.Body)
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if placed != tt.wantPlaced {
+				t.Errorf("order sent %d times, want %d", placed, tt.wantPlaced)
+			}
+			if recovered := resp.Header.Get("X-Proxy-Order-Recovered") == "true"; recovered != tt.wantRecovered {
+				t.Errorf("recovered = %v, want %v", recovered, tt.wantRecovered)
+			}
+		})
+	}
+}
+
+func TestRetryTransportNoRetryDuringBan(t *testing.T) {
+	logger := logging.NewRequestLogger(zap.NewNop(), &config.LoggingConfig{}, nil)
+	bans := ratelimit.NewBanTracker("spot", logger)
+
+	sent := 0
+	next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent++
+		// The ban starts while the first attempt is in flight
+		banned := response(req, ratelimit.StatusIPBanned, `{"code":-1003,"msg":"Way too many requests; IP banned."}`)
+		banned.Header.Set("Retry-After", "60")
+		bans.Observe(banned)
+		return response(req, http.StatusBadGateway, ""), nil
+	})
+	transport := &retryTransport{
+		next:   next,
+		cfg:    &config.RetryConfig{Enabled: true, MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		limits: limits{bans: bans},
+		api:    binance.APITypeSpot,
+		tag:    "spot",
+		logger: logger,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://api.binance.com/api/v3/ticker/price?symbol=BTCUSDT", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	resp.Body.Close()
+	if sent != 1 {
+		t.Errorf("request sent %d times during a ban, want 1", sent)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+}
+
+func TestRetryTransportObservesFailedAttempts(t *testing.T) {
+	logger := logging.NewRequestLogger(zap.NewNop(), &config.LoggingConfig{}, nil)
+	accountant, err := ratelimit.NewAccountant(&config.RateLimitConfig{Enabled: true, RequestWeight: map[string]int{"1m": 6000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := 0
+	next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent++
+		if sent == 1 {
+			resp := response(req, http.StatusServiceUnavailable, "")
+			resp.Header.Set("X-MBX-USED-WEIGHT-1M", "5000")
+			return resp, nil
+		}
+		return response(req, http.StatusOK, `{"symbol":"BTCUSDT","price":"1"}`), nil
+	})
+	transport := &retryTransport{
+		limits: limits{accountant: accountant, bans: ratelimit.NewBanTracker("spot", logger)},
+		next:   next,
+		cfg:    &config.RetryConfig{Enabled: true, MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		api:    binance.APITypeSpot,
+		tag:    "spot",
+		logger: logger,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://api.binance.com/api/v3/ticker/price?symbol=BTCUSDT", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	resp.Body.Close()
+
+	usage := accountant.WeightUsage()
+	if len(usage) != 1 || usage[0].Used < 5000 {
+		t.Errorf("weight usage = %+v, want the failed attempt's 5000 recorded", usage)
+	}
+}
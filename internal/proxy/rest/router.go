@@ -2,50 +2,160 @@ package rest
 
 import (
 	"net/http"
+	"net/url"
 
 	"github.com/gorilla/mux"
 
+	"github.com/xgaicc/binance-proxy/internal/audit"
+	"github.com/xgaicc/binance-proxy/internal/auth"
+	"github.com/xgaicc/binance-proxy/internal/clock"
+	"github.com/xgaicc/binance-proxy/internal/config"
 	"github.com/xgaicc/binance-proxy/internal/health"
+	"github.com/xgaicc/binance-proxy/internal/killswitch"
 	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/marketdata"
+	"github.com/xgaicc/binance-proxy/internal/orderbook"
+	"github.com/xgaicc/binance-proxy/internal/policy"
 	"github.com/xgaicc/binance-proxy/internal/proxy/websocket"
+	"github.com/xgaicc/binance-proxy/internal/risk"
+	"github.com/xgaicc/binance-proxy/internal/userdata"
 	"github.com/xgaicc/binance-proxy/pkg/binance"
 )
 
-func NewRouter(
-	restHandler *ProxyHandler,
-	wsHandler *websocket.Handler,
-	healthHandler *health.Handler,
-	logger *logging.RequestLogger,
-) *mux.Router {
+// RouterConfig holds the handlers and middleware dependencies the router
+// wires up. Optional features are disabled by leaving their field nil.
+type RouterConfig struct {
+	APIs       []*config.APIEndpoints
+	REST       *ProxyHandler
+	WebSocket  *websocket.Handler
+	Health     *health.Handler
+	Auth       auth.Authenticator
+	Policies   *policy.Engine
+	Risk       *risk.Checker
+	KillSwitch *killswitch.Switch
+	Admin      *killswitch.Handler
+	AdminAuth  auth.Authenticator
+	Audit      *audit.Store
+	OrderBooks *orderbook.Handler
+	UserData   *userdata.Handler
+	Clock      *clock.Clock
+	StreamData map[string]*marketdata.Manager
+	Metrics    http.Handler
+	Logger     *logging.RequestLogger
+}
+
+func NewRouter(rc *RouterConfig) *mux.Router {
 	r := mux.NewRouter()
 
 	// Health endpoints (no logging middleware)
-	r.HandleFunc("/health", healthHandler.Liveness).Methods("GET")
-	r.HandleFunc("/ready", healthHandler.Readiness).Methods("GET")
+	r.HandleFunc("/health", rc.Health.Liveness).Methods("GET")
+	r.HandleFunc("/ready", rc.Health.Readiness).Methods("GET")
+	if rc.Metrics != nil {
+		r.Handle("/metrics", rc.Metrics).Methods("GET")
+	}
+
+	// Admin API, only exposed when admin credentials are configured
+	if rc.AdminAuth != nil {
+		adminRouter := r.PathPrefix("/admin").Subrouter()
+		adminRouter.Use(TracingMiddleware("admin", ""))
+		adminRouter.Use(AuthMiddleware(rc.AdminAuth, rc.Logger, "admin"))
+		adminRouter.Use(MetricsMiddleware("admin", ""))
+		adminRouter.Use(LoggingMiddleware(rc.Logger, "admin"))
 
-	// Spot API subrouter
-	spotRouter := r.PathPrefix("/spot").Subrouter()
-	spotRouter.Use(LoggingMiddleware(logger, string(binance.APITypeSpot)))
+		if rc.Admin != nil {
+			adminRouter.HandleFunc("/killswitch", rc.Admin.Get).Methods("GET")
+			adminRouter.HandleFunc("/killswitch", rc.Admin.Engage).Methods("POST")
+			adminRouter.HandleFunc("/killswitch", rc.Admin.Release).Methods("DELETE")
+		}
+		if rc.Audit != nil {
+			adminRouter.HandleFunc("/audit", rc.Audit.Records).Methods("GET")
+		}
+	}
 
-	// Spot WebSocket endpoints
-	spotRouter.HandleFunc("/ws", wsHandler.HandleSpotWS)
-	spotRouter.HandleFunc("/ws/{streams}", wsHandler.HandleSpotWS)
-	spotRouter.HandleFunc("/stream", wsHandler.HandleSpotWS)
+	// Endpoints served by the proxy itself
+	proxyRouter := r.PathPrefix("/proxy").Subrouter()
+	proxyRouter.Use(TracingMiddleware("proxy", ""))
+	if rc.Auth != nil {
+		proxyRouter.Use(AuthMiddleware(rc.Auth, rc.Logger, "proxy"))
+	}
+	proxyRouter.Use(MetricsMiddleware("proxy", ""))
+	proxyRouter.Use(LoggingMiddleware(rc.Logger, "proxy"))
 
-	// Spot REST API - catch all remaining paths
-	spotRouter.PathPrefix("/").Handler(http.StripPrefix("/spot", restHandler.SpotHandler()))
+	if rc.OrderBooks != nil {
+		proxyRouter.HandleFunc("/orderbook/{apiType}/{symbol}", rc.OrderBooks.Depth).Methods("GET")
+		proxyRouter.HandleFunc("/orderbook/{apiType}/{symbol}/ws", rc.OrderBooks.Stream)
+	}
+	if rc.UserData != nil {
+		var stream http.Handler = http.HandlerFunc(rc.UserData.Stream)
+		if rc.Policies != nil {
+			stream = UserDataPolicyMiddleware(rc.Policies, rc.Logger, rc.APIs)(stream)
+		}
+		proxyRouter.Handle("/userdata/{apiType}", stream)
+	}
+	if rc.Clock != nil {
+		proxyRouter.HandleFunc("/time", rc.Clock.Time).Methods("GET")
+	}
 
-	// Futures API subrouter
-	futuresRouter := r.PathPrefix("/futures").Subrouter()
-	futuresRouter.Use(LoggingMiddleware(logger, string(binance.APITypeFutures)))
+	// Binance API families, each under its own prefix: market streams, the
+	// WebSocket API at the path of its upstream URL, and REST for the rest
+	for _, api := range rc.APIs {
+		apiType := binance.APIType(api.Name)
+		sub := apiRouter(r, rc, api)
 
-	// Futures WebSocket endpoints
-	futuresRouter.HandleFunc("/ws", wsHandler.HandleFuturesWS)
-	futuresRouter.HandleFunc("/ws/{streams}", wsHandler.HandleFuturesWS)
-	futuresRouter.HandleFunc("/stream", wsHandler.HandleFuturesWS)
+		sub.HandleFunc("/ws", rc.WebSocket.Streams(apiType))
+		sub.HandleFunc("/ws/{streams:.+}", rc.WebSocket.Streams(apiType))
+		sub.HandleFunc("/stream", rc.WebSocket.Streams(apiType))
+		if path := wsAPIPath(api.WebSocketAPIURL); path != "" {
+			sub.HandleFunc(path, rc.WebSocket.API(apiType))
+		}
 
-	// Futures REST API - catch all remaining paths
-	futuresRouter.PathPrefix("/").Handler(http.StripPrefix("/futures", restHandler.FuturesHandler()))
+		sub.PathPrefix("/").Handler(http.StripPrefix(api.Prefix, rc.REST.Handler(apiType)))
+	}
 
 	return r
 }
+
+// apiRouter creates the subrouter for one API family with its middleware
+// chain: tracing, authentication, metrics, logging, auditing, then the checks that may
+// reject a request before it is forwarded
+func apiRouter(r *mux.Router, rc *RouterConfig, api *config.APIEndpoints) *mux.Router {
+	sub := r.PathPrefix(api.Prefix).Subrouter()
+	prefix, tag := api.Prefix, api.Tag
+
+	sub.Use(TracingMiddleware(tag, prefix))
+	if rc.Auth != nil {
+		sub.Use(AuthMiddleware(rc.Auth, rc.Logger, tag))
+	}
+	sub.Use(MetricsMiddleware(tag, prefix))
+	sub.Use(LoggingMiddleware(rc.Logger, tag))
+	if rc.Audit != nil {
+		sub.Use(AuditMiddleware(rc.Audit, tag, prefix))
+	}
+	if rc.Policies != nil {
+		sub.Use(PolicyMiddleware(rc.Policies, rc.Logger, tag, prefix))
+	}
+	if rc.KillSwitch != nil {
+		sub.Use(KillSwitchMiddleware(rc.KillSwitch, rc.Logger, api.Name, tag, prefix))
+	}
+	if rc.Risk != nil {
+		sub.Use(RiskMiddleware(rc.Risk, rc.Logger, api.Name, tag, prefix))
+	}
+	if m := rc.StreamData[api.Name]; m != nil {
+		sub.Use(StreamDataMiddleware(m, prefix))
+	}
+
+	return sub
+}
+
+// wsAPIPath returns the path a WebSocket API URL is served at, which the
+// proxy mirrors under the family prefix
+func wsAPIPath(apiURL string) string {
+	if apiURL == "" {
+		return ""
+	}
+	target, err := url.Parse(apiURL)
+	if err != nil || target.Path == "" || target.Path == "/" {
+		return ""
+	}
+	return target.Path
+}
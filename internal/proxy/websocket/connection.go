@@ -1,76 +1,484 @@
 package websocket
 
 import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 
+	"github.com/xgaicc/binance-proxy/internal/audit"
+	"github.com/xgaicc/binance-proxy/internal/clock"
+	"github.com/xgaicc/binance-proxy/internal/keystore"
+	"github.com/xgaicc/binance-proxy/internal/killswitch"
 	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/metrics"
+	"github.com/xgaicc/binance-proxy/internal/policy"
+	"github.com/xgaicc/binance-proxy/internal/risk"
+	"github.com/xgaicc/binance-proxy/pkg/binance"
 )
 
+// Guards are the checks applied to each WebSocket API request, the same ones
+// the REST middleware applies to the equivalent endpoint. Nil fields are
+// disabled.
+type Guards struct {
+	Policies   *policy.Engine
+	Risk       *risk.Checker
+	KillSwitch *killswitch.Switch
+}
+
+// apiRequest is a WebSocket API request. Params are decoded with UseNumber so
+// that re-encoding leaves numbers exactly as the client sent them.
+type apiRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params map[string]any  `json:"params,omitempty"`
+}
+
+type apiResponse struct {
+	ID     json.RawMessage   `json:"id"`
+	Status int               `json:"status"`
+	Result json.RawMessage   `json:"result,omitempty"`
+	Error  *binance.APIError `json:"error,omitempty"`
+}
+
+type pendingRequest struct {
+	method  string
+	start   time.Time
+	request []byte
+	apiKey  string
+	// params and signed are kept for the audit store
+	params url.Values
+	signed bool
+}
+
+// ConnectionProxy relays a client's WebSocket API connection to Binance,
+// checking and signing each request and logging it with its response
 type ConnectionProxy struct {
 	client   *websocket.Conn
 	server   *websocket.Conn
+	keys     *keystore.Keystore
+	clock    *clock.Clock
+	guards   *Guards
+	audit    *audit.Store
 	logger   *logging.RequestLogger
 	clientIP string
-	apiType  string
+	apiType  binance.APIType
+	tag      string
+	bot      string
 	done     chan struct{}
 	once     sync.Once
+	writeMu  sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string]*pendingRequest
+	// session is the credential of a session.logon, which later requests
+	// use instead of an apiKey param
+	session string
 }
 
 func NewConnectionProxy(
 	client, server *websocket.Conn,
+	keys *keystore.Keystore,
+	clk *clock.Clock,
+	guards *Guards,
+	store *audit.Store,
 	logger *logging.RequestLogger,
-	clientIP, apiType string,
+	clientIP string, apiType binance.APIType, tag, bot string,
 ) *ConnectionProxy {
 	return &ConnectionProxy{
 		client:   client,
 		server:   server,
+		keys:     keys,
+		clock:    clk,
+		guards:   guards,
+		audit:    store,
 		logger:   logger,
 		clientIP: clientIP,
 		apiType:  apiType,
+		tag:      tag,
+		bot:      bot,
 		done:     make(chan struct{}),
+		pending:  make(map[string]*pendingRequest),
 	}
 }
 
+// Start relays messages until either side disconnects
 func (p *ConnectionProxy) Start() {
-	// Client -> Server
-	go p.forward(p.client, p.server, "client->server")
-
-	// Server -> Client
-	go p.forward(p.server, p.client, "server->client")
+	go p.forwardRequests()
+	go p.forwardResponses()
 
 	<-p.done
 }
 
-func (p *ConnectionProxy) forward(src, dst *websocket.Conn, direction string) {
+func (p *ConnectionProxy) forwardRequests() {
 	defer p.close()
 
 	for {
-		messageType, message, err := src.ReadMessage()
+		messageType, message, err := p.client.ReadMessage()
 		if err != nil {
 			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 				p.logger.Debug("WebSocket read completed",
-					logging.Field("direction", direction),
+					logging.Field("direction", "client->server"),
 					logging.Field("client_ip", p.clientIP))
 			}
 			return
 		}
 
-		// Log the message
-		p.logger.LogWebSocketMessage(direction, p.clientIP, p.apiType, message)
+		p.logger.LogWebSocketMessage("client->server", p.clientIP, p.tag, message)
+		metrics.AddBytes(p.tag, metrics.TransportWebSocket, metrics.DirectionIn, len(message))
 
-		if err := dst.WriteMessage(messageType, message); err != nil {
+		forward, reply := p.handleRequest(message)
+		if reply != nil {
+			if err := p.writeClient(websocket.TextMessage, reply); err != nil {
+				return
+			}
+			continue
+		}
+
+		if err := p.server.WriteMessage(messageType, forward); err != nil {
 			p.logger.Debug("WebSocket write completed",
-				logging.Field("direction", direction),
+				logging.Field("direction", "client->server"),
 				logging.Field("client_ip", p.clientIP))
 			return
 		}
 	}
 }
 
+func (p *ConnectionProxy) forwardResponses() {
+	defer p.close()
+
+	for {
+		messageType, message, err := p.server.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				p.logger.Debug("WebSocket read completed",
+					logging.Field("direction", "server->client"),
+					logging.Field("client_ip", p.clientIP))
+			}
+			return
+		}
+
+		p.logger.LogWebSocketMessage("server->client", p.clientIP, p.tag, message)
+
+		var resp apiResponse
+		if json.Unmarshal(message, &resp) == nil && resp.ID != nil {
+			if req := p.complete(resp.ID); req != nil {
+				p.logRequest(resp.ID, req, resp.Status, message)
+				p.auditRequest(req, resp.Status, message, resp.Result)
+			}
+		}
+
+		if err := p.writeClient(messageType, message); err != nil {
+			p.logger.Debug("WebSocket write completed",
+				logging.Field("direction", "server->client"),
+				logging.Field("client_ip", p.clientIP))
+			return
+		}
+	}
+}
+
+// handleRequest checks a request and signs it for proxy-held keys. It returns
+// either the message to forward or a reply rejecting the request.
+func (p *ConnectionProxy) handleRequest(message []byte) (forward, reply []byte) {
+	var req apiRequest
+	dec := json.NewDecoder(bytes.NewReader(message))
+	dec.UseNumber()
+	if err := dec.Decode(&req); err != nil || req.Method == "" {
+		// Binance answers malformed requests itself
+		return message, nil
+	}
+
+	credential := stringParam(req.Params, "apiKey")
+	if req.Method == "session.logon" {
+		p.mu.Lock()
+		p.session = credential
+		p.mu.Unlock()
+	} else if credential == "" {
+		p.mu.Lock()
+		credential = p.session
+		p.mu.Unlock()
+	}
+
+	pending := &pendingRequest{
+		method:  req.Method,
+		start:   time.Now(),
+		request: message,
+		apiKey:  credential,
+		params:  paramValues(req.Params),
+	}
+	pending.signed = p.signed(req.Method, pending.params)
+
+	if status, apiErr := p.check(req.Method, req.Params); apiErr != nil {
+		return nil, p.reject(req.ID, pending, status, apiErr)
+	}
+
+	forward = message
+	if key, ok := p.keys.Lookup(stringParam(req.Params, "apiKey")); ok {
+		// The proxy credential must never reach Binance: requests that
+		// cannot be signed are answered here
+		if !pending.signed {
+			req.Params["apiKey"] = key.APIKey
+		} else if err := p.sign(req.Params, key); err != nil {
+			p.logger.Error("failed to sign request",
+				logging.Field("api_type", p.tag),
+				logging.Field("method", req.Method),
+				logging.Field("key", key.Name),
+				logging.Field("error", err.Error()))
+			return nil, p.reject(req.ID, pending, http.StatusInternalServerError, &binance.APIError{
+				Code: binance.ErrCodeUnknown,
+				Msg:  "Proxy failed to sign the request.",
+			})
+		}
+		forward, _ = json.Marshal(req)
+	}
+
+	if req.ID != nil {
+		p.mu.Lock()
+		p.pending[string(req.ID)] = pending
+		p.mu.Unlock()
+	}
+	p.recordOrder(req.Method, pending.params, credential)
+	return forward, nil
+}
+
+// recordOrder tells the kill switch where bot sends an order, once the order
+// passed every check and is about to be forwarded
+func (p *ConnectionProxy) recordOrder(method string, params url.Values, credential string) {
+	if p.guards.KillSwitch == nil {
+		return
+	}
+	httpMethod, path, ok := binance.WSAPIEndpoint(p.apiType, method)
+	symbol := params.Get("symbol")
+	if !ok || binance.OrderCount(httpMethod, path) == 0 || symbol == "" {
+		return
+	}
+	err := p.guards.KillSwitch.RecordOrder(p.bot, killswitch.Activity{
+		APIType:    string(p.apiType),
+		Credential: credential,
+		Symbol:     strings.ToUpper(symbol),
+	})
+	if err != nil {
+		p.logger.Error("failed to persist kill switch activity", logging.Field("error", err.Error()))
+	}
+}
+
+// reject answers a request on Binance's behalf without forwarding it
+func (p *ConnectionProxy) reject(id json.RawMessage, pending *pendingRequest, status int, apiErr *binance.APIError) []byte {
+	reply, _ := json.Marshal(struct {
+		ID     json.RawMessage   `json:"id"`
+		Status int               `json:"status"`
+		Error  *binance.APIError `json:"error"`
+	}{id, status, apiErr})
+	p.logRequest(id, pending, status, reply)
+	p.auditRequest(pending, status, reply, nil)
+	return reply
+}
+
+// signedMethods are the session and user data stream methods that are
+// signed although they have no REST equivalent
+var signedMethods = map[string]bool{
+	"session.logon":                      true,
+	"userDataStream.subscribe.signature": true,
+}
+
+// signed reports whether a request carries a signature or goes to a method
+// that requires one, judged by its REST equivalent where it has one
+func (p *ConnectionProxy) signed(method string, params url.Values) bool {
+	if params.Has("signature") || signedMethods[method] {
+		return true
+	}
+	httpMethod, path, ok := binance.WSAPIEndpoint(p.apiType, method)
+	return ok && binance.RequiresSignature(httpMethod, path, params)
+}
+
+// sessionMethods are the methods without a REST equivalent that are allowed
+// to any bot the connection route admits
+var sessionMethods = map[string]bool{
+	"session.logon":                      true,
+	"session.status":                     true,
+	"session.logout":                     true,
+	"userDataStream.start":               true,
+	"userDataStream.ping":                true,
+	"userDataStream.stop":                true,
+	"userDataStream.subscribe":           true,
+	"userDataStream.subscribe.signature": true,
+	"userDataStream.unsubscribe":         true,
+}
+
+// check applies policies, the kill switch and risk checks to methods with a
+// REST equivalent. Session and user data stream methods are allowed; any
+// other method is rejected while a guard is configured, as none of them
+// could be applied to it.
+func (p *ConnectionProxy) check(method string, params map[string]any) (int, *binance.APIError) {
+	httpMethod, path, ok := binance.WSAPIEndpoint(p.apiType, method)
+	if !ok {
+		guarded := p.guards.Policies != nil || p.guards.Risk != nil || p.guards.KillSwitch != nil
+		if !guarded || sessionMethods[method] {
+			return 0, nil
+		}
+		p.logger.LogPolicyDenial(p.bot, p.clientIP, method, "", p.tag, "unmapped method")
+		return http.StatusForbidden, &binance.APIError{
+			Code: binance.ErrCodeRejectedAPIKey,
+			Msg:  "Invalid API-key, IP, or permissions for action.",
+		}
+	}
+	if p.guards.Policies != nil {
+		if decision := p.guards.Policies.Evaluate(p.bot, httpMethod, path); !decision.Allowed {
+			p.logger.LogPolicyDenial(p.bot, p.clientIP, httpMethod, path, p.tag, decision.Rule)
+			return http.StatusForbidden, &binance.APIError{
+				Code: binance.ErrCodeRejectedAPIKey,
+				Msg:  "Invalid API-key, IP, or permissions for action.",
+			}
+		}
+	}
+
+	values := paramValues(params)
+
+	if p.guards.KillSwitch != nil && binance.OrderCount(httpMethod, path) > 0 {
+		if entry, blocked := p.guards.KillSwitch.Blocked(p.bot); blocked {
+			p.logger.LogRiskRejection(p.bot, p.clientIP, httpMethod, path, p.tag,
+				binance.ErrCodeNewOrderRejected, "kill switch: "+entry.Reason)
+			return http.StatusBadRequest, &binance.APIError{
+				Code: binance.ErrCodeNewOrderRejected,
+				Msg:  "New orders are disabled by the proxy kill switch.",
+			}
+		}
+	}
+
+	if p.guards.Risk != nil {
+		if apiErr := p.guards.Risk.Check(p.bot, string(p.apiType), httpMethod, path, values); apiErr != nil {
+			p.logger.LogRiskRejection(p.bot, p.clientIP, httpMethod, path, p.tag, apiErr.Code, apiErr.Msg)
+			return http.StatusBadRequest, apiErr
+		}
+	}
+
+	return 0, nil
+}
+
+// sign replaces the proxy credential with the Binance API key and signs the
+// params, keeping their JSON types
+func (p *ConnectionProxy) sign(params map[string]any, key *keystore.Key) error {
+	signed := make(map[string]string, len(params)+3)
+	for name, value := range params {
+		signed[name] = formatParam(value)
+	}
+	if err := p.keys.SignParams(signed, key, p.clock.Now(p.apiType)); err != nil {
+		return err
+	}
+
+	params["apiKey"] = signed["apiKey"]
+	params["signature"] = signed["signature"]
+	params["timestamp"] = json.Number(signed["timestamp"])
+	if _, ok := params["recvWindow"]; !ok && signed["recvWindow"] != "" {
+		params["recvWindow"] = json.Number(signed["recvWindow"])
+	}
+	return nil
+}
+
+func (p *ConnectionProxy) complete(id json.RawMessage) *pendingRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	req, ok := p.pending[string(id)]
+	if !ok {
+		return nil
+	}
+	delete(p.pending, string(id))
+	return req
+}
+
+func (p *ConnectionProxy) logRequest(id json.RawMessage, req *pendingRequest, status int, response []byte) {
+	p.logger.LogWebSocketAPI(logging.WebSocketAPILog{
+		Timestamp: req.start,
+		Duration:  time.Since(req.start),
+		ID:        strings.Trim(string(id), `"`),
+		Method:    req.method,
+		Status:    status,
+		Request:   string(req.request),
+		Response:  string(response),
+		ClientIP:  p.clientIP,
+		APIKey:    req.apiKey,
+		APIType:   p.tag,
+		Bot:       p.bot,
+	})
+}
+
+// auditRequest stores a signed request with its response. result is the
+// response's result, which holds the order for order methods.
+func (p *ConnectionProxy) auditRequest(req *pendingRequest, status int, response, result []byte) {
+	if p.audit == nil || !req.signed {
+		return
+	}
+	_, path, _ := binance.WSAPIEndpoint(p.apiType, req.method)
+	rec := &audit.Record{
+		Time:       req.start.UnixMilli(),
+		DurationMs: float64(time.Since(req.start).Microseconds()) / 1000,
+		Transport:  audit.TransportWebSocket,
+		APIType:    p.tag,
+		Bot:        p.bot,
+		ClientIP:   p.clientIP,
+		APIKey:     logging.MaskAPIKey(req.apiKey),
+		Method:     req.method,
+		Path:       path,
+		Status:     status,
+		Request:    string(req.request),
+		Response:   string(response),
+	}
+	rec.Identify(req.params, result)
+	p.audit.Record(rec)
+}
+
+// writeClient serializes writes from both relay directions
+func (p *ConnectionProxy) writeClient(messageType int, message []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	if err := p.client.WriteMessage(messageType, message); err != nil {
+		return err
+	}
+	metrics.AddBytes(p.tag, metrics.TransportWebSocket, metrics.DirectionOut, len(message))
+	return nil
+}
+
 func (p *ConnectionProxy) close() {
 	p.once.Do(func() {
 		close(p.done)
 	})
 }
+
+func stringParam(params map[string]any, name string) string {
+	s, _ := params[name].(string)
+	return s
+}
+
+// formatParam renders a param value as Binance does when computing the
+// signature payload
+func formatParam(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+func paramValues(params map[string]any) url.Values {
+	values := make(url.Values, len(params))
+	for name, value := range params {
+		values.Set(name, formatParam(value))
+	}
+	return values
+}
@@ -0,0 +1,77 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/keystore"
+	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/policy"
+	"github.com/xgaicc/binance-proxy/pkg/binance"
+)
+
+func TestConnectionProxyCheck(t *testing.T) {
+	policies, err := policy.New(&config.PolicyConfig{
+		Enabled:       true,
+		DefaultAction: policy.EffectDeny,
+		Bots: []config.BotPolicyConfig{{
+			Bot:   "grid-bot",
+			Rules: []config.PolicyRuleConfig{{Methods: []string{"POST"}, Paths: []string{"/fapi/v1/order"}}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keystore.New(&config.KeystoreConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logging.NewRequestLogger(zap.NewNop(), &config.LoggingConfig{}, nil)
+
+	tests := []struct {
+		name       string
+		guards     *Guards
+		method     string
+		wantStatus int
+	}{
+		{name: "mapped order allowed by policy", guards: &Guards{Policies: policies}, method: "order.place"},
+		{name: "mapped method denied by default", guards: &Guards{Policies: policies}, method: "order.cancel", wantStatus: 403},
+		{name: "unmapped order method denied", guards: &Guards{Policies: policies}, method: "algoOrder.place", wantStatus: 403},
+		{name: "session method allowed", guards: &Guards{Policies: policies}, method: "session.status"},
+		{name: "user data stream method allowed", guards: &Guards{Policies: policies}, method: "userDataStream.start"},
+		{name: "unmapped method without guards", guards: &Guards{}, method: "algoOrder.place"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewConnectionProxy(nil, nil, keys, nil, tt.guards, nil, logger,
+				"127.0.0.1", binance.APITypeFutures, "futures", "grid-bot")
+
+			message := `{"id":1,"method":"` + tt.method + `","params":{"symbol":"BTCUSDT","side":"BUY","type":"MARKET","quantity":"1"}}`
+			forward, reply := p.handleRequest([]byte(message))
+
+			if tt.wantStatus == 0 {
+				if reply != nil || forward == nil {
+					t.Fatalf("request was rejected: %s", reply)
+				}
+				return
+			}
+			if forward != nil {
+				t.Fatal("request was forwarded")
+			}
+			var resp struct {
+				Status int               `json:"status"`
+				Error  *binance.APIError `json:"error"`
+			}
+			if err := json.Unmarshal(reply, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != tt.wantStatus || resp.Error == nil || resp.Error.Code != binance.ErrCodeRejectedAPIKey {
+				t.Errorf("reply = %s, want status %d with code %d", reply, tt.wantStatus, binance.ErrCodeRejectedAPIKey)
+			}
+		})
+	}
+}
@@ -8,9 +8,16 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
 
+	"github.com/xgaicc/binance-proxy/internal/audit"
+	"github.com/xgaicc/binance-proxy/internal/auth"
+	"github.com/xgaicc/binance-proxy/internal/clock"
 	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/keystore"
 	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/metrics"
+	"github.com/xgaicc/binance-proxy/internal/tracing"
 	"github.com/xgaicc/binance-proxy/pkg/binance"
 )
 
@@ -21,103 +28,186 @@ var upgrader = websocket.Upgrader{
 }
 
 type Handler struct {
-	spotWSURL    string
-	futuresWSURL string
-	logger       *logging.RequestLogger
+	families map[binance.APIType]*family
+	keys     *keystore.Keystore
+	clock    *clock.Clock
+	guards   *Guards
+	audit    *audit.Store
+	logger   *logging.RequestLogger
 }
 
-func NewHandler(cfg *config.Config, logger *logging.RequestLogger) *Handler {
-	return &Handler{
-		spotWSURL:    cfg.Binance.Spot.WebSocketURL,
-		futuresWSURL: cfg.Binance.Futures.WebSocketURL,
-		logger:       logger,
+// family is the WebSocket side of one API family
+type family struct {
+	apiType binance.APIType
+	tag     string
+	hub     *Hub
+	apiURL  string
+}
+
+func NewHandler(cfg *config.Config, keys *keystore.Keystore, clk *clock.Clock, guards *Guards, store *audit.Store, logger *logging.RequestLogger) *Handler {
+	if guards == nil {
+		guards = &Guards{}
 	}
+	h := &Handler{
+		families: make(map[binance.APIType]*family),
+		keys:     keys,
+		clock:    clk,
+		guards:   guards,
+		audit:    store,
+		logger:   logger,
+	}
+	for _, api := range cfg.Binance.APIs() {
+		f := &family{
+			apiType: binance.APIType(api.Name),
+			tag:     api.Tag,
+			apiURL:  api.WebSocketAPIURL,
+		}
+		if api.WebSocketURL != "" {
+			f.hub = NewHub(api.WebSocketURL, api.Tag, &cfg.WebSocket, logger)
+		}
+		h.families[f.apiType] = f
+	}
+	return h
 }
 
-func (h *Handler) HandleSpotWS(w http.ResponseWriter, r *http.Request) {
-	h.proxyWebSocket(w, r, h.spotWSURL, string(binance.APITypeSpot))
+// Streams returns the handler for an API family's market streams
+func (h *Handler) Streams(apiType binance.APIType) http.HandlerFunc {
+	f := h.families[apiType]
+	return func(w http.ResponseWriter, r *http.Request) {
+		if f.hub == nil {
+			http.Error(w, "No streams configured", http.StatusNotFound)
+			return
+		}
+		h.serveStreams(w, r, f.hub, f.tag)
+	}
+}
+
+// API returns the handler for an API family's WebSocket API
+func (h *Handler) API(apiType binance.APIType) http.HandlerFunc {
+	f := h.families[apiType]
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.serveAPI(w, r, f)
+	}
 }
 
-func (h *Handler) HandleFuturesWS(w http.ResponseWriter, r *http.Request) {
-	h.proxyWebSocket(w, r, h.futuresWSURL, string(binance.APITypeFutures))
+// Hub returns the shared stream hub of an API family, nil if it has no
+// stream URL
+func (h *Handler) Hub(apiType binance.APIType) *Hub {
+	if f, ok := h.families[apiType]; ok {
+		return f.hub
+	}
+	return nil
 }
 
-func (h *Handler) proxyWebSocket(w http.ResponseWriter, r *http.Request, targetBase, apiType string) {
+// serveAPI relays a WebSocket API connection. Each client gets its own
+// upstream connection, since requests and sessions belong to one bot.
+func (h *Handler) serveAPI(w http.ResponseWriter, r *http.Request, f *family) {
 	startTime := time.Now()
 
-	// Extract client IP
 	clientIP := r.RemoteAddr
 	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
 		clientIP = strings.Split(forwarded, ",")[0]
 	}
 
-	// Build target URL
-	targetURL, err := url.Parse(targetBase)
+	target, err := url.Parse(f.apiURL)
 	if err != nil {
-		h.logger.Error("failed to parse target URL", logging.Field("error", err.Error()))
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, "Invalid upstream URL", http.StatusInternalServerError)
 		return
 	}
+	// Options such as returnRateLimits are passed through
+	target.RawQuery = r.URL.RawQuery
 
-	// Get stream path from URL
-	vars := mux.Vars(r)
-	streams := vars["streams"]
-
-	// Build the WebSocket path
-	if streams != "" {
-		targetURL.Path = "/ws/" + streams
-	} else if r.URL.Path != "" {
-		// Remove the /spot or /futures prefix and use the rest
-		path := r.URL.Path
-		if strings.HasPrefix(path, "/spot") {
-			path = strings.TrimPrefix(path, "/spot")
-		} else if strings.HasPrefix(path, "/futures") {
-			path = strings.TrimPrefix(path, "/futures")
-		}
-		if path == "" || path == "/" {
-			path = "/ws"
-		}
-		targetURL.Path = path
+	dialer := websocket.Dialer{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
 	}
+	headers := http.Header{}
+	headers.Set("Origin", "https://"+target.Host)
 
-	// Preserve query parameters
-	targetURL.RawQuery = r.URL.RawQuery
+	bot := auth.Bot(r)
+	ctx, span := tracing.StartServer(r.Context(), "websocket api",
+		attribute.String("api_type", f.tag),
+		attribute.String("bot", bot))
+	defer span.End()
+
+	_, dialSpan := tracing.StartClient(ctx, "upstream dial", attribute.String("server.address", target.Host))
+	serverConn, _, err := dialer.DialContext(r.Context(), target.String(), headers)
+	if err != nil {
+		tracing.Fail(dialSpan, err)
+		dialSpan.End()
+		tracing.Fail(span, err)
+		if r.Context().Err() == nil {
+			metrics.DialFailed(f.tag, metrics.TransportWebSocket)
+		}
+		h.logger.Error("failed to connect to Binance WebSocket API",
+			logging.Field("error", err.Error()),
+			logging.Field("target", h.logger.URL(target)))
+		http.Error(w, "Failed to connect to upstream", http.StatusBadGateway)
+		return
+	}
+	dialSpan.End()
+	defer serverConn.Close()
 
-	h.logger.LogWebSocketConnect(clientIP, targetURL.Path, apiType)
+	h.logger.LogWebSocketConnect(clientIP, r.URL.Path, f.tag, bot)
 
-	// Upgrade client connection
 	clientConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		h.logger.Error("failed to upgrade client connection", logging.Field("error", err.Error()))
 		return
 	}
 	defer clientConn.Close()
+	defer metrics.ConnectionOpened(f.tag, metrics.ConnAPI)()
 
-	// Connect to Binance WebSocket
-	dialer := websocket.Dialer{
-		ReadBufferSize:  4096,
-		WriteBufferSize: 4096,
+	NewConnectionProxy(clientConn, serverConn, h.keys, h.clock, h.guards, h.audit, h.logger, clientIP, f.apiType, f.tag, bot).Start()
+
+	h.logger.LogWebSocketDisconnect(clientIP, r.URL.Path, f.tag, bot, time.Since(startTime))
+}
+
+func (h *Handler) serveStreams(w http.ResponseWriter, r *http.Request, hub *Hub, apiType string) {
+	startTime := time.Now()
+
+	// Extract client IP
+	clientIP := r.RemoteAddr
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		clientIP = strings.Split(forwarded, ",")[0]
 	}
 
-	// Set required headers for Binance WebSocket connection
-	headers := http.Header{}
-	headers.Set("Origin", "https://"+targetURL.Host)
-	if apiKey := r.Header.Get(binance.APIKeyHeader); apiKey != "" {
-		headers.Set(binance.APIKeyHeader, apiKey)
+	// Streams come from the path for raw connections (/ws/a@trade/b@trade)
+	// and from the query for combined ones (/stream?streams=a@trade/b@trade)
+	combined := strings.HasSuffix(r.URL.Path, "/stream")
+	list := mux.Vars(r)["streams"]
+	if combined {
+		list = r.URL.Query().Get("streams")
+	}
+
+	var streams []string
+	if list != "" {
+		streams = strings.Split(list, "/")
 	}
 
-	serverConn, _, err := dialer.Dial(targetURL.String(), headers)
+	bot := auth.Bot(r)
+	h.logger.LogWebSocketConnect(clientIP, r.URL.Path, apiType, bot)
+
+	_, span := tracing.StartServer(r.Context(), "websocket streams",
+		attribute.String("api_type", apiType),
+		attribute.String("bot", bot),
+		attribute.Bool("combined", combined),
+		attribute.Int("streams", len(streams)))
+	defer span.End()
+
+	// Upgrade client connection
+	clientConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		h.logger.Error("failed to connect to Binance WebSocket",
-			logging.Field("error", err.Error()),
-			logging.Field("target", targetURL.String()))
+		h.logger.Error("failed to upgrade client connection", logging.Field("error", err.Error()))
 		return
 	}
-	defer serverConn.Close()
+	defer clientConn.Close()
+	defer metrics.ConnectionOpened(apiType, metrics.ConnStreams)()
 
-	// Bidirectional proxy
-	proxy := NewConnectionProxy(clientConn, serverConn, h.logger, clientIP, apiType)
-	proxy.Start()
+	// Serve from the shared upstream connection
+	s := newSession(clientConn, hub, combined, h.logger, clientIP, apiType)
+	s.sub.span = span
+	s.run(streams)
 
-	h.logger.LogWebSocketDisconnect(clientIP, targetURL.Path, apiType, time.Since(startTime))
+	h.logger.LogWebSocketDisconnect(clientIP, r.URL.Path, apiType, bot, time.Since(startTime))
 }
@@ -0,0 +1,697 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/metrics"
+)
+
+const (
+	// Binance allows 1024 streams per connection
+	maxStreamsPerConnection = 1024
+
+	// Binance disconnects clients sending more than 5 messages per second
+	controlMessageInterval = 250 * time.Millisecond
+
+	// Streams beyond this many are subscribed after connecting rather than
+	// passed in the connection URL
+	maxURLStreams = 200
+
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = time.Minute
+
+	// dialTimeout bounds connecting and the WebSocket handshake
+	dialTimeout = 10 * time.Second
+
+	subscriberBuffer = 256
+)
+
+var ErrTooManyStreams = errors.New("too many streams on the shared upstream connection")
+
+// Message is one event from a Binance stream. Messages without a stream are
+// notices from the proxy itself.
+type Message struct {
+	Stream string
+	Data   json.RawMessage
+}
+
+// Subscriber receives messages for the streams it has subscribed to on a hub
+type Subscriber struct {
+	ch     chan Message
+	done   chan struct{}
+	once   sync.Once
+	reason string
+	// span of the client connection, which records upstream reconnects
+	span trace.Span
+}
+
+func NewSubscriber() *Subscriber {
+	return &Subscriber{
+		ch:   make(chan Message, subscriberBuffer),
+		done: make(chan struct{}),
+	}
+}
+
+func (s *Subscriber) Messages() <-chan Message {
+	return s.ch
+}
+
+// Done is closed when the hub drops the subscriber
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+// Reason explains why the subscriber was dropped
+func (s *Subscriber) Reason() string {
+	<-s.done
+	return s.reason
+}
+
+func (s *Subscriber) close(reason string) {
+	s.once.Do(func() {
+		s.reason = reason
+		close(s.done)
+	})
+}
+
+// Hub shares one upstream Binance connection between all clients of an API
+// type. Each stream is subscribed upstream once, reference counted by its
+// subscribers, and unsubscribed when the last one leaves.
+//
+// Clients are kept connected when the upstream connection drops: the hub
+// reconnects with backoff and restores every stream. Connections are also
+// replaced ahead of Binance's 24 hour limit, opening the new one before the
+// old one is closed.
+type Hub struct {
+	baseURL string
+	apiType string
+	maxAge  time.Duration
+	notice  bool
+	logger  *logging.RequestLogger
+
+	mu           sync.Mutex
+	streams      map[string]map[*Subscriber]struct{}
+	subscribers  map[*Subscriber]map[string]struct{}
+	up           *upstreamConn
+	reconnecting bool
+	// connecting is set while the first connection is dialed, which happens
+	// without holding mu
+	connecting bool
+}
+
+func NewHub(baseURL, apiType string, cfg *config.WebSocketConfig, logger *logging.RequestLogger) *Hub {
+	return &Hub{
+		baseURL:     baseURL,
+		apiType:     apiType,
+		maxAge:      cfg.MaxConnectionAge,
+		notice:      cfg.ReconnectNotice,
+		logger:      logger,
+		streams:     make(map[string]map[*Subscriber]struct{}),
+		subscribers: make(map[*Subscriber]map[string]struct{}),
+	}
+}
+
+// Subscribe adds streams to sub, subscribing upstream to those no other
+// subscriber is receiving yet. The first subscriber dials the upstream
+// connection and gets its error; others subscribing meanwhile are served once
+// it is open.
+func (h *Hub) Subscribe(sub *Subscriber, streams ...string) error {
+	h.mu.Lock()
+
+	streams = normalizeStreams(streams)
+
+	var added []string
+	for _, stream := range streams {
+		if _, ok := h.streams[stream]; !ok {
+			added = append(added, stream)
+		}
+	}
+	if len(h.streams)+len(added) > maxStreamsPerConnection {
+		h.mu.Unlock()
+		return ErrTooManyStreams
+	}
+
+	h.add(sub, streams)
+	if len(added) == 0 || h.up != nil || h.reconnecting || h.connecting {
+		if h.up != nil {
+			h.up.subscribe(added)
+		}
+		h.mu.Unlock()
+		return nil
+	}
+
+	// Dial without holding mu, so that a slow handshake does not hold up
+	// other clients
+	h.connecting = true
+	dialed := h.streamList()
+	h.mu.Unlock()
+
+	up, err := h.dial(dialed)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.connecting = false
+	if err != nil {
+		h.unsubscribeLocked(sub, streams)
+		if len(h.streams) > 0 {
+			// Streams other clients subscribed to meanwhile
+			h.reconnecting = true
+			go h.reconnect(time.Now())
+		}
+		return err
+	}
+	h.adopt(up, dialed)
+	return nil
+}
+
+// add records that sub receives streams. Called with h.mu held.
+func (h *Hub) add(sub *Subscriber, streams []string) {
+	own, ok := h.subscribers[sub]
+	if !ok {
+		own = make(map[string]struct{})
+		h.subscribers[sub] = own
+	}
+	for _, stream := range streams {
+		subs, ok := h.streams[stream]
+		if !ok {
+			subs = make(map[*Subscriber]struct{})
+			h.streams[stream] = subs
+		}
+		subs[sub] = struct{}{}
+		own[stream] = struct{}{}
+	}
+}
+
+// Unsubscribe removes streams from sub, unsubscribing upstream from those
+// that have no subscribers left
+func (h *Hub) Unsubscribe(sub *Subscriber, streams ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.unsubscribeLocked(sub, normalizeStreams(streams))
+}
+
+// Remove drops sub from every stream it subscribed to
+func (h *Hub) Remove(sub *Subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.unsubscribeLocked(sub, h.streamsOf(sub))
+}
+
+// Streams returns the streams sub is subscribed to
+func (h *Hub) Streams(sub *Subscriber) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.streamsOf(sub)
+}
+
+func (h *Hub) streamsOf(sub *Subscriber) []string {
+	streams := make([]string, 0, len(h.subscribers[sub]))
+	for stream := range h.subscribers[sub] {
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+func (h *Hub) unsubscribeLocked(sub *Subscriber, streams []string) {
+	var removed []string
+	for _, stream := range streams {
+		subs, ok := h.streams[stream]
+		if !ok {
+			continue
+		}
+		delete(subs, sub)
+		delete(h.subscribers[sub], stream)
+		if len(subs) == 0 {
+			delete(h.streams, stream)
+			removed = append(removed, stream)
+		}
+	}
+	if len(h.subscribers[sub]) == 0 {
+		delete(h.subscribers, sub)
+	}
+
+	if h.up == nil || len(removed) == 0 {
+		return
+	}
+	if len(h.streams) == 0 {
+		h.logger.Info("closing idle upstream websocket", logging.Field("api_type", h.apiType))
+		h.up.close()
+		h.up = nil
+		return
+	}
+	h.up.unsubscribe(removed)
+}
+
+func (h *Hub) streamList() []string {
+	streams := make([]string, 0, len(h.streams))
+	for stream := range h.streams {
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+// start makes up the current upstream connection
+func (h *Hub) start(up *upstreamConn) {
+	h.up = up
+	go h.read(up)
+	if h.maxAge > 0 {
+		up.mu.Lock()
+		up.rotation = time.AfterFunc(h.maxAge, func() { h.rotate(up) })
+		up.mu.Unlock()
+	}
+}
+
+// adopt starts a connection dialed with streams, reconciling the
+// subscriptions that changed while it was being opened. Called with h.mu held.
+func (h *Hub) adopt(up *upstreamConn, streams []string) {
+	if len(h.streams) == 0 {
+		up.close()
+		return
+	}
+
+	dialed := make(map[string]bool, len(streams))
+	for _, stream := range streams {
+		dialed[stream] = true
+	}
+	var added, removed []string
+	for stream := range h.streams {
+		if !dialed[stream] {
+			added = append(added, stream)
+		}
+	}
+	for _, stream := range streams {
+		if _, ok := h.streams[stream]; !ok {
+			removed = append(removed, stream)
+		}
+	}
+	up.subscribe(added)
+	up.unsubscribe(removed)
+
+	h.start(up)
+}
+
+// dial opens a combined stream connection, passing the first streams in the
+// URL and subscribing to the rest once connected
+func (h *Hub) dial(streams []string) (*upstreamConn, error) {
+	target, err := url.Parse(h.baseURL)
+	if err != nil {
+		return nil, err
+	}
+	initial, rest := streams, []string(nil)
+	if len(streams) > maxURLStreams {
+		initial, rest = streams[:maxURLStreams], streams[maxURLStreams:]
+	}
+	// Some families serve streams below a base path, such as /eoptions
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/stream"
+	target.RawQuery = "streams=" + strings.Join(initial, "/")
+
+	dialer := websocket.Dialer{
+		ReadBufferSize:   4096,
+		WriteBufferSize:  4096,
+		HandshakeTimeout: dialTimeout,
+	}
+
+	headers := http.Header{}
+	headers.Set("Origin", "https://"+target.Host)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	conn, _, err := dialer.DialContext(ctx, target.String(), headers)
+	if err != nil {
+		metrics.DialFailed(h.apiType, metrics.TransportWebSocket)
+		h.logger.Error("failed to connect to Binance WebSocket",
+			logging.Field("error", err.Error()),
+			logging.Field("target", h.logger.URL(target)))
+		return nil, err
+	}
+
+	h.logger.Info("upstream websocket connected",
+		logging.Field("api_type", h.apiType),
+		logging.Field("streams", len(streams)))
+
+	up := newUpstreamConn(conn)
+	up.subscribe(rest)
+	return up, nil
+}
+
+// envelope is a frame on a combined stream connection: either stream data or
+// the response to a SUBSCRIBE/UNSUBSCRIBE request
+type envelope struct {
+	Stream string          `json:"stream"`
+	Data   json.RawMessage `json:"data"`
+	ID     *int64          `json:"id"`
+	Error  *struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	} `json:"error"`
+}
+
+func (h *Hub) read(up *upstreamConn) {
+	for {
+		_, frame, err := up.conn.ReadMessage()
+		if err != nil {
+			h.upstreamClosed(up, err)
+			return
+		}
+
+		var env envelope
+		if err := json.Unmarshal(frame, &env); err != nil {
+			h.logger.Debug("unexpected upstream websocket frame",
+				logging.Field("api_type", h.apiType),
+				logging.Field("error", err.Error()))
+			continue
+		}
+
+		if env.Stream == "" {
+			if env.Error != nil {
+				h.logger.Error("upstream subscription request failed",
+					logging.Field("api_type", h.apiType),
+					logging.Field("code", env.Error.Code),
+					logging.Field("msg", env.Error.Msg))
+			}
+			continue
+		}
+
+		h.logger.LogWebSocketMessage("server->proxy", "", h.apiType, frame)
+		h.dispatch(up, Message{Stream: env.Stream, Data: env.Data})
+	}
+}
+
+func (h *Hub) dispatch(up *upstreamConn, msg Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.up != up {
+		// A connection being replaced; its successor delivers from now on
+		return
+	}
+	subs, ok := h.streams[msg.Stream]
+	if !ok {
+		// Unsubscribed while in flight
+		return
+	}
+	metrics.StreamMessage(h.apiType, msg.Stream, len(msg.Data))
+	h.deliver(subs, msg)
+}
+
+// deliver sends msg to subs. Called with h.mu held.
+func (h *Hub) deliver(subs map[*Subscriber]struct{}, msg Message) {
+	var slow []*Subscriber
+	for sub := range subs {
+		select {
+		case sub.ch <- msg:
+		default:
+			slow = append(slow, sub)
+		}
+	}
+
+	// Dropping messages would corrupt order books and sequences downstream,
+	// so a subscriber that cannot keep up is disconnected instead
+	for _, sub := range slow {
+		h.unsubscribeLocked(sub, h.streamsOf(sub))
+		sub.close("slow consumer")
+	}
+}
+
+func (h *Hub) upstreamClosed(up *upstreamConn, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.up != up {
+		// Closed deliberately, after the last subscriber left or once replaced
+		return
+	}
+	h.up = nil
+	up.close()
+
+	h.logger.Warn("upstream websocket disconnected, reconnecting",
+		logging.Field("api_type", h.apiType),
+		logging.Field("error", err.Error()))
+	h.traceEvent("upstream disconnected", attribute.String("error", err.Error()))
+
+	h.reconnecting = true
+	go h.reconnect(time.Now())
+}
+
+// reconnect dials until the connection is restored or no streams are left,
+// backing off exponentially with jitter between attempts
+func (h *Hub) reconnect(since time.Time) {
+	backoff := reconnectMinBackoff
+	for attempt := 1; ; attempt++ {
+		h.mu.Lock()
+		streams := h.streamList()
+		if len(streams) == 0 {
+			h.reconnecting = false
+			h.mu.Unlock()
+			return
+		}
+		h.mu.Unlock()
+
+		up, err := h.dial(streams)
+		if err == nil {
+			h.mu.Lock()
+			h.reconnecting = false
+			h.adopt(up, streams)
+			if h.notice {
+				h.notifyReconnected(since)
+			}
+			h.traceEvent("upstream reconnected",
+				attribute.Int("attempts", attempt),
+				attribute.Int64("downtime_ms", time.Since(since).Milliseconds()))
+			h.mu.Unlock()
+
+			h.logger.Info("upstream websocket reconnected",
+				logging.Field("api_type", h.apiType),
+				logging.Field("attempts", attempt),
+				logging.Field("downtime_ms", time.Since(since).Milliseconds()))
+			return
+		}
+
+		time.Sleep(backoff/2 + rand.N(backoff/2))
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+}
+
+// rotate replaces old before Binance's 24 hour disconnect. Should that fail,
+// the reconnect loop takes over when Binance closes the connection.
+func (h *Hub) rotate(old *upstreamConn) {
+	h.mu.Lock()
+	if h.up != old {
+		h.mu.Unlock()
+		return
+	}
+	streams := h.streamList()
+	h.mu.Unlock()
+
+	h.logger.Info("replacing upstream websocket before the 24h disconnect",
+		logging.Field("api_type", h.apiType),
+		logging.Field("streams", len(streams)))
+
+	up, err := h.dial(streams)
+	if err != nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.up != old {
+		up.close()
+		return
+	}
+	h.up = nil
+	old.close()
+	h.adopt(up, streams)
+	h.traceEvent("upstream replaced")
+}
+
+// traceEvent records an upstream connection event on the span of every
+// subscriber. Called with h.mu held.
+func (h *Hub) traceEvent(name string, attrs ...attribute.KeyValue) {
+	for sub := range h.subscribers {
+		if sub.span != nil {
+			sub.span.AddEvent(name, trace.WithAttributes(attrs...))
+		}
+	}
+}
+
+// notifyReconnected tells every subscriber that events may have been missed
+// since the connection dropped. Called with h.mu held.
+func (h *Hub) notifyReconnected(since time.Time) {
+	notice, _ := json.Marshal(map[string]any{
+		"e":              "proxyReconnected",
+		"E":              time.Now().UnixMilli(),
+		"disconnectedAt": since.UnixMilli(),
+	})
+	subs := make(map[*Subscriber]struct{}, len(h.subscribers))
+	for sub := range h.subscribers {
+		subs[sub] = struct{}{}
+	}
+	h.deliver(subs, Message{Data: notice})
+}
+
+// upstreamConn batches subscription changes into at most one control message
+// per interval, keeping the shared connection under Binance's inbound message
+// limit however many clients subscribe and unsubscribe
+type upstreamConn struct {
+	conn *websocket.Conn
+	done chan struct{}
+	once sync.Once
+
+	mu       sync.Mutex
+	rotation *time.Timer
+	pending  map[string]bool // stream -> subscribe (true) or unsubscribe (false)
+	nextID   int64
+}
+
+func newUpstreamConn(conn *websocket.Conn) *upstreamConn {
+	u := &upstreamConn{
+		conn:    conn,
+		done:    make(chan struct{}),
+		pending: make(map[string]bool),
+	}
+	go u.writeLoop()
+	return u
+}
+
+func (u *upstreamConn) subscribe(streams []string) {
+	u.queue(streams, true)
+}
+
+func (u *upstreamConn) unsubscribe(streams []string) {
+	u.queue(streams, false)
+}
+
+func (u *upstreamConn) queue(streams []string, subscribe bool) {
+	if len(streams) == 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, stream := range streams {
+		if pending, ok := u.pending[stream]; ok && pending != subscribe {
+			// Subscribed and unsubscribed again before anything was sent
+			delete(u.pending, stream)
+			continue
+		}
+		u.pending[stream] = subscribe
+	}
+}
+
+// next takes the pending changes of one kind, preferring subscriptions so
+// that new clients are served first
+func (u *upstreamConn) next() []byte {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if len(u.pending) == 0 {
+		return nil
+	}
+
+	var subs, unsubs []string
+	for stream, subscribe := range u.pending {
+		if subscribe {
+			subs = append(subs, stream)
+		} else {
+			unsubs = append(unsubs, stream)
+		}
+	}
+
+	method, streams := "SUBSCRIBE", subs
+	if len(subs) == 0 {
+		method, streams = "UNSUBSCRIBE", unsubs
+	}
+	for _, stream := range streams {
+		delete(u.pending, stream)
+	}
+
+	u.nextID++
+	msg, _ := json.Marshal(map[string]any{
+		"method": method,
+		"params": streams,
+		"id":     u.nextID,
+	})
+	return msg
+}
+
+func (u *upstreamConn) writeLoop() {
+	ticker := time.NewTicker(controlMessageInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-ticker.C:
+		}
+
+		msg := u.next()
+		if msg == nil {
+			continue
+		}
+		if err := u.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			u.close()
+			return
+		}
+	}
+}
+
+func (u *upstreamConn) close() {
+	u.once.Do(func() {
+		u.mu.Lock()
+		if u.rotation != nil {
+			u.rotation.Stop()
+		}
+		u.mu.Unlock()
+		close(u.done)
+		u.conn.Close()
+	})
+}
+
+// NormalizeStream lowercases the symbol part of a stream name, which Binance
+// requires, while leaving the rest (such as the "1M" kline interval) intact.
+// All-market "!" streams and listen keys are used as given.
+func NormalizeStream(stream string) string {
+	stream = strings.TrimSpace(stream)
+	if strings.HasPrefix(stream, "!") {
+		return stream
+	}
+	if at := strings.IndexByte(stream, '@'); at > 0 {
+		return strings.ToLower(stream[:at]) + stream[at:]
+	}
+	return stream
+}
+
+// normalizeStreams normalizes stream names, dropping empty and duplicate ones
+func normalizeStreams(streams []string) []string {
+	seen := make(map[string]bool, len(streams))
+	result := make([]string, 0, len(streams))
+	for _, stream := range streams {
+		stream = NormalizeStream(stream)
+		if stream == "" || seen[stream] {
+			continue
+		}
+		seen[stream] = true
+		result = append(result, stream)
+	}
+	return result
+}
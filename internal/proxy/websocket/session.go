@@ -0,0 +1,303 @@
+package websocket
+
+import (
+	"encoding/json"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/metrics"
+)
+
+const (
+	writeWait = 10 * time.Second
+
+	// Binance allows 5 incoming messages per second per connection. The
+	// proxy holds bots to the same limit but answers with an error instead
+	// of disconnecting them.
+	clientMessagesPerSecond = 5
+)
+
+// Error codes of Binance's live subscription protocol
+const (
+	errCodeUnknownProperty = 0
+	errCodeInvalidValue    = 1
+	errCodeInvalidRequest  = 2
+	errCodeInvalidJSON     = 3
+)
+
+// session serves hub messages to one client connection. Raw sessions
+// (/ws paths) receive the event payload only; combined sessions (/stream, or
+// after SET_PROPERTY combined) receive {"stream": ..., "data": ...} envelopes,
+// as Binance sends them.
+type session struct {
+	client   *websocket.Conn
+	hub      *Hub
+	sub      *Subscriber
+	combined atomic.Bool
+	limiter  *messageLimiter
+	replies  chan []byte
+	logger   *logging.RequestLogger
+	clientIP string
+	apiType  string
+	done     chan struct{}
+}
+
+func newSession(client *websocket.Conn, hub *Hub, combined bool, logger *logging.RequestLogger, clientIP, apiType string) *session {
+	s := &session{
+		client:   client,
+		hub:      hub,
+		sub:      NewSubscriber(),
+		limiter:  newMessageLimiter(clientMessagesPerSecond),
+		replies:  make(chan []byte, 16),
+		logger:   logger,
+		clientIP: clientIP,
+		apiType:  apiType,
+		done:     make(chan struct{}),
+	}
+	s.combined.Store(combined)
+	return s
+}
+
+// run serves the session until either side goes away
+func (s *session) run(streams []string) {
+	defer s.hub.Remove(s.sub)
+
+	if err := s.hub.Subscribe(s.sub, streams...); err != nil {
+		s.closeClient(websocket.CloseTryAgainLater, err.Error())
+		return
+	}
+
+	go s.readLoop()
+	s.writeLoop()
+}
+
+// readLoop handles client requests and ends the session when the client
+// disconnects
+func (s *session) readLoop() {
+	defer close(s.done)
+
+	for {
+		_, message, err := s.client.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				s.logger.Debug("WebSocket read completed",
+					logging.Field("direction", "client->proxy"),
+					logging.Field("client_ip", s.clientIP))
+			}
+			return
+		}
+
+		s.logger.LogWebSocketMessage("client->proxy", s.clientIP, s.apiType, message)
+		metrics.AddBytes(s.apiType, metrics.TransportWebSocket, metrics.DirectionIn, len(message))
+
+		reply := s.handleRequest(message)
+		select {
+		case s.replies <- reply:
+		case <-s.sub.Done():
+			return
+		}
+	}
+}
+
+func (s *session) writeLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+
+		case <-s.sub.Done():
+			if s.sub.span != nil {
+				s.sub.span.AddEvent("dropped", trace.WithAttributes(attribute.String("reason", s.sub.Reason())))
+			}
+			s.closeClient(websocket.CloseGoingAway, s.sub.Reason())
+			return
+
+		case reply := <-s.replies:
+			if err := s.writeFrame(reply); err != nil {
+				return
+			}
+
+		case msg := <-s.sub.Messages():
+			if err := s.write(msg); err != nil {
+				s.logger.Debug("WebSocket write completed",
+					logging.Field("direction", "proxy->client"),
+					logging.Field("client_ip", s.clientIP))
+				return
+			}
+		}
+	}
+}
+
+type controlRequest struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	ID     json.RawMessage   `json:"id"`
+}
+
+type controlResponse struct {
+	Result any             `json:"result"`
+	ID     json.RawMessage `json:"id"`
+}
+
+type controlError struct {
+	Error struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	} `json:"error"`
+	ID json.RawMessage `json:"id"`
+}
+
+// handleRequest answers a live subscription request from the client. The
+// proxy manages upstream subscriptions itself, so nothing the client sends is
+// forwarded to Binance.
+func (s *session) handleRequest(message []byte) []byte {
+	var req controlRequest
+	if err := json.Unmarshal(message, &req); err != nil {
+		return errorReply(nil, errCodeInvalidJSON, "Invalid JSON: "+err.Error())
+	}
+	if req.ID == nil {
+		req.ID = json.RawMessage("null")
+	}
+
+	if !s.limiter.allow() {
+		return errorReply(req.ID, errCodeInvalidRequest, "Too many requests; limit is 5 messages per second")
+	}
+
+	switch req.Method {
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		streams, ok := stringParams(req.Params)
+		if !ok {
+			return errorReply(req.ID, errCodeInvalidValue, "Invalid value type: expected array of stream names")
+		}
+		if req.Method == "UNSUBSCRIBE" {
+			s.hub.Unsubscribe(s.sub, streams...)
+		} else if err := s.hub.Subscribe(s.sub, streams...); err != nil {
+			return errorReply(req.ID, errCodeInvalidRequest, "Invalid request: "+err.Error())
+		}
+		return reply(req.ID, nil)
+
+	case "LIST_SUBSCRIPTIONS":
+		streams := s.hub.Streams(s.sub)
+		sort.Strings(streams)
+		return reply(req.ID, streams)
+
+	case "SET_PROPERTY":
+		var name string
+		var value bool
+		if len(req.Params) != 2 || json.Unmarshal(req.Params[0], &name) != nil {
+			return errorReply(req.ID, errCodeInvalidRequest, "Invalid request: expected [property, value]")
+		}
+		if name != "combined" {
+			return errorReply(req.ID, errCodeUnknownProperty, "Unknown property")
+		}
+		if json.Unmarshal(req.Params[1], &value) != nil {
+			return errorReply(req.ID, errCodeInvalidValue, "Invalid value type: expected Boolean")
+		}
+		s.combined.Store(value)
+		return reply(req.ID, nil)
+
+	case "GET_PROPERTY":
+		var name string
+		if len(req.Params) != 1 || json.Unmarshal(req.Params[0], &name) != nil {
+			return errorReply(req.ID, errCodeInvalidRequest, "Invalid request: expected [property]")
+		}
+		if name != "combined" {
+			return errorReply(req.ID, errCodeUnknownProperty, "Unknown property")
+		}
+		return reply(req.ID, s.combined.Load())
+
+	default:
+		return errorReply(req.ID, errCodeInvalidRequest, "Invalid request: unknown method '"+req.Method+"'")
+	}
+}
+
+func stringParams(params []json.RawMessage) ([]string, bool) {
+	result := make([]string, 0, len(params))
+	for _, p := range params {
+		var s string
+		if err := json.Unmarshal(p, &s); err != nil {
+			return nil, false
+		}
+		result = append(result, s)
+	}
+	return result, true
+}
+
+func reply(id json.RawMessage, result any) []byte {
+	msg, _ := json.Marshal(controlResponse{Result: result, ID: id})
+	return msg
+}
+
+func errorReply(id json.RawMessage, code int, msg string) []byte {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	var e controlError
+	e.Error.Code = code
+	e.Error.Msg = msg
+	e.ID = id
+	out, _ := json.Marshal(e)
+	return out
+}
+
+func (s *session) write(msg Message) error {
+	payload := []byte(msg.Data)
+	if s.combined.Load() && msg.Stream != "" {
+		payload, _ = json.Marshal(struct {
+			Stream string          `json:"stream"`
+			Data   json.RawMessage `json:"data"`
+		}{msg.Stream, msg.Data})
+	}
+	return s.writeFrame(payload)
+}
+
+func (s *session) writeFrame(payload []byte) error {
+	s.client.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := s.client.WriteMessage(websocket.TextMessage, payload); err != nil {
+		return err
+	}
+	metrics.AddBytes(s.apiType, metrics.TransportWebSocket, metrics.DirectionOut, len(payload))
+	return nil
+}
+
+func (s *session) closeClient(code int, reason string) {
+	s.client.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(writeWait))
+}
+
+// messageLimiter is a token bucket refilled at rate tokens per second
+type messageLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newMessageLimiter(rate int) *messageLimiter {
+	return &messageLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (l *messageLimiter) allow() bool {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
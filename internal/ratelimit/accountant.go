@@ -0,0 +1,272 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+)
+
+const (
+	usedWeightHeaderPrefix = "X-Mbx-Used-Weight-"
+	orderCountHeaderPrefix = "X-Mbx-Order-Count-"
+)
+
+// LimitError is returned when a request would exceed a budget and cannot be
+// queued within the configured wait time
+type LimitError struct {
+	Limit      string
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s budget exhausted, retry after %s", e.Limit, e.RetryAfter.Round(time.Second))
+}
+
+// Accountant tracks request weight for the proxy's egress IP and order counts
+// per API key, using Binance's usage headers as the source of truth.
+type Accountant struct {
+	mu          sync.Mutex
+	maxWait     time.Duration
+	weight      []*window
+	orderLimits map[time.Duration]int
+	orders      map[string][]*window
+	now         func() time.Time
+}
+
+func NewAccountant(cfg *config.RateLimitConfig) (*Accountant, error) {
+	weight, err := newWindows(cfg.RequestWeight)
+	if err != nil {
+		return nil, fmt.Errorf("invalid requestWeight limit: %w", err)
+	}
+
+	orderLimits := make(map[time.Duration]int, len(cfg.Orders))
+	for interval, limit := range cfg.Orders {
+		d, err := ParseInterval(interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid orders limit: %w", err)
+		}
+		orderLimits[d] = limit
+	}
+
+	return &Accountant{
+		maxWait:     cfg.MaxWait,
+		weight:      weight,
+		orderLimits: orderLimits,
+		orders:      make(map[string][]*window),
+		now:         time.Now,
+	}, nil
+}
+
+// Acquire reserves weight and order count for a request. If the budget is
+// exhausted it waits for the window to reset, up to the configured maximum,
+// and returns a *LimitError if that is not enough.
+func (a *Accountant) Acquire(ctx context.Context, weight, orders int, apiKey string) error {
+	deadline := a.now().Add(a.maxWait)
+
+	for {
+		a.mu.Lock()
+		now := a.now()
+		err := a.reserve(now, weight, orders, apiKey)
+		a.mu.Unlock()
+
+		if err == nil {
+			return nil
+		}
+		if now.Add(err.RetryAfter).After(deadline) {
+			return err
+		}
+
+		timer := time.NewTimer(err.RetryAfter)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Observe updates usage from the headers of a Binance response
+func (a *Accountant) Observe(header http.Header, apiKey string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	for key, values := range header {
+		if len(values) == 0 {
+			continue
+		}
+		used, err := strconv.Atoi(values[0])
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(key, usedWeightHeaderPrefix):
+			observe(a.weight, strings.TrimPrefix(key, usedWeightHeaderPrefix), used, now)
+		case strings.HasPrefix(key, orderCountHeaderPrefix) && apiKey != "":
+			observe(a.orderWindows(apiKey), strings.TrimPrefix(key, orderCountHeaderPrefix), used, now)
+		}
+	}
+}
+
+// Usage is the request weight used in one window
+type Usage struct {
+	Interval string
+	Used     int
+	Limit    int
+}
+
+// WeightUsage reports the request weight used in each current window
+func (a *Accountant) WeightUsage() []Usage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	usage := make([]Usage, 0, len(a.weight))
+	for _, w := range a.weight {
+		w.roll(now)
+		usage = append(usage, Usage{Interval: FormatInterval(w.interval), Used: w.used, Limit: w.limit})
+	}
+	return usage
+}
+
+func (a *Accountant) reserve(now time.Time, weight, orders int, apiKey string) *LimitError {
+	if err := check(a.weight, "request weight", weight, now); err != nil {
+		return err
+	}
+
+	var orderWindows []*window
+	if orders > 0 && apiKey != "" {
+		orderWindows = a.orderWindows(apiKey)
+		if err := check(orderWindows, "order count", orders, now); err != nil {
+			return err
+		}
+	}
+
+	for _, w := range a.weight {
+		w.used += weight
+	}
+	for _, w := range orderWindows {
+		w.used += orders
+	}
+	return nil
+}
+
+func (a *Accountant) orderWindows(apiKey string) []*window {
+	windows, ok := a.orders[apiKey]
+	if !ok {
+		for interval, limit := range a.orderLimits {
+			windows = append(windows, &window{interval: interval, limit: limit})
+		}
+		a.orders[apiKey] = windows
+	}
+	return windows
+}
+
+func check(windows []*window, name string, n int, now time.Time) *LimitError {
+	for _, w := range windows {
+		w.roll(now)
+		if w.used+n > w.limit {
+			return &LimitError{
+				Limit:      fmt.Sprintf("%s %s", name, FormatInterval(w.interval)),
+				RetryAfter: w.start.Add(w.interval).Sub(now),
+			}
+		}
+	}
+	return nil
+}
+
+func observe(windows []*window, suffix string, used int, now time.Time) {
+	interval, err := ParseInterval(suffix)
+	if err != nil {
+		return
+	}
+	for _, w := range windows {
+		if w.interval != interval {
+			continue
+		}
+		w.roll(now)
+		// Binance's count already includes requests we reserved, but may lag
+		// behind requests still in flight, so never lower the local figure
+		if used > w.used {
+			w.used = used
+		}
+	}
+}
+
+// window is a fixed rate limit window aligned to the interval boundary, as
+// Binance resets its counters on the minute, second or day
+type window struct {
+	interval time.Duration
+	limit    int
+	start    time.Time
+	used     int
+}
+
+func newWindows(limits map[string]int) ([]*window, error) {
+	windows := make([]*window, 0, len(limits))
+	for interval, limit := range limits {
+		d, err := ParseInterval(interval)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, &window{interval: d, limit: limit})
+	}
+	return windows, nil
+}
+
+func (w *window) roll(now time.Time) {
+	if start := now.Truncate(w.interval); start.After(w.start) {
+		w.start = start
+		w.used = 0
+	}
+}
+
+// ParseInterval parses Binance interval notation such as "10s", "1m" or "1d"
+func ParseInterval(s string) (time.Duration, error) {
+	s = strings.ToLower(s)
+	if len(s) < 2 {
+		return 0, fmt.Errorf("invalid interval %q", s)
+	}
+
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid interval %q", s)
+	}
+
+	var unit time.Duration
+	switch s[len(s)-1] {
+	case 's':
+		unit = time.Second
+	case 'm':
+		unit = time.Minute
+	case 'h':
+		unit = time.Hour
+	case 'd':
+		unit = 24 * time.Hour
+	default:
+		return 0, fmt.Errorf("invalid interval %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// FormatInterval is the inverse of ParseInterval
+func FormatInterval(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
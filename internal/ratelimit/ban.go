@@ -0,0 +1,175 @@
+package ratelimit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/pkg/binance"
+)
+
+// StatusIPBanned is the status Binance answers with once an IP keeps sending
+// requests after a 429
+const StatusIPBanned = http.StatusTeapot
+
+// Used when Binance omits Retry-After
+const (
+	defaultRateLimitBan = time.Minute
+	defaultIPBan        = 2 * time.Minute
+)
+
+// BanTracker remembers when an upstream has told the proxy to back off, so
+// that no client contacts Binance again until the window has passed.
+type BanTracker struct {
+	mu      sync.Mutex
+	apiType string
+	logger  *logging.RequestLogger
+	status  int
+	since   time.Time
+	until   time.Time
+	timer   *time.Timer
+}
+
+func NewBanTracker(apiType string, logger *logging.RequestLogger) *BanTracker {
+	return &BanTracker{
+		apiType: apiType,
+		logger:  logger,
+	}
+}
+
+// Active reports the status and remaining time of the current ban
+func (b *BanTracker) Active() (status int, remaining time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	remaining = time.Until(b.until)
+	if remaining <= 0 {
+		return 0, 0, false
+	}
+	return b.status, remaining, true
+}
+
+// Until returns the end of the current ban
+func (b *BanTracker) Until() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.until
+}
+
+// Observe inspects an upstream response and starts or extends a ban on 429
+// and 418 answers
+func (b *BanTracker) Observe(resp *http.Response) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != StatusIPBanned {
+		return
+	}
+
+	// Exceeding the order count is an account limit, not an IP one, so it
+	// must not lock every other bot out
+	if resp.StatusCode == http.StatusTooManyRequests && isOrderRateLimit(resp) {
+		return
+	}
+
+	duration := retryAfter(resp.Header)
+	if duration <= 0 {
+		duration = defaultRateLimitBan
+		if resp.StatusCode == StatusIPBanned {
+			duration = defaultIPBan
+		}
+	}
+
+	b.start(resp.StatusCode, time.Now().Add(duration))
+}
+
+func (b *BanTracker) start(status int, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	active := b.until.After(now)
+
+	if active && !until.After(b.until) && status <= b.status {
+		return
+	}
+
+	if !active {
+		b.since = now
+	}
+	if !active || status > b.status {
+		b.status = status
+	}
+	if until.After(b.until) {
+		b.until = until
+	}
+
+	b.logger.LogBanStart(b.apiType, b.status, b.until)
+
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.timer = time.AfterFunc(time.Until(b.until), b.end)
+}
+
+func (b *BanTracker) end() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if time.Now().Before(b.until) {
+		return
+	}
+	b.logger.LogBanEnd(b.apiType, b.status, time.Since(b.since))
+	b.status = 0
+	b.timer = nil
+}
+
+func retryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// isOrderRateLimit reports whether a 429 is Binance's -1015 order count
+// error. The body is left as it arrived, so a gzip encoded one that the
+// reverse proxy passes through is decompressed for the check only.
+func isOrderRateLimit(resp *http.Response) bool {
+	if resp.Body == nil {
+		return false
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return false
+		}
+		if body, err = io.ReadAll(zr); err != nil {
+			return false
+		}
+	}
+
+	var apiErr binance.APIError
+	if err := json.Unmarshal(body, &apiErr); err != nil {
+		return false
+	}
+	return apiErr.Code == binance.ErrCodeTooManyOrders
+}
@@ -0,0 +1,327 @@
+package redact
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+)
+
+// Actions a rule can take on a field
+const (
+	ActionDrop = "drop"
+	ActionMask = "mask"
+	ActionHash = "hash"
+)
+
+// Defaults cover the fields of Binance requests and responses that must not
+// end up in logs: signatures are dropped, listen keys and API keys masked,
+// and withdrawal addresses hashed so that they can still be correlated.
+var Defaults = []config.RedactionRuleConfig{
+	{Fields: []string{"signature", "secretKey"}, Action: ActionDrop},
+	{Fields: []string{"listenKey", "apiKey"}, Action: ActionMask},
+	{Fields: []string{"address", "addressTag"}, Action: ActionHash},
+}
+
+// Redactor rewrites sensitive fields in query strings, form bodies and JSON
+// documents, such as REST requests and responses and WebSocket messages.
+// Fields are matched by name, case-insensitively, at any depth.
+type Redactor struct {
+	actions map[string]string
+}
+
+// New builds a redactor from cfg. It returns nil when redaction is
+// disabled; a nil Redactor passes everything through unchanged.
+func New(cfg *config.RedactionConfig) (*Redactor, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	var rules []config.RedactionRuleConfig
+	if cfg.Defaults {
+		rules = append(rules, Defaults...)
+	}
+	rules = append(rules, cfg.Rules...)
+
+	r := &Redactor{actions: make(map[string]string)}
+	for i, rule := range rules {
+		switch rule.Action {
+		case ActionDrop, ActionMask, ActionHash:
+		default:
+			return nil, fmt.Errorf("redaction rule %d: unknown action %q", i, rule.Action)
+		}
+		// Later rules, including configured ones over the defaults, win
+		for _, field := range rule.Fields {
+			r.actions[strings.ToLower(field)] = rule.Action
+		}
+	}
+	return r, nil
+}
+
+// String redacts s as a JSON document if it looks like one, and otherwise as
+// a query string or form body. Anything else is returned unchanged.
+func (r *Redactor) String(s string) string {
+	if r == nil || s == "" {
+		return s
+	}
+	trimmed := strings.TrimSpace(s)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		return r.JSON(s)
+	}
+	if strings.Contains(s, "=") {
+		return r.Query(s)
+	}
+	return s
+}
+
+// Query redacts the parameters of a query string or form body, leaving the
+// others exactly as they were. Listen keys in a combined stream list, as in
+// streams=<listenKey>/btcusdt@trade, are redacted like Path does.
+func (r *Redactor) Query(s string) string {
+	if r == nil || s == "" || !r.mentions(s) && !r.mentionsListenKey(s) {
+		return s
+	}
+
+	parts := strings.Split(s, "&")
+	kept := parts[:0]
+	changed := false
+	for _, part := range parts {
+		name, value, _ := strings.Cut(part, "=")
+		if key, err := url.QueryUnescape(name); err == nil {
+			name = key
+		}
+
+		if name == "streams" {
+			if streams := r.streams(value); streams != value {
+				part = name + "=" + streams
+				changed = true
+			}
+		}
+
+		action, ok := r.actions[strings.ToLower(name)]
+		if !ok {
+			kept = append(kept, part)
+			continue
+		}
+		changed = true
+		switch action {
+		case ActionMask:
+			kept = append(kept, name+"="+Mask(value))
+		case ActionHash:
+			if v, err := url.QueryUnescape(value); err == nil {
+				value = v
+			}
+			kept = append(kept, name+"="+Hash(value))
+		}
+	}
+	if !changed {
+		return s
+	}
+	return strings.Join(kept, "&")
+}
+
+// JSON redacts the fields of a JSON document. Documents without sensitive
+// fields, and invalid JSON, are returned unchanged; otherwise the document is
+// re-encoded with its object keys sorted.
+func (r *Redactor) JSON(s string) string {
+	if r == nil || s == "" || !r.mentions(s) && !r.mentionsListenKey(s) {
+		return s
+	}
+
+	var doc any
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return s
+	}
+	if !r.walk(doc) {
+		return s
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return s
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// Path redacts listen keys used as stream names in a WebSocket path, such as
+// /ws/<listenKey>, with the action of the listenKey field. Dropped keys
+// leave **** in their place.
+func (r *Redactor) Path(p string) string {
+	if r == nil {
+		return p
+	}
+	action, ok := r.actions["listenkey"]
+	if !ok {
+		return p
+	}
+
+	segments := strings.Split(p, "/")
+	changed := false
+	for i, segment := range segments {
+		if !isListenKey(segment) {
+			continue
+		}
+		changed = true
+		segments[i] = redactListenKey(segment, action)
+	}
+	if !changed {
+		return p
+	}
+	return strings.Join(segments, "/")
+}
+
+// URL redacts a URL for logs: listen keys in its path and in a combined
+// stream list, and sensitive query parameters
+func (r *Redactor) URL(u *url.URL) string {
+	if r == nil {
+		return u.String()
+	}
+	c := *u
+	// Setting RawPath keeps a masked key's asterisks from being escaped
+	c.Path = r.Path(c.Path)
+	c.RawPath = c.Path
+	c.RawQuery = r.Query(c.RawQuery)
+	return c.String()
+}
+
+// streams redacts the listen keys in the value of a streams parameter
+func (r *Redactor) streams(value string) string {
+	if v, err := url.QueryUnescape(value); err == nil && v != value {
+		if redacted := r.Path(v); redacted != v {
+			return url.QueryEscape(redacted)
+		}
+		return value
+	}
+	return r.Path(value)
+}
+
+func redactListenKey(key, action string) string {
+	switch action {
+	case ActionMask:
+		return Mask(key)
+	case ActionHash:
+		return Hash(key)
+	default:
+		// Dropped keys leave a placeholder so the position stays visible
+		return "****"
+	}
+}
+
+// isListenKey reports whether a stream name is a listen key: long and
+// alphanumeric, where market stream names always contain '@'
+func isListenKey(s string) bool {
+	if len(s) < 32 {
+		return false
+	}
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// mentionsListenKey reports whether s may hold a listen key outside a
+// listenKey field, such as a stream name in SUBSCRIBE params
+func (r *Redactor) mentionsListenKey(s string) bool {
+	if _, ok := r.actions["listenkey"]; !ok {
+		return false
+	}
+	run := 0
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			run = 0
+			continue
+		}
+		if run++; run >= 32 {
+			return true
+		}
+	}
+	return false
+}
+
+// mentions reports whether s contains the name of any redacted field, which
+// spares decoding large documents that hold none
+func (r *Redactor) mentions(s string) bool {
+	lower := strings.ToLower(s)
+	for field := range r.actions {
+		if strings.Contains(lower, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// walk redacts v in place and reports whether anything changed
+func (r *Redactor) walk(v any) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			action, ok := r.actions[strings.ToLower(key)]
+			if !ok {
+				changed = r.walk(value) || changed
+				continue
+			}
+			changed = true
+			switch action {
+			case ActionDrop:
+				delete(v, key)
+			case ActionMask:
+				v[key] = Mask(scalar(value))
+			case ActionHash:
+				v[key] = Hash(scalar(value))
+			}
+		}
+	case []any:
+		for i, value := range v {
+			// Listen keys also appear as stream names, as in SUBSCRIBE params
+			if s, ok := value.(string); ok && isListenKey(s) {
+				if action, ok := r.actions["listenkey"]; ok {
+					v[i] = redactListenKey(s, action)
+					changed = true
+				}
+				continue
+			}
+			changed = r.walk(value) || changed
+		}
+	}
+	return changed
+}
+
+// scalar renders a JSON value as the text a mask or hash is taken of
+func scalar(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// Mask keeps the first and last four characters of long values
+func Mask(s string) string {
+	if len(s) <= 8 {
+		return "****"
+	}
+	return s[:4] + "****" + s[len(s)-4:]
+}
+
+// Hash replaces a value with a short SHA-256 digest, which still shows
+// whether two values are the same
+func Hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,400 @@
+package risk
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/pkg/binance"
+)
+
+type requestKind int
+
+const (
+	kindOrder requestKind = iota + 1
+	kindBatch
+	kindOrderList
+	kindLeverage
+)
+
+// checkedEndpoints are the requests that can open or change exposure
+var checkedEndpoints = map[string]requestKind{
+	"POST /api/v3/order":               kindOrder,
+	"POST /api/v3/order/test":          kindOrder,
+	"POST /api/v3/order/cancelReplace": kindOrder,
+	"POST /api/v3/order/oco":           kindOrderList,
+	"POST /api/v3/orderList/oco":       kindOrderList,
+	"POST /api/v3/orderList/oto":       kindOrderList,
+	"POST /api/v3/orderList/otoco":     kindOrderList,
+	"POST /api/v3/sor/order":           kindOrder,
+	"POST /fapi/v1/order":              kindOrder,
+	"PUT /fapi/v1/order":               kindOrder,
+	"POST /fapi/v1/batchOrders":        kindBatch,
+	"PUT /fapi/v1/batchOrders":         kindBatch,
+	"POST /fapi/v1/leverage":           kindLeverage,
+	"POST /dapi/v1/order":              kindOrder,
+	"PUT /dapi/v1/order":               kindOrder,
+	"POST /dapi/v1/batchOrders":        kindBatch,
+	"PUT /dapi/v1/batchOrders":         kindBatch,
+	"POST /dapi/v1/leverage":           kindLeverage,
+	"POST /eapi/v1/order":              kindOrder,
+	"POST /eapi/v1/batchOrders":        kindBatch,
+	"POST /papi/v1/um/order":           kindOrder,
+	"PUT /papi/v1/um/order":            kindOrder,
+	"POST /papi/v1/cm/order":           kindOrder,
+	"PUT /papi/v1/cm/order":            kindOrder,
+	"POST /papi/v1/margin/order":       kindOrder,
+	"POST /papi/v1/um/leverage":        kindLeverage,
+	"POST /papi/v1/cm/leverage":        kindLeverage,
+}
+
+// leg names the parameters one order of an order list is placed with.
+// Legs without a type parameter have a fixed type.
+type leg struct {
+	typeParam string
+	orderType string
+	quantity  string
+	price     string
+	stopPrice string
+}
+
+// orderLists are the legs of the order list endpoints
+var orderLists = map[string][]leg{
+	"POST /api/v3/order/oco": {
+		{orderType: "LIMIT_MAKER", quantity: "quantity", price: "price"},
+		{orderType: "STOP_LOSS_LIMIT", quantity: "quantity", price: "stopLimitPrice", stopPrice: "stopPrice"},
+	},
+	"POST /api/v3/orderList/oco": {
+		{typeParam: "aboveType", quantity: "quantity", price: "abovePrice", stopPrice: "aboveStopPrice"},
+		{typeParam: "belowType", quantity: "quantity", price: "belowPrice", stopPrice: "belowStopPrice"},
+	},
+	"POST /api/v3/orderList/oto": {
+		{typeParam: "workingType", quantity: "workingQuantity", price: "workingPrice"},
+		{typeParam: "pendingType", quantity: "pendingQuantity", price: "pendingPrice", stopPrice: "pendingStopPrice"},
+	},
+	"POST /api/v3/orderList/otoco": {
+		{typeParam: "workingType", quantity: "workingQuantity", price: "workingPrice"},
+		{typeParam: "pendingAboveType", quantity: "pendingQuantity", price: "pendingAbovePrice", stopPrice: "pendingAboveStopPrice"},
+		{typeParam: "pendingBelowType", quantity: "pendingQuantity", price: "pendingBelowPrice", stopPrice: "pendingBelowStopPrice"},
+	},
+}
+
+// Checks reports whether method and path are subject to risk checks
+func Checks(method, path string) bool {
+	_, ok := kindOf(method, path)
+	return ok
+}
+
+// kindOf returns how a request is checked. Order endpoints of configured
+// families are checked as single orders.
+func kindOf(method, path string) (requestKind, bool) {
+	if kind, ok := checkedEndpoints[method+" "+path]; ok {
+		return kind, true
+	}
+	if binance.OrderCount(method, path) > 0 {
+		return kindOrder, true
+	}
+	return 0, false
+}
+
+// Order is the subset of order parameters the risk checks look at
+type Order struct {
+	Symbol    string
+	Type      string
+	Quantity  float64
+	Price     float64
+	StopPrice float64
+	QuoteQty  float64
+	// ContractSize is the quote asset value of one contract for orders
+	// whose quantity counts contracts, as on COIN-M, and 0 otherwise
+	ContractSize float64
+	// Reduces is set for orders that can only close a position
+	Reduces bool
+}
+
+// Notional returns the order value in the quote asset, if it can be known
+// from the order alone. Stop market orders are valued at their stop price,
+// and orders sized in contracts at their contract size whatever the price.
+func (o *Order) Notional() (float64, bool) {
+	if o.ContractSize > 0 {
+		return o.Quantity * o.ContractSize, o.Quantity > 0
+	}
+	if o.Quantity > 0 && o.Price > 0 {
+		return o.Quantity * o.Price, true
+	}
+	if o.QuoteQty > 0 {
+		return o.QuoteQty, true
+	}
+	if o.Quantity > 0 && o.StopPrice > 0 {
+		return o.Quantity * o.StopPrice, true
+	}
+	return 0, false
+}
+
+type limits struct {
+	symbols     map[string]bool
+	orderTypes  map[string]bool
+	maxNotional float64
+	maxQuantity map[string]float64
+	maxLeverage int
+}
+
+// Prices supplies the mark price of a symbol, if a fresh one is known
+type Prices interface {
+	MarkPrice(symbol string) (float64, bool)
+}
+
+// Checker validates orders against configured limits before they reach Binance
+type Checker struct {
+	defaults limits
+	bots     map[string]limits
+
+	mu     sync.RWMutex
+	prices map[string]Prices
+}
+
+func New(cfg *config.RiskConfig) (*Checker, error) {
+	c := &Checker{
+		defaults: newLimits(&cfg.Limits),
+		bots:     make(map[string]limits, len(cfg.Bots)),
+		prices:   make(map[string]Prices),
+	}
+	for _, b := range cfg.Bots {
+		if b.Bot == "" {
+			return nil, fmt.Errorf("risk limits entry without a bot name")
+		}
+		c.bots[b.Bot] = newLimits(&b.Limits)
+	}
+	return c, nil
+}
+
+func newLimits(cfg *config.RiskLimitsConfig) limits {
+	l := limits{
+		maxNotional: cfg.MaxNotional,
+		maxLeverage: cfg.MaxLeverage,
+	}
+	if len(cfg.Symbols) > 0 {
+		l.symbols = upperSet(cfg.Symbols)
+	}
+	if len(cfg.OrderTypes) > 0 {
+		l.orderTypes = upperSet(cfg.OrderTypes)
+	}
+	if len(cfg.MaxQuantity) > 0 {
+		// Config map keys arrive lowercased
+		l.maxQuantity = make(map[string]float64, len(cfg.MaxQuantity))
+		for symbol, qty := range cfg.MaxQuantity {
+			l.maxQuantity[strings.ToUpper(symbol)] = qty
+		}
+	}
+	return l
+}
+
+func upperSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[strings.ToUpper(v)] = true
+	}
+	return set
+}
+
+// AddPrices values the orders of apiType that carry no price, such as
+// market orders given only a quantity, at the mark prices of prices
+func (c *Checker) AddPrices(apiType string, prices Prices) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.prices[apiType] = prices
+}
+
+// Check validates the parameters of a request from bot to apiType. It
+// returns nil when the request passes or is not subject to risk checks, and
+// otherwise the error Binance would return for a comparable rejection.
+func (c *Checker) Check(bot, apiType, method, path string, params url.Values) *binance.APIError {
+	kind, ok := kindOf(method, path)
+	if !ok {
+		return nil
+	}
+
+	l, ok := c.bots[bot]
+	if !ok {
+		l = c.defaults
+	}
+
+	c.mu.RLock()
+	prices := c.prices[apiType]
+	c.mu.RUnlock()
+
+	switch kind {
+	case kindOrder:
+		order, err := parseOrder(path, params.Get)
+		if err != nil {
+			return err
+		}
+		return l.checkOrder(order, prices)
+
+	case kindBatch:
+		name := "batchOrders"
+		if strings.HasPrefix(path, "/eapi/") {
+			name = "orders"
+		}
+		var batch []map[string]any
+		if err := json.Unmarshal([]byte(params.Get(name)), &batch); err != nil {
+			return &binance.APIError{Code: binance.ErrCodeMandatoryParam, Msg: "Parameter '" + name + "' is not valid JSON."}
+		}
+		for _, entry := range batch {
+			order, err := parseOrder(path, func(key string) string {
+				if v, ok := entry[key]; ok && v != nil {
+					return fmt.Sprint(v)
+				}
+				return ""
+			})
+			if err != nil {
+				return err
+			}
+			if err := l.checkOrder(order, prices); err != nil {
+				return err
+			}
+		}
+
+	case kindOrderList:
+		for _, lg := range orderLists[method+" "+path] {
+			order, err := parseOrder(path, lg.params(params))
+			if err != nil {
+				return err
+			}
+			if err := l.checkOrder(order, prices); err != nil {
+				return err
+			}
+		}
+
+	case kindLeverage:
+		if l.maxLeverage <= 0 {
+			return nil
+		}
+		leverage, err := strconv.Atoi(params.Get("leverage"))
+		if err != nil {
+			return &binance.APIError{Code: binance.ErrCodeMandatoryParam, Msg: "Parameter 'leverage' is not valid."}
+		}
+		if leverage > l.maxLeverage {
+			return &binance.APIError{
+				Code: binance.ErrCodeInvalidLeverage,
+				Msg:  fmt.Sprintf("Leverage %d is not valid; proxy limit is %d.", leverage, l.maxLeverage),
+			}
+		}
+	}
+
+	return nil
+}
+
+func (l *limits) checkOrder(o *Order, prices Prices) *binance.APIError {
+	if l.symbols != nil && !l.symbols[o.Symbol] {
+		return &binance.APIError{Code: binance.ErrCodeBadSymbol, Msg: "Invalid symbol; " + o.Symbol + " is not allowed by the proxy."}
+	}
+
+	if l.orderTypes != nil && o.Type != "" && !l.orderTypes[o.Type] {
+		return &binance.APIError{Code: binance.ErrCodeInvalidOrderType, Msg: "Invalid orderType; " + o.Type + " is not allowed by the proxy."}
+	}
+
+	if max, ok := l.maxQuantity[o.Symbol]; ok && o.Quantity > max {
+		return &binance.APIError{
+			Code: binance.ErrCodeFilterFailure,
+			Msg:  fmt.Sprintf("Filter failure: PROXY_MAX_QUANTITY (%s > %s).", formatFloat(o.Quantity), formatFloat(max)),
+		}
+	}
+
+	if l.maxNotional > 0 {
+		notional, ok := o.Notional()
+		if !ok && prices != nil && o.Quantity > 0 {
+			var mark float64
+			if mark, ok = prices.MarkPrice(o.Symbol); ok {
+				notional = o.Quantity * mark
+			}
+		}
+		if !ok && !o.Reduces {
+			// Without a price the limit cannot be enforced, so the order is
+			// refused rather than let through unchecked
+			return &binance.APIError{
+				Code: binance.ErrCodeFilterFailure,
+				Msg:  "Filter failure: PROXY_MAX_NOTIONAL (order value unknown and no recent mark price; send price or quoteOrderQty).",
+			}
+		}
+		if notional > l.maxNotional {
+			return &binance.APIError{
+				Code: binance.ErrCodeFilterFailure,
+				Msg:  fmt.Sprintf("Filter failure: PROXY_MAX_NOTIONAL (%s > %s).", formatFloat(notional), formatFloat(l.maxNotional)),
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseOrder(path string, get func(string) string) (*Order, *binance.APIError) {
+	o := &Order{
+		Symbol:  strings.ToUpper(get("symbol")),
+		Type:    strings.ToUpper(get("type")),
+		Reduces: strings.EqualFold(get("reduceOnly"), "true") || strings.EqualFold(get("closePosition"), "true"),
+	}
+	if o.Symbol == "" {
+		return nil, &binance.APIError{Code: binance.ErrCodeMandatoryParam, Msg: "Mandatory parameter 'symbol' was not sent, was empty/null, or malformed."}
+	}
+
+	for name, dst := range map[string]*float64{
+		"quantity":      &o.Quantity,
+		"price":         &o.Price,
+		"stopPrice":     &o.StopPrice,
+		"quoteOrderQty": &o.QuoteQty,
+	} {
+		value := get(name)
+		if value == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, &binance.APIError{Code: binance.ErrCodeMandatoryParam, Msg: fmt.Sprintf("Parameter '%s' is malformed.", name)}
+		}
+		*dst = f
+	}
+	o.ContractSize = binance.ContractSize(path, o.Symbol)
+
+	return o, nil
+}
+
+// params reads the leg's parameters of an order list under the names of a
+// single order
+func (lg leg) params(params url.Values) func(string) string {
+	return func(key string) string {
+		switch key {
+		case "type":
+			if lg.typeParam != "" {
+				return params.Get(lg.typeParam)
+			}
+			// The stop leg of an OCO only has a limit price as a stop limit
+			if lg.orderType == "STOP_LOSS_LIMIT" && params.Get(lg.price) == "" {
+				return "STOP_LOSS"
+			}
+			return lg.orderType
+		case "quantity":
+			return params.Get(lg.quantity)
+		case "price":
+			return params.Get(lg.price)
+		case "stopPrice":
+			if lg.stopPrice == "" {
+				return ""
+			}
+			return params.Get(lg.stopPrice)
+		case "quoteOrderQty":
+			return ""
+		default:
+			return params.Get(key)
+		}
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net/http"
 	"os"
@@ -19,17 +21,36 @@ type Server struct {
 	cfg        *config.ServerConfig
 }
 
-func New(handler http.Handler, cfg *config.ServerConfig, logger *zap.Logger) *Server {
-	return &Server{
-		httpServer: &http.Server{
-			Addr:         cfg.Address(),
-			Handler:      handler,
-			ReadTimeout:  cfg.ReadTimeout,
-			WriteTimeout: cfg.WriteTimeout,
-		},
-		logger: logger,
-		cfg:    cfg,
+func New(handler http.Handler, cfg *config.ServerConfig, logger *zap.Logger) (*Server, error) {
+	httpServer := &http.Server{
+		Addr:         cfg.Address(),
+		Handler:      handler,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+	}
+
+	if cfg.TLS.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLS.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.TLS.ClientCAFile)
+		}
+
+		// Clients without a certificate may still authenticate by other means
+		httpServer.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		}
 	}
+
+	return &Server{
+		httpServer: httpServer,
+		logger:     logger,
+		cfg:        cfg,
+	}, nil
 }
 
 func (s *Server) Start() error {
@@ -45,9 +66,16 @@ func (s *Server) Start() error {
 		s.logger.Info("Starting server",
 			zap.String("address", s.httpServer.Addr),
 			zap.String("host", s.cfg.Host),
-			zap.Int("port", s.cfg.Port))
+			zap.Int("port", s.cfg.Port),
+			zap.Bool("tls", s.cfg.TLS.Enabled()))
 
-		if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if s.cfg.TLS.Enabled() {
+			err = s.httpServer.ListenAndServeTLS(s.cfg.TLS.CertFile, s.cfg.TLS.KeyFile)
+		} else {
+			err = s.httpServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			errCh <- fmt.Errorf("server failed: %w", err)
 		}
 	}()
@@ -0,0 +1,139 @@
+package userdata
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/xgaicc/binance-proxy/internal/auth"
+	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/metrics"
+	"github.com/xgaicc/binance-proxy/internal/tracing"
+	"github.com/xgaicc/binance-proxy/pkg/binance"
+)
+
+const writeWait = 10 * time.Second
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// Handler serves user data streams to bots. The Binance API key, or the
+// proxy credential standing in for it, is taken from X-MBX-APIKEY.
+type Handler struct {
+	managers map[string]*Manager
+	logger   *logging.RequestLogger
+}
+
+func NewHandler(managers []*Manager, logger *logging.RequestLogger) *Handler {
+	h := &Handler{
+		managers: make(map[string]*Manager, len(managers)),
+		logger:   logger,
+	}
+	for _, m := range managers {
+		h.managers[m.apiType] = m
+	}
+	return h
+}
+
+func (h *Handler) Stream(w http.ResponseWriter, r *http.Request) {
+	apiType := mux.Vars(r)["apiType"]
+	m, ok := h.managers[apiType]
+	if !ok {
+		writeError(w, http.StatusNotFound, binance.ErrCodeUnknown, "Unknown API type.")
+		return
+	}
+
+	credential := r.Header.Get(binance.APIKeyHeader)
+	if credential == "" {
+		writeError(w, http.StatusUnauthorized, binance.ErrCodeRejectedAPIKey, "API-key header "+binance.APIKeyHeader+" is required.")
+		return
+	}
+
+	bot := auth.Bot(r)
+	ctx, span := tracing.StartServer(r.Context(), "websocket userdata",
+		attribute.String("api_type", apiType),
+		attribute.String("bot", bot))
+	defer span.End()
+
+	// Join before upgrading so a rejected API key gets Binance's error response
+	client, err := m.Join(ctx, credential)
+	if err != nil {
+		tracing.Fail(span, err)
+		var apiErr *binance.APIError
+		if errors.As(err, &apiErr) {
+			writeError(w, http.StatusBadRequest, apiErr.Code, apiErr.Msg)
+			return
+		}
+		writeError(w, http.StatusBadGateway, binance.ErrCodeDisconnected, "Could not start user data stream.")
+		return
+	}
+	defer m.Leave(client)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		h.logger.Error("failed to upgrade client connection", logging.Field("error", err.Error()))
+		return
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	clientIP := r.RemoteAddr
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		clientIP = strings.Split(forwarded, ",")[0]
+	}
+	h.logger.LogWebSocketConnect(clientIP, r.URL.Path, apiType, bot)
+	defer func() {
+		h.logger.LogWebSocketDisconnect(clientIP, r.URL.Path, apiType, bot, time.Since(start))
+	}()
+	defer metrics.ConnectionOpened(apiType, metrics.ConnUserData)()
+
+	// Clients only listen; reading detects the disconnect
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+
+		case <-client.Done():
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "slow consumer"),
+				time.Now().Add(writeWait))
+			return
+
+		case msg := <-client.Messages():
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+			metrics.AddBytes(apiType, metrics.TransportWebSocket, metrics.DirectionOut, len(msg))
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status, code int, msg string) {
+	writeJSON(w, status, binance.APIError{Code: code, Msg: msg})
+}
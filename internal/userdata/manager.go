@@ -0,0 +1,120 @@
+package userdata
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/xgaicc/binance-proxy/internal/config"
+	"github.com/xgaicc/binance-proxy/internal/keystore"
+	"github.com/xgaicc/binance-proxy/internal/logging"
+)
+
+const clientBuffer = 256
+
+// ListenKeys manages user data stream listen keys through the REST API
+type ListenKeys interface {
+	CreateListenKey(ctx context.Context, apiType, credential string) (string, error)
+	KeepAliveListenKey(ctx context.Context, apiType, credential, listenKey string) error
+	CloseListenKey(ctx context.Context, apiType, credential, listenKey string) error
+}
+
+// Manager owns the user data streams of one API type: one listen key and one
+// upstream connection per Binance API key, shared by every bot using it
+type Manager struct {
+	apiType    string
+	wsURL      string
+	maxAge     time.Duration
+	notice     bool
+	listenKeys ListenKeys
+	keys       *keystore.Keystore
+	logger     *logging.RequestLogger
+
+	mu      sync.Mutex
+	streams map[string]*stream
+}
+
+func NewManager(apiType, wsURL string, cfg *config.WebSocketConfig, listenKeys ListenKeys, keys *keystore.Keystore, logger *logging.RequestLogger) *Manager {
+	return &Manager{
+		apiType:    apiType,
+		wsURL:      wsURL,
+		maxAge:     cfg.MaxConnectionAge,
+		notice:     cfg.ReconnectNotice,
+		listenKeys: listenKeys,
+		keys:       keys,
+		logger:     logger,
+		streams:    make(map[string]*stream),
+	}
+}
+
+// Join adds a client to the user data stream of the API key behind
+// credential, starting the stream if it is the first client. Upstream
+// reconnects are recorded on the span in ctx.
+func (m *Manager) Join(ctx context.Context, credential string) (*Client, error) {
+	apiKey := credential
+	if key, ok := m.keys.Lookup(credential); ok {
+		apiKey = key.APIKey
+	}
+
+	c := &Client{
+		ch:     make(chan []byte, clientBuffer),
+		done:   make(chan struct{}),
+		apiKey: apiKey,
+		span:   trace.SpanFromContext(ctx),
+	}
+
+	m.mu.Lock()
+	s, ok := m.streams[apiKey]
+	if !ok {
+		s = newStream(m, credential, apiKey)
+		m.streams[apiKey] = s
+		go s.start()
+	}
+	s.add(c)
+	m.mu.Unlock()
+
+	<-s.ready
+	if s.err != nil {
+		m.Leave(c)
+		return nil, s.err
+	}
+	return c, nil
+}
+
+// Leave removes a client, stopping its stream when no clients are left
+func (m *Manager) Leave(c *Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c.close()
+	s, ok := m.streams[c.apiKey]
+	if !ok || !s.remove(c) {
+		return
+	}
+	delete(m.streams, c.apiKey)
+	go s.stop()
+}
+
+// Client receives the events of one user data stream
+type Client struct {
+	ch     chan []byte
+	done   chan struct{}
+	once   sync.Once
+	apiKey string
+	span   trace.Span
+}
+
+func (c *Client) Messages() <-chan []byte {
+	return c.ch
+}
+
+// Done is closed when the client falls behind or is removed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) close() {
+	c.once.Do(func() { close(c.done) })
+}
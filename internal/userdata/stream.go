@@ -0,0 +1,373 @@
+package userdata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/xgaicc/binance-proxy/internal/logging"
+	"github.com/xgaicc/binance-proxy/internal/metrics"
+	"github.com/xgaicc/binance-proxy/pkg/binance"
+)
+
+const (
+	// Listen keys expire after 60 minutes without a keepalive
+	keepAliveInterval = 30 * time.Minute
+	requestTimeout    = 10 * time.Second
+
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = time.Minute
+)
+
+// stream is the upstream user data connection of one Binance API key
+type stream struct {
+	m          *Manager
+	credential string
+	apiKey     string
+
+	// ready is closed once the first connection attempt has finished, with
+	// err set if it failed
+	ready chan struct{}
+	err   error
+	done  chan struct{}
+
+	mu        sync.Mutex
+	clients   map[*Client]struct{}
+	listenKey string
+	conn      *websocket.Conn
+	rotation  *time.Timer
+	stopped   bool
+}
+
+func newStream(m *Manager, credential, apiKey string) *stream {
+	return &stream{
+		m:          m,
+		credential: credential,
+		apiKey:     apiKey,
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+		clients:    make(map[*Client]struct{}),
+	}
+}
+
+func (s *stream) add(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clients[c] = struct{}{}
+}
+
+// remove drops c and reports whether the stream has no clients left
+func (s *stream) remove(c *Client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.clients, c)
+	return len(s.clients) == 0
+}
+
+func (s *stream) start() {
+	defer close(s.ready)
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	listenKey, conn, err := s.connect(ctx)
+	if err != nil {
+		s.err = err
+		return
+	}
+
+	s.mu.Lock()
+	s.listenKey = listenKey
+	s.adoptLocked(conn)
+	s.mu.Unlock()
+
+	s.m.logger.Info("user data stream started",
+		logging.Field("api_type", s.m.apiType),
+		logging.Field("api_key", logging.MaskAPIKey(s.apiKey)))
+
+	go s.keepAlive()
+}
+
+// stop closes the connection and the listen key after the last client left
+func (s *stream) stop() {
+	<-s.ready
+
+	s.mu.Lock()
+	s.stopped = true
+	conn, listenKey := s.conn, s.listenKey
+	if s.rotation != nil {
+		s.rotation.Stop()
+	}
+	s.mu.Unlock()
+
+	close(s.done)
+	if conn == nil {
+		return
+	}
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if err := s.m.listenKeys.CloseListenKey(ctx, s.m.apiType, s.credential, listenKey); err != nil {
+		s.m.logger.Warn("failed to close listen key",
+			logging.Field("api_type", s.m.apiType),
+			logging.Field("error", err.Error()))
+	}
+
+	s.m.logger.Info("user data stream stopped",
+		logging.Field("api_type", s.m.apiType),
+		logging.Field("api_key", logging.MaskAPIKey(s.apiKey)))
+}
+
+// connect obtains a listen key and opens its stream
+func (s *stream) connect(ctx context.Context) (string, *websocket.Conn, error) {
+	listenKey, err := s.m.listenKeys.CreateListenKey(ctx, s.m.apiType, s.credential)
+	if err != nil {
+		return "", nil, err
+	}
+	conn, err := s.dial(ctx, listenKey)
+	if err != nil {
+		return "", nil, err
+	}
+	return listenKey, conn, nil
+}
+
+func (s *stream) dial(ctx context.Context, listenKey string) (*websocket.Conn, error) {
+	target, err := url.Parse(s.m.wsURL)
+	if err != nil {
+		return nil, err
+	}
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/ws/" + listenKey
+
+	dialer := websocket.Dialer{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+	}
+
+	headers := http.Header{}
+	headers.Set("Origin", "https://"+target.Host)
+
+	conn, _, err := dialer.DialContext(ctx, target.String(), headers)
+	if err != nil {
+		if ctx.Err() == nil {
+			metrics.DialFailed(s.m.apiType, metrics.TransportWebSocket)
+		}
+		s.m.logger.Error("failed to connect to Binance user data stream",
+			logging.Field("api_type", s.m.apiType),
+			logging.Field("error", err.Error()))
+		return nil, err
+	}
+	return conn, nil
+}
+
+// adoptLocked makes conn the current connection, replacing it before
+// Binance's 24 hour disconnect. Called with s.mu held.
+func (s *stream) adoptLocked(conn *websocket.Conn) {
+	s.conn = conn
+	go s.read(conn)
+
+	if s.m.maxAge > 0 {
+		if s.rotation != nil {
+			s.rotation.Stop()
+		}
+		s.rotation = time.AfterFunc(s.m.maxAge, func() { s.rotate(conn) })
+	}
+}
+
+func (s *stream) read(conn *websocket.Conn) {
+	for {
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			s.disconnected(conn, err)
+			return
+		}
+
+		var event struct {
+			Event string `json:"e"`
+		}
+		json.Unmarshal(frame, &event)
+
+		if event.Event == "listenKeyExpired" {
+			// Reconnecting creates a new listen key
+			s.m.logger.Warn("listen key expired",
+				logging.Field("api_type", s.m.apiType),
+				logging.Field("api_key", logging.MaskAPIKey(s.apiKey)))
+			conn.Close()
+			continue
+		}
+
+		s.broadcast(conn, frame)
+	}
+}
+
+// broadcast sends frame to every client. Frames from a connection that has
+// been replaced are dropped; its successor delivers them.
+func (s *stream) broadcast(from *websocket.Conn, frame []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if from != nil && from != s.conn {
+		return
+	}
+	for c := range s.clients {
+		select {
+		case c.ch <- frame:
+		default:
+			// A client missing events would hold a wrong view of its orders
+			// and balances, so it is disconnected instead
+			delete(s.clients, c)
+			c.close()
+		}
+	}
+}
+
+func (s *stream) disconnected(conn *websocket.Conn, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped || s.conn != conn {
+		return
+	}
+	s.conn = nil
+
+	s.m.logger.Warn("user data stream disconnected, reconnecting",
+		logging.Field("api_type", s.m.apiType),
+		logging.Field("api_key", logging.MaskAPIKey(s.apiKey)),
+		logging.Field("error", err.Error()))
+	s.traceEventLocked("upstream disconnected", attribute.String("error", err.Error()))
+
+	go s.reconnect(time.Now())
+}
+
+// reconnect obtains a listen key and reconnects, backing off exponentially
+// with jitter, until it succeeds or the stream is stopped
+func (s *stream) reconnect(since time.Time) {
+	backoff := reconnectMinBackoff
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		listenKey, conn, err := s.connect(ctx)
+		cancel()
+
+		if err == nil {
+			s.mu.Lock()
+			if s.stopped {
+				s.mu.Unlock()
+				conn.Close()
+				return
+			}
+			s.listenKey = listenKey
+			s.adoptLocked(conn)
+			s.traceEventLocked("upstream reconnected",
+				attribute.Int64("downtime_ms", time.Since(since).Milliseconds()))
+			s.mu.Unlock()
+
+			s.m.logger.Info("user data stream reconnected",
+				logging.Field("api_type", s.m.apiType),
+				logging.Field("api_key", logging.MaskAPIKey(s.apiKey)),
+				logging.Field("downtime_ms", time.Since(since).Milliseconds()))
+
+			if s.m.notice {
+				notice, _ := json.Marshal(map[string]any{
+					"e":              "proxyReconnected",
+					"E":              time.Now().UnixMilli(),
+					"disconnectedAt": since.UnixMilli(),
+				})
+				s.broadcast(nil, notice)
+			}
+			return
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-time.After(backoff/2 + rand.N(backoff/2)):
+		}
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+}
+
+// rotate replaces old with a new connection to the same listen key. Should
+// that fail, the reconnect loop takes over when Binance closes old.
+func (s *stream) rotate(old *websocket.Conn) {
+	s.mu.Lock()
+	if s.stopped || s.conn != old {
+		s.mu.Unlock()
+		return
+	}
+	listenKey := s.listenKey
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	conn, err := s.dial(ctx, listenKey)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped || s.conn != old {
+		conn.Close()
+		return
+	}
+	s.adoptLocked(conn)
+	old.Close()
+	s.traceEventLocked("upstream replaced")
+}
+
+// traceEventLocked records an upstream connection event on the span of every
+// client. Called with s.mu held.
+func (s *stream) traceEventLocked(name string, attrs ...attribute.KeyValue) {
+	for c := range s.clients {
+		c.span.AddEvent(name, trace.WithAttributes(attrs...))
+	}
+}
+
+// keepAlive extends the listen key every 30 minutes. A key Binance no longer
+// knows is replaced by reconnecting.
+func (s *stream) keepAlive() {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		listenKey, conn := s.listenKey, s.conn
+		s.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		err := s.m.listenKeys.KeepAliveListenKey(ctx, s.m.apiType, s.credential, listenKey)
+		cancel()
+		if err == nil {
+			continue
+		}
+
+		s.m.logger.Warn("listen key keepalive failed",
+			logging.Field("api_type", s.m.apiType),
+			logging.Field("api_key", logging.MaskAPIKey(s.apiKey)),
+			logging.Field("error", err.Error()))
+
+		var apiErr *binance.APIError
+		if errors.As(err, &apiErr) && apiErr.Code == binance.ErrCodeInvalidListenKey && conn != nil {
+			conn.Close()
+		}
+	}
+}
@@ -9,6 +9,18 @@ const (
 	FuturesRestURL      = "https://fapi.binance.com"
 	FuturesWebSocketURL = "wss://fstream.binance.com"
 
+	// COIN-M futures API endpoints
+	CoinMRestURL      = "https://dapi.binance.com"
+	CoinMWebSocketURL = "wss://dstream.binance.com"
+
+	// Options API endpoints
+	OptionsRestURL      = "https://eapi.binance.com"
+	OptionsWebSocketURL = "wss://nbstream.binance.com/eoptions"
+
+	// Portfolio margin API endpoints. Its WebSocket carries user data only.
+	PortfolioMarginRestURL      = "https://papi.binance.com"
+	PortfolioMarginWebSocketURL = "wss://fstream.binance.com/pm"
+
 	// Authentication header
 	APIKeyHeader = "X-MBX-APIKEY"
 )
@@ -17,6 +29,87 @@ const (
 type APIType string
 
 const (
-	APITypeSpot    APIType = "spot"
-	APITypeFutures APIType = "futures"
+	APITypeSpot            APIType = "spot"
+	APITypeFutures         APIType = "futures"
+	APITypeCoinM           APIType = "coinm"
+	APITypeOptions         APIType = "options"
+	APITypePortfolioMargin APIType = "portfolio"
 )
+
+// Family holds the defaults of an API family the proxy knows. Paths are
+// empty where the family lacks the feature.
+type Family struct {
+	RestURL         string
+	WebSocketURL    string
+	WebSocketAPIURL string
+	PingPath        string
+	TimePath        string
+	DepthPath       string
+	ListenKeyPath   string
+	// Endpoints that cancel all open orders on a symbol; portfolio margin
+	// has one per market
+	CancelAllPaths []string
+	// REST endpoints that stream data can answer
+	BookTickerPath   string
+	PremiumIndexPath string
+}
+
+var families = map[APIType]Family{
+	APITypeSpot: {
+		RestURL:         SpotRestURL,
+		WebSocketURL:    SpotWebSocketURL,
+		WebSocketAPIURL: "wss://ws-api.binance.com:443/ws-api/v3",
+		PingPath:        "/api/v3/ping",
+		TimePath:        "/api/v3/time",
+		DepthPath:       "/api/v3/depth",
+		ListenKeyPath:   "/api/v3/userDataStream",
+		CancelAllPaths:  []string{"/api/v3/openOrders"},
+		BookTickerPath:  "/api/v3/ticker/bookTicker",
+	},
+	APITypeFutures: {
+		RestURL:          FuturesRestURL,
+		WebSocketURL:     FuturesWebSocketURL,
+		WebSocketAPIURL:  "wss://ws-fapi.binance.com/ws-fapi/v1",
+		PingPath:         "/fapi/v1/ping",
+		TimePath:         "/fapi/v1/time",
+		DepthPath:        "/fapi/v1/depth",
+		ListenKeyPath:    "/fapi/v1/listenKey",
+		CancelAllPaths:   []string{"/fapi/v1/allOpenOrders"},
+		BookTickerPath:   "/fapi/v1/ticker/bookTicker",
+		PremiumIndexPath: "/fapi/v1/premiumIndex",
+	},
+	APITypeCoinM: {
+		RestURL:        CoinMRestURL,
+		WebSocketURL:   CoinMWebSocketURL,
+		PingPath:       "/dapi/v1/ping",
+		TimePath:       "/dapi/v1/time",
+		DepthPath:      "/dapi/v1/depth",
+		ListenKeyPath:  "/dapi/v1/listenKey",
+		CancelAllPaths: []string{"/dapi/v1/allOpenOrders"},
+	},
+	APITypeOptions: {
+		RestURL:        OptionsRestURL,
+		WebSocketURL:   OptionsWebSocketURL,
+		PingPath:       "/eapi/v1/ping",
+		TimePath:       "/eapi/v1/time",
+		ListenKeyPath:  "/eapi/v1/listenKey",
+		CancelAllPaths: []string{"/eapi/v1/allOpenOrders"},
+	},
+	APITypePortfolioMargin: {
+		RestURL:       PortfolioMarginRestURL,
+		WebSocketURL:  PortfolioMarginWebSocketURL,
+		PingPath:      "/papi/v1/ping",
+		ListenKeyPath: "/papi/v1/listenKey",
+		CancelAllPaths: []string{
+			"/papi/v1/um/allOpenOrders",
+			"/papi/v1/cm/allOpenOrders",
+			"/papi/v1/margin/allOpenOrders",
+		},
+	},
+}
+
+// KnownFamily returns the defaults of a built-in API family
+func KnownFamily(apiType APIType) (Family, bool) {
+	f, ok := families[apiType]
+	return f, ok
+}
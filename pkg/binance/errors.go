@@ -0,0 +1,31 @@
+package binance
+
+import "fmt"
+
+// Error codes returned by Binance (and by the proxy when it answers on Binance's behalf)
+const (
+	ErrCodeUnknown          = -1000
+	ErrCodeDisconnected     = -1001
+	ErrCodeUnauthorized     = -1002
+	ErrCodeTooManyRequests  = -1003
+	ErrCodeFilterFailure    = -1013
+	ErrCodeTooManyOrders    = -1015
+	ErrCodeMandatoryParam   = -1102
+	ErrCodeInvalidOrderType = -1116
+	ErrCodeBadSymbol        = -1121
+	ErrCodeInvalidListenKey = -1125
+	ErrCodeNewOrderRejected = -2010
+	ErrCodeNoSuchOrder      = -2013
+	ErrCodeRejectedAPIKey   = -2015
+	ErrCodeInvalidLeverage  = -4028
+)
+
+// APIError is the JSON error body Binance returns
+type APIError struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("binance error %d: %s", e.Code, e.Msg)
+}
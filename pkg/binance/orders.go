@@ -0,0 +1,41 @@
+package binance
+
+import "strings"
+
+// orderQueries maps order placement endpoints to the endpoint that looks up
+// an order by symbol and origClientOrderId
+var orderQueries = map[string]string{
+	"POST /api/v3/order":         "/api/v3/order",
+	"POST /fapi/v1/order":        "/fapi/v1/order",
+	"POST /dapi/v1/order":        "/dapi/v1/order",
+	"POST /papi/v1/um/order":     "/papi/v1/um/order",
+	"POST /papi/v1/cm/order":     "/papi/v1/cm/order",
+	"POST /papi/v1/margin/order": "/papi/v1/margin/order",
+}
+
+// OrderQueryPath returns the path that looks up orders placed by a request,
+// if the request places a single order identified by newClientOrderId
+func OrderQueryPath(method, path string) (string, bool) {
+	query, ok := orderQueries[method+" "+path]
+	return query, ok
+}
+
+// contractPaths prefix the order endpoints whose quantity counts contracts
+// rather than the base asset
+var contractPaths = []string{"/dapi/", "/papi/v1/cm/"}
+
+// ContractSize returns the quote asset value of one contract of symbol for
+// orders on path sized in contracts, as on COIN-M, and 0 for orders sized in
+// the base asset. Binance lists it as contractSize in exchangeInfo: 100 USD
+// for BTCUSD contracts and 10 USD for all others.
+func ContractSize(path, symbol string) float64 {
+	for _, prefix := range contractPaths {
+		if strings.HasPrefix(path, prefix) {
+			if strings.HasPrefix(symbol, "BTCUSD_") {
+				return 100
+			}
+			return 10
+		}
+	}
+	return 0
+}
@@ -0,0 +1,315 @@
+package binance
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultWeight is charged for endpoints missing from the weight table
+const DefaultWeight = 1
+
+// SecurityType is the authentication Binance requires for an endpoint
+type SecurityType int
+
+const (
+	SecurityNone   SecurityType = iota
+	SecurityAPIKey              // API key header only (USER_STREAM, MARKET_DATA)
+	SecuritySigned              // API key header and signature (TRADE, USER_DATA)
+)
+
+// Endpoint describes the rate limit cost and security of a Binance REST endpoint
+type Endpoint struct {
+	Weight   int // IP request weight
+	Orders   int // order count consumed per request
+	Security SecurityType
+
+	weightFn func(q url.Values) int
+}
+
+var endpoints = map[string]Endpoint{
+	// Spot market data
+	"GET /api/v3/ping":              {Weight: 1},
+	"GET /api/v3/time":              {Weight: 1},
+	"GET /api/v3/exchangeInfo":      {Weight: 20},
+	"GET /api/v3/depth":             {weightFn: spotDepthWeight},
+	"GET /api/v3/trades":            {Weight: 25},
+	"GET /api/v3/historicalTrades":  {Weight: 25, Security: SecurityAPIKey},
+	"GET /api/v3/aggTrades":         {Weight: 2},
+	"GET /api/v3/klines":            {Weight: 2},
+	"GET /api/v3/uiKlines":          {Weight: 2},
+	"GET /api/v3/avgPrice":          {Weight: 2},
+	"GET /api/v3/ticker/24hr":       {weightFn: spotTicker24hrWeight},
+	"GET /api/v3/ticker/tradingDay": {weightFn: perSymbolWeight(4, 200)},
+	"GET /api/v3/ticker":            {weightFn: perSymbolWeight(4, 200)},
+	"GET /api/v3/ticker/price":      {weightFn: symbolWeight(2, 4)},
+	"GET /api/v3/ticker/bookTicker": {weightFn: symbolWeight(2, 4)},
+	"POST /api/v3/userDataStream":   {Weight: 2, Security: SecurityAPIKey},
+	"PUT /api/v3/userDataStream":    {Weight: 2, Security: SecurityAPIKey},
+	"DELETE /api/v3/userDataStream": {Weight: 2, Security: SecurityAPIKey},
+
+	// Spot trading and account
+	"POST /api/v3/order":               {Weight: 1, Orders: 1, Security: SecuritySigned},
+	"POST /api/v3/order/test":          {Weight: 1, Security: SecuritySigned},
+	"POST /api/v3/order/cancelReplace": {Weight: 1, Orders: 1, Security: SecuritySigned},
+	"POST /api/v3/order/oco":           {Weight: 1, Orders: 2, Security: SecuritySigned},
+	"POST /api/v3/orderList/oco":       {Weight: 1, Orders: 2, Security: SecuritySigned},
+	"POST /api/v3/orderList/oto":       {Weight: 1, Orders: 2, Security: SecuritySigned},
+	"POST /api/v3/orderList/otoco":     {Weight: 1, Orders: 3, Security: SecuritySigned},
+	"POST /api/v3/sor/order":           {Weight: 1, Orders: 1, Security: SecuritySigned},
+	"GET /api/v3/order":                {Weight: 4, Security: SecuritySigned},
+	"DELETE /api/v3/order":             {Weight: 1, Security: SecuritySigned},
+	"DELETE /api/v3/openOrders":        {Weight: 1, Security: SecuritySigned},
+	"GET /api/v3/openOrders":           {weightFn: symbolWeight(6, 80), Security: SecuritySigned},
+	"GET /api/v3/allOrders":            {Weight: 20, Security: SecuritySigned},
+	"GET /api/v3/orderList":            {Weight: 4, Security: SecuritySigned},
+	"DELETE /api/v3/orderList":         {Weight: 1, Security: SecuritySigned},
+	"GET /api/v3/allOrderList":         {Weight: 20, Security: SecuritySigned},
+	"GET /api/v3/openOrderList":        {Weight: 6, Security: SecuritySigned},
+	"GET /api/v3/account":              {Weight: 20, Security: SecuritySigned},
+	"GET /api/v3/myTrades":             {Weight: 20, Security: SecuritySigned},
+	"GET /api/v3/rateLimit/order":      {Weight: 40, Security: SecuritySigned},
+	"GET /api/v3/account/commission":   {Weight: 20, Security: SecuritySigned},
+	"GET /api/v3/myPreventedMatches":   {weightFn: symbolWeight(2, 20), Security: SecuritySigned},
+	"GET /api/v3/myAllocations":        {Weight: 20, Security: SecuritySigned},
+
+	// USD-M futures market data
+	"GET /fapi/v1/ping":              {Weight: 1},
+	"GET /fapi/v1/time":              {Weight: 1},
+	"GET /fapi/v1/exchangeInfo":      {Weight: 1},
+	"GET /fapi/v1/depth":             {weightFn: futuresDepthWeight},
+	"GET /fapi/v1/trades":            {Weight: 5},
+	"GET /fapi/v1/historicalTrades":  {Weight: 20},
+	"GET /fapi/v1/aggTrades":         {Weight: 20},
+	"GET /fapi/v1/klines":            {weightFn: futuresKlinesWeight},
+	"GET /fapi/v1/continuousKlines":  {weightFn: futuresKlinesWeight},
+	"GET /fapi/v1/indexPriceKlines":  {weightFn: futuresKlinesWeight},
+	"GET /fapi/v1/markPriceKlines":   {weightFn: futuresKlinesWeight},
+	"GET /fapi/v1/premiumIndex":      {weightFn: symbolWeight(1, 10)},
+	"GET /fapi/v1/fundingRate":       {Weight: 1},
+	"GET /fapi/v1/ticker/24hr":       {weightFn: symbolWeight(1, 40)},
+	"GET /fapi/v1/ticker/price":      {weightFn: symbolWeight(1, 2)},
+	"GET /fapi/v2/ticker/price":      {weightFn: symbolWeight(1, 2)},
+	"GET /fapi/v1/ticker/bookTicker": {weightFn: symbolWeight(2, 5)},
+	"GET /fapi/v1/openInterest":      {Weight: 1},
+	"POST /fapi/v1/listenKey":        {Weight: 1, Security: SecurityAPIKey},
+	"PUT /fapi/v1/listenKey":         {Weight: 1, Security: SecurityAPIKey},
+	"DELETE /fapi/v1/listenKey":      {Weight: 1, Security: SecurityAPIKey},
+
+	// USD-M futures trading and account
+	"POST /fapi/v1/order":             {Weight: 0, Orders: 1, Security: SecuritySigned},
+	"PUT /fapi/v1/order":              {Weight: 1, Orders: 1, Security: SecuritySigned},
+	"POST /fapi/v1/batchOrders":       {Weight: 5, Orders: 5, Security: SecuritySigned},
+	"PUT /fapi/v1/batchOrders":        {Weight: 5, Orders: 5, Security: SecuritySigned},
+	"GET /fapi/v1/order":              {Weight: 1, Security: SecuritySigned},
+	"DELETE /fapi/v1/order":           {Weight: 1, Security: SecuritySigned},
+	"DELETE /fapi/v1/batchOrders":     {Weight: 1, Security: SecuritySigned},
+	"DELETE /fapi/v1/allOpenOrders":   {Weight: 1, Security: SecuritySigned},
+	"GET /fapi/v1/openOrder":          {Weight: 1, Security: SecuritySigned},
+	"GET /fapi/v1/openOrders":         {weightFn: symbolWeight(1, 40), Security: SecuritySigned},
+	"GET /fapi/v1/allOrders":          {Weight: 5, Security: SecuritySigned},
+	"GET /fapi/v2/account":            {Weight: 5, Security: SecuritySigned},
+	"GET /fapi/v3/account":            {Weight: 5, Security: SecuritySigned},
+	"GET /fapi/v2/balance":            {Weight: 5, Security: SecuritySigned},
+	"GET /fapi/v3/balance":            {Weight: 5, Security: SecuritySigned},
+	"GET /fapi/v2/positionRisk":       {Weight: 5, Security: SecuritySigned},
+	"GET /fapi/v3/positionRisk":       {Weight: 5, Security: SecuritySigned},
+	"GET /fapi/v1/userTrades":         {Weight: 5, Security: SecuritySigned},
+	"GET /fapi/v1/income":             {Weight: 30, Security: SecuritySigned},
+	"POST /fapi/v1/leverage":          {Weight: 1, Security: SecuritySigned},
+	"POST /fapi/v1/marginType":        {Weight: 1, Security: SecuritySigned},
+	"POST /fapi/v1/positionSide/dual": {Weight: 1, Security: SecuritySigned},
+
+	// COIN-M futures
+	"GET /dapi/v1/ping":             {Weight: 1},
+	"GET /dapi/v1/time":             {Weight: 1},
+	"GET /dapi/v1/exchangeInfo":     {Weight: 1},
+	"GET /dapi/v1/depth":            {weightFn: futuresDepthWeight},
+	"GET /dapi/v1/klines":           {weightFn: futuresKlinesWeight},
+	"POST /dapi/v1/listenKey":       {Weight: 1, Security: SecurityAPIKey},
+	"PUT /dapi/v1/listenKey":        {Weight: 1, Security: SecurityAPIKey},
+	"DELETE /dapi/v1/listenKey":     {Weight: 1, Security: SecurityAPIKey},
+	"POST /dapi/v1/order":           {Weight: 1, Orders: 1, Security: SecuritySigned},
+	"PUT /dapi/v1/order":            {Weight: 1, Orders: 1, Security: SecuritySigned},
+	"POST /dapi/v1/batchOrders":     {Weight: 5, Orders: 5, Security: SecuritySigned},
+	"PUT /dapi/v1/batchOrders":      {Weight: 5, Orders: 5, Security: SecuritySigned},
+	"GET /dapi/v1/order":            {Weight: 1, Security: SecuritySigned},
+	"DELETE /dapi/v1/order":         {Weight: 1, Security: SecuritySigned},
+	"DELETE /dapi/v1/batchOrders":   {Weight: 1, Security: SecuritySigned},
+	"DELETE /dapi/v1/allOpenOrders": {Weight: 1, Security: SecuritySigned},
+	"GET /dapi/v1/openOrders":       {weightFn: symbolWeight(1, 40), Security: SecuritySigned},
+	"GET /dapi/v1/account":          {Weight: 5, Security: SecuritySigned},
+	"GET /dapi/v1/balance":          {Weight: 1, Security: SecuritySigned},
+	"GET /dapi/v1/positionRisk":     {Weight: 1, Security: SecuritySigned},
+	"POST /dapi/v1/leverage":        {Weight: 1, Security: SecuritySigned},
+
+	// Options
+	"GET /eapi/v1/time":             {Weight: 1},
+	"GET /eapi/v1/exchangeInfo":     {Weight: 1},
+	"POST /eapi/v1/listenKey":       {Weight: 1, Security: SecurityAPIKey},
+	"PUT /eapi/v1/listenKey":        {Weight: 1, Security: SecurityAPIKey},
+	"DELETE /eapi/v1/listenKey":     {Weight: 1, Security: SecurityAPIKey},
+	"POST /eapi/v1/order":           {Weight: 1, Orders: 1, Security: SecuritySigned},
+	"POST /eapi/v1/batchOrders":     {Weight: 5, Orders: 10, Security: SecuritySigned},
+	"GET /eapi/v1/order":            {Weight: 1, Security: SecuritySigned},
+	"DELETE /eapi/v1/order":         {Weight: 1, Security: SecuritySigned},
+	"DELETE /eapi/v1/batchOrders":   {Weight: 1, Security: SecuritySigned},
+	"DELETE /eapi/v1/allOpenOrders": {Weight: 1, Security: SecuritySigned},
+
+	// Portfolio margin
+	"POST /papi/v1/listenKey":              {Weight: 1, Security: SecurityAPIKey},
+	"PUT /papi/v1/listenKey":               {Weight: 1, Security: SecurityAPIKey},
+	"DELETE /papi/v1/listenKey":            {Weight: 1, Security: SecurityAPIKey},
+	"POST /papi/v1/um/order":               {Weight: 1, Orders: 1, Security: SecuritySigned},
+	"PUT /papi/v1/um/order":                {Weight: 1, Orders: 1, Security: SecuritySigned},
+	"POST /papi/v1/cm/order":               {Weight: 1, Orders: 1, Security: SecuritySigned},
+	"PUT /papi/v1/cm/order":                {Weight: 1, Orders: 1, Security: SecuritySigned},
+	"POST /papi/v1/margin/order":           {Weight: 1, Orders: 1, Security: SecuritySigned},
+	"DELETE /papi/v1/um/order":             {Weight: 1, Security: SecuritySigned},
+	"DELETE /papi/v1/cm/order":             {Weight: 1, Security: SecuritySigned},
+	"DELETE /papi/v1/margin/order":         {Weight: 2, Security: SecuritySigned},
+	"DELETE /papi/v1/um/allOpenOrders":     {Weight: 1, Security: SecuritySigned},
+	"DELETE /papi/v1/cm/allOpenOrders":     {Weight: 1, Security: SecuritySigned},
+	"DELETE /papi/v1/margin/allOpenOrders": {Weight: 5, Security: SecuritySigned},
+	"POST /papi/v1/um/leverage":            {Weight: 1, Security: SecuritySigned},
+	"POST /papi/v1/cm/leverage":            {Weight: 1, Security: SecuritySigned},
+	"GET /papi/v1/account":                 {Weight: 20, Security: SecuritySigned},
+	"GET /papi/v1/balance":                 {Weight: 20, Security: SecuritySigned},
+}
+
+// LookupEndpoint returns the rate limit metadata for a method and path
+func LookupEndpoint(method, path string) (Endpoint, bool) {
+	ep, ok := endpoints[method+" "+path]
+	return ep, ok
+}
+
+// RequestWeight returns the IP weight a request consumes
+func RequestWeight(method, path string, query url.Values) int {
+	ep, ok := LookupEndpoint(method, path)
+	if !ok {
+		return DefaultWeight
+	}
+	if ep.weightFn != nil {
+		return ep.weightFn(query)
+	}
+	return ep.Weight
+}
+
+// AddOrderEndpoint registers an endpoint of a configured API family that
+// places one order per request, so that it counts against the order limits
+// and is subject to the kill switch and risk checks. Endpoints already in the
+// table keep their entry. It must be called before requests are served.
+func AddOrderEndpoint(method, path string) {
+	key := method + " " + path
+	if _, ok := endpoints[key]; !ok {
+		endpoints[key] = Endpoint{Weight: DefaultWeight, Orders: 1, Security: SecuritySigned}
+	}
+}
+
+// OrderCount returns how many orders a request counts against the account order limits
+func OrderCount(method, path string) int {
+	ep, _ := LookupEndpoint(method, path)
+	return ep.Orders
+}
+
+// RequiresSignature reports whether a request must carry a signature. Endpoints
+// missing from the table are treated as signed when the client sent a
+// timestamp or signature itself.
+func RequiresSignature(method, path string, params url.Values) bool {
+	if ep, ok := LookupEndpoint(method, path); ok {
+		return ep.Security == SecuritySigned
+	}
+	return params.Has("signature") || params.Has("timestamp")
+}
+
+func symbolWeight(withSymbol, without int) func(url.Values) int {
+	return func(q url.Values) int {
+		if q.Get("symbol") != "" {
+			return withSymbol
+		}
+		return without
+	}
+}
+
+func perSymbolWeight(per, max int) func(url.Values) int {
+	return func(q url.Values) int {
+		n := symbolCount(q)
+		if n == 0 {
+			return max
+		}
+		if w := per * n; w < max {
+			return w
+		}
+		return max
+	}
+}
+
+func symbolCount(q url.Values) int {
+	if q.Get("symbol") != "" {
+		return 1
+	}
+	symbols := strings.Trim(q.Get("symbols"), "[]")
+	if symbols == "" {
+		return 0
+	}
+	return strings.Count(symbols, ",") + 1
+}
+
+func spotDepthWeight(q url.Values) int {
+	switch limit := intParam(q, "limit", 100); {
+	case limit <= 100:
+		return 5
+	case limit <= 500:
+		return 25
+	case limit <= 1000:
+		return 50
+	default:
+		return 250
+	}
+}
+
+func spotTicker24hrWeight(q url.Values) int {
+	switch n := symbolCount(q); {
+	case n == 0:
+		return 80
+	case n <= 20:
+		return 2
+	case n <= 100:
+		return 40
+	default:
+		return 80
+	}
+}
+
+func futuresDepthWeight(q url.Values) int {
+	switch limit := intParam(q, "limit", 500); {
+	case limit <= 50:
+		return 2
+	case limit <= 100:
+		return 5
+	case limit <= 500:
+		return 10
+	default:
+		return 20
+	}
+}
+
+func futuresKlinesWeight(q url.Values) int {
+	switch limit := intParam(q, "limit", 500); {
+	case limit < 100:
+		return 1
+	case limit < 500:
+		return 2
+	case limit <= 1000:
+		return 5
+	default:
+		return 10
+	}
+}
+
+func intParam(q url.Values, key string, def int) int {
+	if n, err := strconv.Atoi(q.Get(key)); err == nil {
+		return n
+	}
+	return def
+}
@@ -0,0 +1,76 @@
+package binance
+
+import "strings"
+
+// wsAPIMethods maps WebSocket API methods to the REST endpoints they are
+// equivalent to, so that weights, policies and risk checks written for REST
+// paths apply to them as well
+var wsAPIMethods = map[APIType]map[string]string{
+	APITypeSpot: {
+		"ping":                      "GET /api/v3/ping",
+		"time":                      "GET /api/v3/time",
+		"exchangeInfo":              "GET /api/v3/exchangeInfo",
+		"depth":                     "GET /api/v3/depth",
+		"trades.recent":             "GET /api/v3/trades",
+		"trades.historical":         "GET /api/v3/historicalTrades",
+		"trades.aggregate":          "GET /api/v3/aggTrades",
+		"klines":                    "GET /api/v3/klines",
+		"uiKlines":                  "GET /api/v3/uiKlines",
+		"avgPrice":                  "GET /api/v3/avgPrice",
+		"ticker.24hr":               "GET /api/v3/ticker/24hr",
+		"ticker.price":              "GET /api/v3/ticker/price",
+		"ticker.book":               "GET /api/v3/ticker/bookTicker",
+		"ticker":                    "GET /api/v3/ticker",
+		"order.place":               "POST /api/v3/order",
+		"order.test":                "POST /api/v3/order/test",
+		"order.status":              "GET /api/v3/order",
+		"order.cancel":              "DELETE /api/v3/order",
+		"order.cancelReplace":       "POST /api/v3/order/cancelReplace",
+		"orderList.place":           "POST /api/v3/order/oco",
+		"orderList.place.oco":       "POST /api/v3/orderList/oco",
+		"orderList.place.oto":       "POST /api/v3/orderList/oto",
+		"orderList.place.otoco":     "POST /api/v3/orderList/otoco",
+		"openOrders.status":         "GET /api/v3/openOrders",
+		"openOrders.cancelAll":      "DELETE /api/v3/openOrders",
+		"sor.order.place":           "POST /api/v3/sor/order",
+		"sor.order.test":            "POST /api/v3/sor/order/test",
+		"account.status":            "GET /api/v3/account",
+		"account.rateLimits.orders": "GET /api/v3/rateLimit/order",
+		"account.commission":        "GET /api/v3/account/commission",
+		"allOrders":                 "GET /api/v3/allOrders",
+		"myTrades":                  "GET /api/v3/myTrades",
+		"myPreventedMatches":        "GET /api/v3/myPreventedMatches",
+		"myAllocations":             "GET /api/v3/myAllocations",
+		"orderList.status":          "GET /api/v3/orderList",
+		"orderList.cancel":          "DELETE /api/v3/orderList",
+		"openOrderLists.status":     "GET /api/v3/openOrderList",
+		"allOrderLists":             "GET /api/v3/allOrderList",
+		"ticker.tradingDay":         "GET /api/v3/ticker/tradingDay",
+	},
+	APITypeFutures: {
+		"depth":               "GET /fapi/v1/depth",
+		"ticker.price":        "GET /fapi/v1/ticker/price",
+		"ticker.book":         "GET /fapi/v1/ticker/bookTicker",
+		"order.place":         "POST /fapi/v1/order",
+		"order.modify":        "PUT /fapi/v1/order",
+		"order.cancel":        "DELETE /fapi/v1/order",
+		"order.status":        "GET /fapi/v1/order",
+		"account.position":    "GET /fapi/v2/positionRisk",
+		"account.balance":     "GET /fapi/v2/balance",
+		"account.status":      "GET /fapi/v2/account",
+		"v2/account.position": "GET /fapi/v3/positionRisk",
+		"v2/account.balance":  "GET /fapi/v3/balance",
+		"v2/account.status":   "GET /fapi/v3/account",
+	},
+}
+
+// WSAPIEndpoint returns the REST method and path equivalent to a WebSocket
+// API method. Session and user data stream methods have no equivalent.
+func WSAPIEndpoint(apiType APIType, method string) (httpMethod, path string, ok bool) {
+	endpoint, ok := wsAPIMethods[apiType][method]
+	if !ok {
+		return "", "", false
+	}
+	httpMethod, path, _ = strings.Cut(endpoint, " ")
+	return httpMethod, path, true
+}